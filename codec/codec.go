@@ -0,0 +1,170 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// 帧的编码模式，由连接上读到的第一个字节决定
+type Mode int
+
+const (
+	ModeUnknown Mode = iota // 还没有读到第一帧，模式未确定
+	ModeLength              // 长度前缀模式: 4字节大端长度 + 消息体
+	ModeLine                // 换行分隔模式，兼容 telnet 这类原始文本客户端
+)
+
+const (
+	HeaderSize      = 4         // 长度前缀的字节数
+	MaxMaxFrameSize = 1<<24 - 1 // 长度前缀的最高字节必须为0，才能和文本模式区分开
+)
+
+// 帧超过最大长度时返回，超长的部分已被丢弃，调用者可以继续读取下一帧
+var ErrFrameTooLarge = errors.New("codec: frame too large")
+
+func (m Mode) String() string {
+	switch m {
+	case ModeLength:
+		return "length"
+	case ModeLine:
+		return "line"
+	default:
+		return "unknown"
+	}
+}
+
+// 从字节流中切分出完整消息的解码器
+// 第一个字节为0时认为是长度前缀模式，否则是换行分隔模式，模式确定后不再改变
+type Decoder struct {
+	r            *bufio.Reader
+	maxFrameSize int          // 单帧消息的最大字节数
+	mode         atomic.Int32 // 当前连接的编码模式，Decode 写入，发送消息的协程读取
+}
+
+func NewDecoder(r io.Reader, maxFrameSize int) *Decoder {
+	if maxFrameSize <= 0 || maxFrameSize > MaxMaxFrameSize {
+		panic(fmt.Sprintf("codec: maxFrameSize 必须在 1 到 %d 之间", MaxMaxFrameSize))
+	}
+	return &Decoder{
+		r:            bufio.NewReader(r),
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// 当前连接的编码模式，在第一次 Decode 之前为 ModeUnknown，可以在其他协程中调用
+func (d *Decoder) Mode() Mode {
+	return Mode(d.mode.Load())
+}
+
+// 读取一帧完整的消息，不包含长度前缀和结尾的换行符
+func (d *Decoder) Decode() ([]byte, error) {
+	if d.Mode() == ModeUnknown {
+		first, err := d.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] == 0 {
+			d.mode.Store(int32(ModeLength))
+		} else {
+			d.mode.Store(int32(ModeLine))
+		}
+	}
+	if d.Mode() == ModeLength {
+		return d.decodeLength()
+	}
+	return d.decodeLine()
+}
+
+// 长度前缀模式: 先读4字节的长度，再读对应长度的消息体
+func (d *Decoder) decodeLength() ([]byte, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > uint32(d.maxFrameSize) {
+		if _, err := io.CopyN(io.Discard, d.r, int64(n)); err != nil {
+			return nil, noEOF(err)
+		}
+		return nil, ErrFrameTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return nil, noEOF(err)
+	}
+	return body, nil
+}
+
+// 换行分隔模式: 读到 '\n' 为止，去掉结尾的 "\r\n"，跳过空行
+func (d *Decoder) decodeLine() ([]byte, error) {
+	for {
+		var line []byte
+		tooLarge := false
+		for {
+			chunk, err := d.r.ReadSlice('\n')
+			if !tooLarge {
+				line = append(line, chunk...)
+				if len(line) > d.maxFrameSize+2 { // 允许结尾的 "\r\n"
+					tooLarge, line = true, nil
+				}
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				if err == io.EOF && (len(line) > 0 || tooLarge) {
+					return nil, io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			break
+		}
+		if tooLarge {
+			return nil, ErrFrameTooLarge
+		}
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > d.maxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// 把 msg 按照 mode 编码成一帧，一次性写入 w
+func Encode(w io.Writer, mode Mode, msg []byte) error {
+	var frame []byte
+	switch mode {
+	case ModeLength:
+		if len(msg) > MaxMaxFrameSize {
+			return ErrFrameTooLarge
+		}
+		frame = make([]byte, HeaderSize+len(msg))
+		binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+		copy(frame[HeaderSize:], msg)
+	default:
+		frame = make([]byte, 0, len(msg)+1)
+		frame = append(frame, msg...)
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			frame = append(frame, '\n')
+		}
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// 读到一半的帧遇到 EOF 属于异常断开
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// 在 net.Pipe 的一端按 writes 分多次写入，另一端用 Decoder 读出所有帧
+func decodeOverPipe(t *testing.T, maxFrameSize int, writes ...[]byte) ([]string, []error) {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		for _, w := range writes {
+			if _, err := client.Write(w); err != nil {
+				t.Errorf("write: %v", err)
+			}
+		}
+		client.Close()
+	}()
+	d := NewDecoder(server, maxFrameSize)
+	var msgs []string
+	var errs []error
+	for {
+		msg, err := d.Decode()
+		if err == io.EOF {
+			return msgs, errs
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if !errors.Is(err, ErrFrameTooLarge) {
+				return msgs, errs
+			}
+			continue
+		}
+		msgs = append(msgs, string(msg))
+	}
+}
+
+func frame(msg string) []byte {
+	var buf bytes.Buffer
+	Encode(&buf, ModeLength, []byte(msg))
+	return buf.Bytes()
+}
+
+func assertMsgs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLengthSplitWrites(t *testing.T) {
+	f := frame("1|hello world")
+	msgs, errs := decodeOverPipe(t, 64, f[:2], f[2:5], f[5:9], f[9:])
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	assertMsgs(t, msgs, "1|hello world")
+}
+
+func TestLengthCoalescedWrites(t *testing.T) {
+	all := append(append(frame("1|a"), frame("1|b|c")...), frame("3")...)
+	msgs, errs := decodeOverPipe(t, 64, all)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	assertMsgs(t, msgs, "1|a", "1|b|c", "3")
+}
+
+func TestLengthFrameTooLarge(t *testing.T) {
+	all := append(append(frame("1|a"), frame("1|this frame is too large")...), frame("3")...)
+	msgs, errs := decodeOverPipe(t, 8, all)
+	if len(errs) != 1 || !errors.Is(errs[0], ErrFrameTooLarge) {
+		t.Fatalf("want one ErrFrameTooLarge, got %v", errs)
+	}
+	assertMsgs(t, msgs, "1|a", "3")
+}
+
+func TestLengthTruncatedFrame(t *testing.T) {
+	f := frame("1|hello")
+	_, errs := decodeOverPipe(t, 64, f[:len(f)-2])
+	if len(errs) != 1 || errs[0] != io.ErrUnexpectedEOF {
+		t.Fatalf("want io.ErrUnexpectedEOF, got %v", errs)
+	}
+}
+
+func TestLineSplitAndCoalescedWrites(t *testing.T) {
+	msgs, errs := decodeOverPipe(t, 64,
+		[]byte("1|he"), []byte("llo\r\n2\n\n4"), []byte("\n0|a|b\n"))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	assertMsgs(t, msgs, "1|hello", "2", "4", "0|a|b")
+}
+
+func TestLineFrameTooLarge(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 5000)
+	msgs, errs := decodeOverPipe(t, 16, []byte("1|a\n"), long, []byte("\n3\n"))
+	if len(errs) != 1 || !errors.Is(errs[0], ErrFrameTooLarge) {
+		t.Fatalf("want one ErrFrameTooLarge, got %v", errs)
+	}
+	assertMsgs(t, msgs, "1|a", "3")
+}
+
+func TestModeDetection(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(frame("x")), 16)
+	if _, err := d.Decode(); err != nil || d.Mode() != ModeLength {
+		t.Fatalf("mode = %v, err = %v", d.Mode(), err)
+	}
+	d = NewDecoder(bytes.NewReader([]byte("x\n")), 16)
+	if _, err := d.Decode(); err != nil || d.Mode() != ModeLine {
+		t.Fatalf("mode = %v, err = %v", d.Mode(), err)
+	}
+}
+
+func TestEncodeLength(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, ModeLength, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(buf.Bytes()); n != 3 || buf.String()[HeaderSize:] != "abc" {
+		t.Fatalf("bad frame %q", buf.Bytes())
+	}
+}
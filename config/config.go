@@ -0,0 +1,367 @@
+package config
+
+import (
+	"bytes"
+	"chatroom/codec"
+	"chatroom/parameter"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidConfig = errors.New("config: invalid config")
+
+// 服务器的全部配置，优先级从低到高: parameter 中的默认值、YAML 配置文件、CHATROOM_* 环境变量、命令行参数
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Mongo     MongoConfig     `yaml:"mongo"`
+	Manager   ManagerConfig   `yaml:"manager"`
+	Chatroom  ChatroomConfig  `yaml:"chatroom"`
+	History   HistoryConfig   `yaml:"history"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Log       LogConfig       `yaml:"log"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Heartbeat HeartbeatConfig `yaml:"heartbeat"`
+	User      UserConfig      `yaml:"user"`
+}
+
+// 监听地址和 TLS 的配置
+type ServerConfig struct {
+	IP            string `yaml:"ip"`             // 聊天室的IP地址
+	Port          string `yaml:"port"`           // 聊天室的端口号
+	WebSocketPort string `yaml:"websocket_port"` // WebSocket 网关的端口号，为空时不开启
+	WebSocketPath string `yaml:"websocket_path"` // WebSocket 网关的路径
+	// 允许连接 WebSocket 网关的浏览器来源，逗号分隔，例如 https://chat.example.com
+	// 同源的页面和不带 Origin 的非浏览器客户端总是允许，* 允许任意来源，不能和 client_ca_file 一起使用
+	WebSocketOrigins  string        `yaml:"websocket_origins"`
+	CertFile          string        `yaml:"cert_file"`           // TLS 证书文件，为空时使用明文
+	KeyFile           string        `yaml:"key_file"`            // TLS 私钥文件
+	ClientCAFile      string        `yaml:"client_ca_file"`      // 校验客户端证书的 CA 文件
+	MaxFrameSize      int           `yaml:"max_frame_size"`      // 单帧消息的最大字节数，超过的消息会被丢弃
+	ResumeGracePeriod time.Duration `yaml:"resume_grace_period"` // 断线后可以用重连令牌恢复会话的宽限期
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`    // 收到 SIGINT/SIGTERM 后等待用户和后台协程退出的最长时间
+}
+
+// websocket_origins 中的每一个来源
+func (s ServerConfig) WebSocketOriginList() []string {
+	var origins []string
+	for _, origin := range strings.Split(s.WebSocketOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// 来源是 * 或者只有 scheme 和 host 的 URL
+func validOrigins(origins []string) bool {
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Mongo 连接的配置
+type MongoConfig struct {
+	URL      string        `yaml:"url"`       // 数据连接的url
+	Database string        `yaml:"database"`  // 对应数据库名称
+	PoolSize uint64        `yaml:"pool_size"` // 数据库连接池大小
+	Timeout  time.Duration `yaml:"timeout"`   // 连接和每次访问的超时时间
+}
+
+// ChatroomManager 的配置
+type ManagerConfig struct {
+	MaxRooms           int    `yaml:"max_rooms"`            // 一个 ChatroomManager 管理的最大聊天室数量
+	MaxRetries         int    `yaml:"max_retries"`          // 随机分配房间时概率采样的重试次数
+	MaxWaiting         int    `yaml:"max_waiting"`          // 所有房间都满时等待进入房间的最大人数，为0时直接拒绝
+	AssignStrategy     string `yaml:"assign_strategy"`      // 分配房间的策略: random、least_loaded、fill_first、round_robin 或 affinity
+	MaxAffinityEntries int    `yaml:"max_affinity_entries"` // affinity 策略最多记住的 IP 或账号数
+}
+
+// Chatroom 的配置
+type ChatroomConfig struct {
+	MaxUsers           int           `yaml:"max_users"`            // 一个 Chatroom 容纳 User 的最大数量
+	RingCapacity       int           `yaml:"ring_capacity"`        // 每个房间 MsgRecording 保存的最近消息条数
+	SlowConsumerPolicy string        `yaml:"slow_consumer_policy"` // 默认的 drop_oldest、disconnect 或 spill_to_disk
+	IdleAwayAfter      time.Duration `yaml:"idle_away_after"`      // 成员多久没有发送消息之后自动标记为空闲，为0时不自动标记
+	MaxMuteDuration    time.Duration `yaml:"max_mute_duration"`    // 房主和管理员一次最长可以禁言的时间
+}
+
+// 聊天记录的配置
+type HistoryConfig struct {
+	Persist        bool `yaml:"persist"`          // 是否把聊天记录保存到 mongo 的 messages 集合
+	ReplaySize     int  `yaml:"replay_size"`      // 进入房间时补发的最近消息条数
+	MaxPageSize    int  `yaml:"max_page_size"`    // history 命令一次最多返回的消息条数
+	BufferSize     int  `yaml:"buffer_size"`      // 等待写入数据库的聊天记录缓冲区大小
+	FlushBatchSize int  `yaml:"flush_batch_size"` // 每次批量写入数据库的最大条数
+}
+
+// 管理接口的配置
+type AdminConfig struct {
+	Addr  string `yaml:"addr"`  // 管理接口监听的地址，例如 127.0.0.1:9090，为空时不开启
+	Token string `yaml:"token"` // 请求需要带上 Authorization: Bearer <token>
+}
+
+// Prometheus 指标的配置
+type MetricsConfig struct {
+	Addr string `yaml:"addr"` // 以 Prometheus 文本格式输出 /metrics 的地址，例如 127.0.0.1:9100，为空时不开启
+}
+
+// 日志的配置
+type LogConfig struct {
+	Level        string `yaml:"level"`         // debug、info、warn 或 error
+	Format       string `yaml:"format"`        // text 或 json
+	RedactBodies bool   `yaml:"redact_bodies"` // 日志中是否隐藏消息内容，只记录长度
+}
+
+// 限流的配置，burst 为0时不限制对应类型的请求
+// 超过限制先警告，连续 mute_after 次之后禁言 mute_for，被禁言超过 max_mutes 次之后断开连接
+type RateLimitConfig struct {
+	BroadcastBurst    int           `yaml:"broadcast_burst"`    // 广播最多连续发送的条数
+	BroadcastInterval time.Duration `yaml:"broadcast_interval"` // 每隔多久恢复一次广播的额度
+	PrivateBurst      int           `yaml:"private_burst"`      // 私聊最多连续发送的条数
+	PrivateInterval   time.Duration `yaml:"private_interval"`   // 每隔多久恢复一次私聊的额度
+	CommandBurst      int           `yaml:"command_burst"`      // 其他命令最多连续发送的条数
+	CommandInterval   time.Duration `yaml:"command_interval"`   // 每隔多久恢复一次命令的额度
+	MuteAfter         int           `yaml:"mute_after"`         // 连续超过限制多少次之后禁言
+	MuteFor           time.Duration `yaml:"mute_for"`           // 禁言的时长
+	MaxMutes          int           `yaml:"max_mutes"`          // 被禁言超过该次数之后再超过限制就断开连接
+	ForgiveAfter      time.Duration `yaml:"forgive_after"`      // 多久没有超过限制之后清空警告和禁言的次数
+	MaxConnsPerIP     int           `yaml:"max_conns_per_ip"`   // 每个IP最多同时建立的连接数，为0时不限制
+}
+
+// 心跳的配置，连续 max_missed 个 interval 没有收到用户的任何消息之后断开连接
+// 收到的任何消息都算作连接还活着，不只是 pong
+type HeartbeatConfig struct {
+	Interval    time.Duration `yaml:"interval"`     // 服务器给每个用户发送 ping 的间隔，为0时不发送心跳，也不断开不说话的连接
+	MaxMissed   int           `yaml:"max_missed"`   // 连续多少个间隔没有收到用户的任何消息之后断开连接
+	Pipe        bool          `yaml:"pipe"`         // 是否也给管道语法的用户发送心跳，默认只有 JSON 协议的用户有心跳
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // 没有心跳的用户多久没有发送任何消息之后断开，为0时不断开，每个 interval 检查一次
+}
+
+// 每个用户的连接、发送队列和私聊的配置
+type UserConfig struct {
+	SendQueueSize      int           `yaml:"send_queue_size"`      // 每个用户发送队列的容量，满了之后丢弃新的消息
+	WriteTimeout       time.Duration `yaml:"write_timeout"`        // 单条消息写入连接的超时时间，超时后断开该用户
+	FlushTimeout       time.Duration `yaml:"flush_timeout"`        // 关闭连接前写完已经排队消息的最长时间
+	HighWater          int           `yaml:"high_water"`           // disconnect 策略下，发送队列超过该长度时断开用户
+	SpillDir           string        `yaml:"spill_dir"`            // spill_to_disk 策略下消息文件所在目录，为空时使用系统临时目录
+	SpillReplayBatch   int           `yaml:"spill_replay_batch"`   // 补发磁盘上的消息时每次读出的条数
+	MaxSpillBytes      int64         `yaml:"max_spill_bytes"`      // 每个用户的消息文件最多写入的字节数，超过时断开该用户
+	MaxNickLength      int           `yaml:"max_nick_length"`      // 名字的最大长度，按字符计算
+	MaxUnreadReceipts  int           `yaml:"max_unread_receipts"`  // 每个用户最多记住多少条等待已读回执的私聊
+	MaxOfflineMessages int           `yaml:"max_offline_messages"` // 每个账号最多保存的离线私聊条数，超过时拒绝新的离线消息
+}
+
+// 多久没有收到任何消息之后断开连接: 连续 MaxMissed 个心跳间隔，为0时不断开
+func (h HeartbeatConfig) ReadTimeout() time.Duration {
+	return h.Interval * time.Duration(h.MaxMissed)
+}
+
+// parameter 中的默认配置
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			IP:                "127.0.0.1",
+			Port:              "4096",
+			WebSocketPath:     "/ws",
+			MaxFrameSize:      parameter.MaxFrameSize,
+			ResumeGracePeriod: parameter.ResumeGracePeriod,
+			ShutdownTimeout:   parameter.ShutdownTimeout,
+		},
+		Mongo: MongoConfig{
+			URL:      parameter.DatabaseUrl,
+			Database: parameter.DatabaseName,
+			PoolSize: parameter.DatabaseConnectPoolSize,
+			Timeout:  parameter.Timeout,
+		},
+		Manager: ManagerConfig{
+			MaxRooms:           parameter.ChatroomMaxCapacity,
+			MaxRetries:         parameter.MaxNumberOfRetries,
+			MaxWaiting:         parameter.MaxWaitingUsers,
+			AssignStrategy:     parameter.AssignStrategy,
+			MaxAffinityEntries: parameter.MaxAffinityEntries,
+		},
+		Chatroom: ChatroomConfig{
+			MaxUsers:           parameter.UsersMaxCapacity,
+			RingCapacity:       parameter.RingMaxCapacity,
+			SlowConsumerPolicy: parameter.SlowConsumerPolicy,
+			IdleAwayAfter:      parameter.IdleAwayAfter,
+			MaxMuteDuration:    parameter.MaxMuteDuration,
+		},
+		History: HistoryConfig{
+			Persist:        parameter.PersistHistory,
+			ReplaySize:     parameter.HistoryReplaySize,
+			MaxPageSize:    parameter.HistoryMaxPageSize,
+			BufferSize:     parameter.HistoryBufferSize,
+			FlushBatchSize: parameter.HistoryFlushBatchSize,
+		},
+		Log: LogConfig{
+			Level:        parameter.LogLevel,
+			Format:       parameter.LogFormat,
+			RedactBodies: parameter.LogRedactBodies,
+		},
+		RateLimit: RateLimitConfig{
+			BroadcastBurst:    parameter.BroadcastBurst,
+			BroadcastInterval: parameter.BroadcastInterval,
+			PrivateBurst:      parameter.PrivateBurst,
+			PrivateInterval:   parameter.PrivateInterval,
+			CommandBurst:      parameter.CommandBurst,
+			CommandInterval:   parameter.CommandInterval,
+			MuteAfter:         parameter.MuteAfter,
+			MuteFor:           parameter.MuteFor,
+			MaxMutes:          parameter.MaxMutes,
+			ForgiveAfter:      parameter.ForgiveAfter,
+			MaxConnsPerIP:     parameter.MaxConnsPerIP,
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval:    parameter.HeartbeatInterval,
+			MaxMissed:   parameter.HeartbeatMaxMissed,
+			Pipe:        parameter.HeartbeatPipe,
+			IdleTimeout: parameter.HeartbeatIdleTimeout,
+		},
+		User: UserConfig{
+			SendQueueSize:      parameter.UserSendQueueSize,
+			WriteTimeout:       parameter.UserWriteTimeout,
+			FlushTimeout:       parameter.UserFlushTimeout,
+			HighWater:          parameter.SlowConsumerHighWater,
+			SpillDir:           parameter.SpillDir,
+			SpillReplayBatch:   parameter.SpillReplayBatchSize,
+			MaxSpillBytes:      parameter.SpillMaxBytes,
+			MaxNickLength:      parameter.MaxNickLength,
+			MaxUnreadReceipts:  parameter.MaxUnreadReceipts,
+			MaxOfflineMessages: parameter.MaxOfflineMessages,
+		},
+	}
+}
+
+// 在默认配置上依次应用 path 对应的 YAML 文件和 environ 中的 CHATROOM_* 环境变量
+// path 为空时不读文件，environ 的格式和 os.Environ 一致，返回前不做 Validate
+func Load(path string, environ []string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: read %s: %w", path, err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config: parse %s: %w", path, err)
+		}
+	}
+	if err := cfg.ApplyEnv(environ); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 检查不可能的配置，返回第一个不合法的字段
+func (c *Config) Validate() error {
+	checks := []struct {
+		ok    bool
+		field string
+		value any
+		rule  string
+	}{
+		{c.Server.Port != "", "server.port", c.Server.Port, "must not be empty"},
+		{c.Server.WebSocketPath == "" || strings.HasPrefix(c.Server.WebSocketPath, "/"), "server.websocket_path", c.Server.WebSocketPath, "must start with /"},
+		{c.Server.CertFile == "" || c.Server.KeyFile != "", "server.key_file", c.Server.KeyFile, "must be set together with server.cert_file"},
+		{c.Server.ClientCAFile == "" || c.Server.CertFile != "", "server.client_ca_file", c.Server.ClientCAFile, "requires server.cert_file"},
+		{validOrigins(c.Server.WebSocketOriginList()), "server.websocket_origins", c.Server.WebSocketOrigins, "must be * or origins like https://chat.example.com"},
+		// 浏览器会把客户端证书出示给任意页面发起的 wss:// 连接，用证书鉴权时不能允许任意来源
+		{c.Server.ClientCAFile == "" || !slices.Contains(c.Server.WebSocketOriginList(), "*"), "server.websocket_origins", c.Server.WebSocketOrigins, "must not be * when server.client_ca_file is set"},
+		{c.Server.MaxFrameSize > 0 && c.Server.MaxFrameSize <= codec.MaxMaxFrameSize, "server.max_frame_size", c.Server.MaxFrameSize, "must be between 1 and 16777215"},
+		{c.Server.ResumeGracePeriod > 0, "server.resume_grace_period", c.Server.ResumeGracePeriod, "must be greater than 0"},
+		{c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", c.Server.ShutdownTimeout, "must be greater than 0"},
+		{c.Mongo.URL != "", "mongo.url", c.Mongo.URL, "must not be empty"},
+		{c.Mongo.Database != "", "mongo.database", c.Mongo.Database, "must not be empty"},
+		{c.Mongo.PoolSize > 0, "mongo.pool_size", c.Mongo.PoolSize, "must be greater than 0"},
+		{c.Mongo.Timeout > 0, "mongo.timeout", c.Mongo.Timeout, "must be greater than 0"},
+		{c.Manager.MaxRooms > 0, "manager.max_rooms", c.Manager.MaxRooms, "must be greater than 0"},
+		{c.Manager.MaxRetries > 0, "manager.max_retries", c.Manager.MaxRetries, "must be greater than 0"},
+		{c.Manager.MaxWaiting >= 0, "manager.max_waiting", c.Manager.MaxWaiting, "must not be negative"},
+		{validStrategies[c.Manager.AssignStrategy], "manager.assign_strategy", c.Manager.AssignStrategy, "must be random, least_loaded, fill_first, round_robin or affinity"},
+		{c.Manager.MaxAffinityEntries > 0, "manager.max_affinity_entries", c.Manager.MaxAffinityEntries, "must be greater than 0"},
+		{c.Chatroom.MaxUsers > 0, "chatroom.max_users", c.Chatroom.MaxUsers, "must be greater than 0"},
+		{c.Chatroom.RingCapacity > 0, "chatroom.ring_capacity", c.Chatroom.RingCapacity, "must be greater than 0"},
+		{validPolicies[c.Chatroom.SlowConsumerPolicy], "chatroom.slow_consumer_policy", c.Chatroom.SlowConsumerPolicy, "must be drop_oldest, disconnect or spill_to_disk"},
+		{c.Chatroom.IdleAwayAfter >= 0, "chatroom.idle_away_after", c.Chatroom.IdleAwayAfter, "must not be negative"},
+		{c.Chatroom.MaxMuteDuration > 0, "chatroom.max_mute_duration", c.Chatroom.MaxMuteDuration, "must be greater than 0"},
+		{c.History.ReplaySize >= 0, "history.replay_size", c.History.ReplaySize, "must not be negative"},
+		{c.History.ReplaySize <= c.Chatroom.RingCapacity, "history.replay_size", c.History.ReplaySize, "must not exceed chatroom.ring_capacity"},
+		{c.History.MaxPageSize > 0, "history.max_page_size", c.History.MaxPageSize, "must be greater than 0"},
+		{c.History.BufferSize > 0, "history.buffer_size", c.History.BufferSize, "must be greater than 0"},
+		{c.History.FlushBatchSize > 0, "history.flush_batch_size", c.History.FlushBatchSize, "must be greater than 0"},
+		{validLevels[c.Log.Level], "log.level", c.Log.Level, "must be debug, info, warn or error"},
+		{c.Log.Format == "text" || c.Log.Format == "json", "log.format", c.Log.Format, "must be text or json"},
+		{c.Admin.Addr == "" || c.Admin.Token != "", "admin.token", "", "must be set when admin.addr is set"},
+		{c.RateLimit.BroadcastBurst >= 0, "rate_limit.broadcast_burst", c.RateLimit.BroadcastBurst, "must not be negative"},
+		{c.RateLimit.BroadcastBurst == 0 || c.RateLimit.BroadcastInterval > 0, "rate_limit.broadcast_interval", c.RateLimit.BroadcastInterval, "must be greater than 0"},
+		{c.RateLimit.PrivateBurst >= 0, "rate_limit.private_burst", c.RateLimit.PrivateBurst, "must not be negative"},
+		{c.RateLimit.PrivateBurst == 0 || c.RateLimit.PrivateInterval > 0, "rate_limit.private_interval", c.RateLimit.PrivateInterval, "must be greater than 0"},
+		{c.RateLimit.CommandBurst >= 0, "rate_limit.command_burst", c.RateLimit.CommandBurst, "must not be negative"},
+		{c.RateLimit.CommandBurst == 0 || c.RateLimit.CommandInterval > 0, "rate_limit.command_interval", c.RateLimit.CommandInterval, "must be greater than 0"},
+		{c.RateLimit.MuteAfter > 0, "rate_limit.mute_after", c.RateLimit.MuteAfter, "must be greater than 0"},
+		{c.RateLimit.MuteFor > 0, "rate_limit.mute_for", c.RateLimit.MuteFor, "must be greater than 0"},
+		{c.RateLimit.MaxMutes >= 0, "rate_limit.max_mutes", c.RateLimit.MaxMutes, "must not be negative"},
+		{c.RateLimit.ForgiveAfter > 0, "rate_limit.forgive_after", c.RateLimit.ForgiveAfter, "must be greater than 0"},
+		{c.RateLimit.MaxConnsPerIP >= 0, "rate_limit.max_conns_per_ip", c.RateLimit.MaxConnsPerIP, "must not be negative"},
+		{c.Heartbeat.Interval >= 0, "heartbeat.interval", c.Heartbeat.Interval, "must not be negative"},
+		{c.Heartbeat.MaxMissed > 0, "heartbeat.max_missed", c.Heartbeat.MaxMissed, "must be greater than 0"},
+		{c.Heartbeat.IdleTimeout >= 0, "heartbeat.idle_timeout", c.Heartbeat.IdleTimeout, "must not be negative"},
+		{c.User.SendQueueSize > 0, "user.send_queue_size", c.User.SendQueueSize, "must be greater than 0"},
+		{c.User.WriteTimeout > 0, "user.write_timeout", c.User.WriteTimeout, "must be greater than 0"},
+		{c.User.FlushTimeout > 0, "user.flush_timeout", c.User.FlushTimeout, "must be greater than 0"},
+		{c.User.HighWater > 0, "user.high_water", c.User.HighWater, "must be greater than 0"},
+		{c.User.HighWater <= c.User.SendQueueSize, "user.high_water", c.User.HighWater, "must not exceed user.send_queue_size"},
+		{c.User.SpillReplayBatch > 0, "user.spill_replay_batch", c.User.SpillReplayBatch, "must be greater than 0"},
+		{c.User.MaxSpillBytes > 0, "user.max_spill_bytes", c.User.MaxSpillBytes, "must be greater than 0"},
+		{c.User.MaxNickLength > 0, "user.max_nick_length", c.User.MaxNickLength, "must be greater than 0"},
+		{c.User.MaxUnreadReceipts >= 0, "user.max_unread_receipts", c.User.MaxUnreadReceipts, "must not be negative"},
+		{c.User.MaxOfflineMessages >= 0, "user.max_offline_messages", c.User.MaxOfflineMessages, "must not be negative"},
+	}
+	for _, check := range checks {
+		if !check.ok {
+			return fmt.Errorf("%w: %s %s, got %v", ErrInvalidConfig, check.field, check.rule, check.value)
+		}
+	}
+	return nil
+}
+
+var validLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// 和 chatroom_manager 中分配房间的策略的名字一致
+var validStrategies = map[string]bool{
+	"random":       true,
+	"least_loaded": true,
+	"fill_first":   true,
+	"round_robin":  true,
+	"affinity":     true,
+}
+
+// 和 user.SlowConsumerPolicy 的名字一致，config 不依赖 server 下的包
+var validPolicies = map[string]bool{
+	"drop_oldest":   true,
+	"disconnect":    true,
+	"spill_to_disk": true,
+}
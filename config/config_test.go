@@ -0,0 +1,124 @@
+package config
+
+import (
+	"chatroom/codec"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadFileThenEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatroom.yaml")
+	yaml := `
+server:
+  port: "5000"
+mongo:
+  timeout: 3s
+chatroom:
+  max_users: 8
+  slow_consumer_policy: spill_to_disk
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path, []string{"CHATROOM_CHATROOM_MAX_USERS=16", "CHATROOM_HISTORY_PERSIST=false", "HOME=/root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != "5000" || cfg.Mongo.Timeout != 3*time.Second || cfg.Chatroom.SlowConsumerPolicy != "spill_to_disk" {
+		t.Fatalf("file values not applied: %+v", cfg)
+	}
+	if cfg.Chatroom.MaxUsers != 16 || cfg.History.Persist {
+		t.Fatalf("env values not applied: %+v", cfg)
+	}
+	// 文件和环境变量都没有设置的字段保持默认值
+	if cfg.Manager.MaxRooms != Default().Manager.MaxRooms {
+		t.Fatalf("manager.max_rooms = %d", cfg.Manager.MaxRooms)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatroom.yaml")
+	if err := os.WriteFile(path, []byte("chatroom:\n  max_user: 8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, nil); err == nil {
+		t.Fatal("misspelled key accepted")
+	}
+	for _, env := range []string{"CHATROOM_CHATROOM_MAX_USER=8", "CHATROOM_CHATROOM_MAX_USERS=eight"} {
+		if _, err := Load("", []string{env}); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Load with %s err = %v, want ErrInvalidConfig", env, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := map[string]func(*Config){
+		"chatroom.max_users":            func(c *Config) { c.Chatroom.MaxUsers = 0 },
+		"chatroom.ring_capacity":        func(c *Config) { c.Chatroom.RingCapacity = 0 },
+		"manager.max_rooms":             func(c *Config) { c.Manager.MaxRooms = -1 },
+		"manager.max_waiting":           func(c *Config) { c.Manager.MaxWaiting = -1 },
+		"manager.assign_strategy":       func(c *Config) { c.Manager.AssignStrategy = "fastest" },
+		"mongo.timeout":                 func(c *Config) { c.Mongo.Timeout = 0 },
+		"chatroom.slow_consumer_policy": func(c *Config) { c.Chatroom.SlowConsumerPolicy = "block" },
+		"history.replay_size":           func(c *Config) { c.History.ReplaySize = c.Chatroom.RingCapacity + 1 },
+		"server.key_file":               func(c *Config) { c.Server.CertFile = "cert.pem" },
+		"admin.token":                   func(c *Config) { c.Admin.Addr = "127.0.0.1:9090" },
+		"log.level":                     func(c *Config) { c.Log.Level = "verbose" },
+		"rate_limit.broadcast_interval": func(c *Config) { c.RateLimit.BroadcastInterval = 0 },
+		"rate_limit.mute_after":         func(c *Config) { c.RateLimit.MuteAfter = 0 },
+		"rate_limit.max_conns_per_ip":   func(c *Config) { c.RateLimit.MaxConnsPerIP = -1 },
+		"heartbeat.interval":            func(c *Config) { c.Heartbeat.Interval = -time.Second },
+		"heartbeat.max_missed":          func(c *Config) { c.Heartbeat.MaxMissed = 0 },
+		"heartbeat.idle_timeout":        func(c *Config) { c.Heartbeat.IdleTimeout = -time.Second },
+		"server.max_frame_size":         func(c *Config) { c.Server.MaxFrameSize = 0 },
+		"server.shutdown_timeout":       func(c *Config) { c.Server.ShutdownTimeout = 0 },
+		"history.flush_batch_size":      func(c *Config) { c.History.FlushBatchSize = 0 },
+		"user.high_water":               func(c *Config) { c.User.HighWater = c.User.SendQueueSize + 1 },
+		"user.write_timeout":            func(c *Config) { c.User.WriteTimeout = 0 },
+		"user.spill_replay_batch":       func(c *Config) { c.User.SpillReplayBatch = 0 },
+		"user.max_spill_bytes":          func(c *Config) { c.User.MaxSpillBytes = 0 },
+		"server.websocket_origins": func(c *Config) {
+			c.Server.CertFile, c.Server.KeyFile, c.Server.ClientCAFile = "cert.pem", "key.pem", "ca.pem"
+			c.Server.WebSocketOrigins = "https://chat.example.com, *"
+		},
+	}
+	for field, mutate := range cases {
+		cfg := Default()
+		mutate(cfg)
+		err := cfg.Validate()
+		if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), field) {
+			t.Errorf("%s: Validate() = %v", field, err)
+		}
+	}
+}
+
+// 超过 codec.MaxMaxFrameSize 的帧长度会让每个新连接的 codec.NewDecoder panic
+func TestValidateMaxFrameSize(t *testing.T) {
+	for size, ok := range map[int]bool{1: true, codec.MaxMaxFrameSize: true, codec.MaxMaxFrameSize + 1: false, 20000000: false} {
+		cfg := Default()
+		cfg.Server.MaxFrameSize = size
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("max_frame_size %d: Validate() = %v", size, err)
+		}
+	}
+}
+
+func TestExampleMatchesDefault(t *testing.T) {
+	cfg, err := Load("chatroom.example.yaml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg != *Default() {
+		t.Fatalf("chatroom.example.yaml = %+v, want %+v", cfg, Default())
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 环境变量的前缀，CHATROOM_<SECTION>_<FIELD> 对应 YAML 中的 section.field，例如 CHATROOM_MONGO_URL
+const EnvPrefix = "CHATROOM_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// 用 environ 中的 CHATROOM_* 变量覆盖配置，environ 的格式和 os.Environ 一致
+// 不认识的 CHATROOM_* 变量会返回错误，避免拼错的变量名被悄悄忽略
+func (c *Config) ApplyEnv(environ []string) error {
+	fields := envFields(reflect.ValueOf(c).Elem())
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(key, EnvPrefix) {
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("%w: unknown environment variable %s", ErrInvalidConfig, key)
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%w: %s=%q: %v", ErrInvalidConfig, key, value, err)
+		}
+	}
+	return nil
+}
+
+// 所有配置项对应的环境变量名 -> 字段
+func envFields(root reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Field(i)
+		sectionName := root.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			name := section.Type().Field(j).Tag.Get("yaml")
+			fields[strings.ToUpper(EnvPrefix+sectionName+"_"+name)] = section.Field(j)
+		}
+	}
+	return fields
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported kind %s", field.Kind())
+	}
+	return nil
+}
@@ -18,14 +18,42 @@ func init() {
 func DynamicConstIntroduceStr() string {
 	once.Do(func() {
 		introduceStr = fmt.Sprintf(
-			"当前仅支持私、广播、查看当前聊天室成员、展示我的名字和退出.\n"+
+			"当前仅支持私、广播、查看当前聊天室成员、展示我的名字、退出、注册、登录、查看聊天记录、选择聊天室、断线重连和管理聊天室、消息回执、在线状态、修改名字和心跳.\n"+
+				"服务器会定期发送 ping，长时间没有收到你的任何消息时会断开连接.\n"+
 				" eg,privateChat:  %d|<name>|<msgbody>\n"+
 				" eg,Broad:  %d|<msgbody>\n"+
 				" eg,ShowAllOnlineUsers:  %d\n"+
 				" eg,MyName:  %d\n"+
 				" eg,quit: %d\n"+
+				" eg,register: %d|<name>|<password>\n"+
+				" eg,login: %d|<name>|<password>\n"+
+				" eg,history: %d|<n>\n"+
+				" eg,rooms: %d\n"+
+				" eg,createRoom: %d|<roomName>|<drop_oldest|disconnect|spill_to_disk>\n"+
+				" eg,join: %d|<roomId or roomName>\n"+
+				" eg,leave: %d\n"+
+				" eg,quickJoin: %d\n"+
+				" eg,resume: %d|<token>\n"+
+				" eg,moderator: %d|<name>\n"+
+				" eg,mute: %d|<name>|<duration, eg 5m>\n"+
+				" eg,kick: %d|<name>\n"+
+				" eg,ban: %d|<name>\n"+
+				" eg,unban: %d|<account or ip>\n"+
+				" eg,read: %d|<msg_id, 省略时全部已读>\n"+
+				" eg,receipts: %d|<on|off, 默认关闭>\n"+
+				" eg,away: %d|<message, 可以省略>\n"+
+				" eg,back: %d\n"+
+				" eg,typing: %d\n"+
+				" eg,nick: %d|<name>\n"+
+				" eg,ping: %d\n"+
+				" eg,pong: %d\n"+
 				"请再次输入\n",
-			PrivateChatOption, BroadOption, ShowAllOnlineUsersOption, MyNameOption, QuitOption)
+			PrivateChatOption, BroadOption, ShowAllOnlineUsersOption, MyNameOption, QuitOption,
+			RegisterOption, LoginOption, HistoryOption,
+			RoomsOption, CreateRoomOption, JoinOption, LeaveOption, QuickJoinOption, ResumeOption,
+			ModeratorOption, MuteOption, KickOption, BanOption, UnbanOption,
+			ReadOption, ReceiptsOption, AwayOption, BackOption, TypingOption, NickOption,
+			PingOption, PongOption)
 	})
 	return introduceStr
 }
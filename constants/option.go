@@ -16,4 +16,26 @@ const (
 	ShowAllOnlineUsersOption        // 展示当前所有用户标识符
 	MyNameOption                    // 查看我的名字标识符
 	QuitOption                      // 退出标识符
+	RegisterOption                  // 注册账号标识符
+	LoginOption                     // 登录账号标识符
+	HistoryOption                   // 查看更早的聊天记录标识符
+	RoomsOption                     // 列出所有聊天室标识符
+	CreateRoomOption                // 创建命名聊天室标识符
+	JoinOption                      // 按ID或名字加入聊天室标识符
+	LeaveOption                     // 离开聊天室回到大厅标识符
+	QuickJoinOption                 // 随机加入聊天室标识符
+	ResumeOption                    // 使用重连令牌恢复会话标识符
+	ModeratorOption                 // 房主任命管理员标识符
+	MuteOption                      // 禁言标识符
+	KickOption                      // 移出聊天室标识符
+	BanOption                       // 封禁标识符
+	UnbanOption                     // 解除封禁标识符
+	ReadOption                      // 私聊已读标识符
+	ReceiptsOption                  // 开关发送确认和回执标识符
+	AwayOption                      // 标记暂时离开标识符
+	BackOption                      // 标记回来了标识符
+	TypingOption                    // 正在输入标识符
+	NickOption                      // 修改名字标识符
+	PingOption                      // 心跳 ping 标识符
+	PongOption                      // 心跳 pong 标识符
 )
@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"chatroom/config"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+// 日志中通用字段的名字
+const (
+	KeyRoomID     = "room_id"     // 聊天室ID
+	KeyUser       = "user"        // 用户名
+	KeyRemoteAddr = "remote_addr" // 用户连接的远端地址
+	KeyOp         = "op"          // 请求或者管理操作的类型
+	KeyBody       = "body"        // 消息内容，默认隐藏
+	KeyErr        = "err"         // 错误
+)
+
+var (
+	level        = new(slog.LevelVar) // Setup 创建的 logger 共用的级别，Apply 可以在运行时修改
+	redactBodies atomic.Bool          // Body 是否隐藏消息内容
+)
+
+func init() {
+	redactBodies.Store(true)
+}
+
+// 按照 cfg 创建写到 w 的 logger，并设置为 slog 和标准库 log 的默认 logger
+func Setup(w io.Writer, cfg config.LogConfig) *slog.Logger {
+	Apply(cfg)
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// 修改日志级别和是否隐藏消息内容，SIGHUP 热更新时调用
+func Apply(cfg config.LogConfig) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(cfg.Level)); err == nil {
+		level.Set(l)
+	}
+	redactBodies.Store(cfg.RedactBodies)
+}
+
+// 消息内容字段，默认只记录长度，log.redact_bodies 为 false 时记录原文
+func Body(body string) slog.Attr {
+	if redactBodies.Load() {
+		return slog.String(KeyBody, fmt.Sprintf("[redacted %d bytes]", len(body)))
+	}
+	return slog.String(KeyBody, body)
+}
+
+// 错误字段
+func Err(err error) slog.Attr {
+	return slog.Any(KeyErr, err)
+}
@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"bytes"
+	"chatroom/config"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetupRedactsBodiesAndFiltersLevels(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	cfg := config.Default().Log
+	cfg.Format = "json"
+	logger := Setup(&buf, cfg)
+
+	logger.Debug("hidden")
+	logger.Info("broadcast", KeyRoomID, 3, Body("secret plans"))
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if record["msg"] != "broadcast" || record[KeyRoomID] != float64(3) || record[KeyBody] != "[redacted 12 bytes]" {
+		t.Fatalf("record = %v", record)
+	}
+
+	buf.Reset()
+	cfg.Level, cfg.RedactBodies = "debug", false
+	Apply(cfg)
+	logger.Debug("broadcast", Body("secret plans"))
+	if !strings.Contains(buf.String(), `"body":"secret plans"`) {
+		t.Fatalf("after Apply output = %q", buf.String())
+	}
+	Apply(config.Default().Log)
+}
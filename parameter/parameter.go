@@ -8,6 +8,60 @@ const (
 	RingMaxCapacity = 500 // 消息存储容量
 )
 
+// 聊天记录的相关参数
+const (
+	PersistHistory        = true // 是否把聊天记录保存到 mongo 的 messages 集合
+	HistoryReplaySize     = 20   // 进入房间时补发的最近消息条数
+	HistoryMaxPageSize    = 100  // history 命令一次最多返回的消息条数
+	HistoryBufferSize     = 1024 // 等待写入数据库的聊天记录缓冲区大小
+	HistoryFlushBatchSize = 100  // 每次批量写入数据库的最大条数
+)
+
+// 消息分帧的相关参数
+const (
+	MaxFrameSize = 4096 // 单帧消息的最大字节数，超过的消息会被丢弃
+)
+
+// 日志的相关参数
+const (
+	LogLevel        = "info" // 日志级别: debug、info、warn 或 error
+	LogFormat       = "text" // 日志格式: text 或 json
+	LogRedactBodies = true   // 日志中是否隐藏消息内容，只记录长度
+)
+
+// 限流的相关参数，默认每个用户每秒最多5条广播、5条私聊和10个命令
+const (
+	BroadcastBurst    = 10                     // 广播最多连续发送的条数
+	BroadcastInterval = 200 * time.Millisecond // 每隔多久恢复一次广播的额度
+	PrivateBurst      = 10                     // 私聊最多连续发送的条数
+	PrivateInterval   = 200 * time.Millisecond // 每隔多久恢复一次私聊的额度
+	CommandBurst      = 20                     // 其他命令最多连续发送的条数
+	CommandInterval   = 100 * time.Millisecond // 每隔多久恢复一次命令的额度
+	MuteAfter         = 3                      // 连续超过限制多少次之后禁言
+	MuteFor           = 30 * time.Second       // 禁言的时长
+	MaxMutes          = 2                      // 被禁言超过该次数之后再超过限制就断开连接
+	ForgiveAfter      = time.Minute            // 多久没有超过限制之后清空警告和禁言的次数
+	MaxConnsPerIP     = 64                     // 每个IP最多同时建立的连接数，为0时不限制
+)
+
+// 心跳的相关参数
+const (
+	HeartbeatInterval    = 30 * time.Second // 服务器给每个用户发送 ping 的间隔，为0时不发送心跳，也不设置读超时
+	HeartbeatMaxMissed   = 3                // 连续多少个间隔没有收到用户的任何消息之后断开连接
+	HeartbeatPipe        = false            // 是否也给管道语法的用户发送心跳，telnet 用户不会回复 ping，开启后闲置的 telnet 用户会被断开
+	HeartbeatIdleTimeout = 10 * time.Minute // 没有心跳的用户多久没有发送任何消息之后当作半开的连接断开，为0时不断开
+)
+
+// 服务器关闭的相关参数
+const (
+	ShutdownTimeout = 10 * time.Second // 收到 SIGINT/SIGTERM 后等待用户和后台协程退出的最长时间
+)
+
+// 断线重连的相关参数
+const (
+	ResumeGracePeriod = 2 * time.Minute // 断线后可以用重连令牌恢复会话的宽限期
+)
+
 // Mongo连接的相关的参数
 const (
 	DatabaseUrl             = "mongodb://localhost:27017" // 数据连接的url
@@ -18,12 +72,44 @@ const (
 
 // ChatroomManager 相关参数
 const (
-	ChatroomMaxCapacity = 100 // 一个 ChatroomManager 管理的最大聊天室容量
+	ChatroomMaxCapacity = 100      // 一个 ChatroomManager 管理的最大聊天室容量
+	MaxWaitingUsers     = 100      // 所有房间都满时等待进入房间的最大人数，为0时直接拒绝
+	AssignStrategy      = "random" // 给新用户分配房间的策略: random、least_loaded、fill_first、round_robin 或 affinity
+	MaxAffinityEntries  = 10000    // affinity 策略最多记住的 IP 或账号数
 )
 
 // Chatroom 相关参数
 const (
-	UsersMaxCapacity = 100 // 一个 Chatroom 容纳 User 的最大容量
+	UsersMaxCapacity = 100             // 一个 Chatroom 容纳 User 的最大容量
+	IdleAwayAfter    = 5 * time.Minute // 成员多久没有发送消息之后自动标记为空闲，为0时不自动标记
+	MaxNickLength    = 24              // 名字的最大长度，按字符计算
+)
+
+// User 发送消息的相关参数
+const (
+	UserSendQueueSize = 256              // 每个用户发送队列的容量，满了之后丢弃新的消息
+	UserWriteTimeout  = 10 * time.Second // 单条消息写入连接的超时时间，超时后断开该用户
+	UserFlushTimeout  = time.Second      // 关闭连接前写完已经排队消息的最长时间
+)
+
+// 广播消息来不及发送时的相关参数
+const (
+	SlowConsumerPolicy    = "drop_oldest" // 聊天室默认的策略: drop_oldest、disconnect 或 spill_to_disk
+	SlowConsumerHighWater = 200           // disconnect 策略下，发送队列超过该长度时断开用户
+	SpillDir              = ""            // spill_to_disk 策略下消息文件所在目录，为空时使用系统临时目录
+	SpillReplayBatchSize  = 100           // 补发磁盘上的消息时每次读出的条数
+	SpillMaxBytes         = 64 << 20      // 每个用户的消息文件最多写入的字节数，超过时断开该用户
+)
+
+// 聊天室管理的相关参数
+const (
+	MaxMuteDuration = 24 * time.Hour // 房主和管理员一次最长可以禁言的时间
+)
+
+// 离线私聊的相关参数
+const (
+	MaxOfflineMessages = 100 // 每个账号最多保存的离线私聊条数，超过时拒绝新的离线消息
+	MaxUnreadReceipts  = 256 // 每个用户最多记住多少条等待已读回执的私聊，超过之后的私聊只有送达回执
 )
 
 // 聊天室进入时，并发控制的参数
@@ -0,0 +1,380 @@
+package protocol
+
+import (
+	"chatroom/constants"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 当前服务端支持的 JSON 协议版本
+const Version = 1
+
+// 连接所使用的协议，由客户端发送的第一帧协商决定
+type Dialect int
+
+const (
+	DialectUnknown Dialect = iota // 还没有收到第一帧
+	DialectPipe                   // <option>|<...> 的管道语法，兼容 telnet 用户
+	DialectJSON                   // JSON 信封协议
+)
+
+// 客户端请求的类型
+const (
+	TypeHello      = "hello"       // 协商使用 JSON 协议
+	TypePrivate    = "private"     // 私聊
+	TypeBroadcast  = "broadcast"   // 广播
+	TypeShow       = "show"        // 展示当前聊天室成员
+	TypeMyName     = "my_name"     // 查看我的名字
+	TypeQuit       = "quit"        // 退出
+	TypeRegister   = "register"    // 注册账号
+	TypeLogin      = "login"       // 登录账号
+	TypeHistory    = "history"     // 查看更早的聊天记录
+	TypeRooms      = "rooms"       // 列出所有聊天室
+	TypeCreateRoom = "create_room" // 创建命名聊天室
+	TypeJoin       = "join"        // 按ID或名字加入聊天室
+	TypeLeave      = "leave"       // 离开聊天室回到大厅
+	TypeQuickJoin  = "quick_join"  // 随机加入聊天室
+	TypeResume     = "resume"      // 使用重连令牌恢复断线前的会话
+	TypeModerator  = "moderator"   // 房主任命管理员
+	TypeMute       = "mute"        // 在当前聊天室中禁言一个成员
+	TypeKick       = "kick"        // 把一个成员移出当前聊天室
+	TypeBan        = "ban"         // 封禁一个成员，之后不能再进入当前聊天室
+	TypeUnban      = "unban"       // 按账号或IP解除封禁
+	TypeRead       = "read"        // 告诉发送者私聊已读
+	TypeReceipts   = "receipts"    // 开启或关闭发送确认和回执
+	TypeAway       = "away"        // 标记为暂时离开，Body 为离开的说明
+	TypeBack       = "back"        // 标记为回来了
+	TypeTyping     = "typing"      // 告诉房间内的其他成员正在输入
+	TypeNick       = "nick"        // 修改名字，Name 为新的名字
+	TypePing       = "ping"        // 心跳，服务端和客户端都可以发送，收到后回复 pong
+	TypePong       = "pong"        // 心跳的回复
+)
+
+// 服务端事件的类型
+const (
+	TypeMessage  = "message"  // 聊天消息
+	TypePresence = "presence" // 成员进出房间等状态变化
+	TypeError    = "error"    // 请求出错
+	TypeAck      = "ack"      // 请求已被接受，Body 中可能带有请求的结果
+	TypeSession  = "session"  // 连接建立时下发的重连令牌
+	TypeNotice   = "notice"   // 服务器发给房间的公告
+	TypeReceipt  = "receipt"  // 私聊已送达或已读的回执
+)
+
+// 私聊回执的状态
+const (
+	ReceiptDelivered = "delivered" // 已经写入接收者的连接
+	ReceiptRead      = "read"      // 接收者已读
+)
+
+// 成员状态变化事件的状态
+const (
+	PresenceJoin       = "join"       // 进入房间
+	PresenceLeave      = "leave"      // 离开房间回到大厅
+	PresenceDisconnect = "disconnect" // 断开连接
+	PresenceTimeout    = "timeout"    // 连续多个心跳间隔没有收到消息，被服务器断开
+	PresenceAway       = "away"       // 暂时离开
+	PresenceIdle       = "idle"       // 长时间没有发送消息，自动标记为空闲
+	PresenceBack       = "back"       // 从暂时离开或空闲中回来
+	PresenceTyping     = "typing"     // 正在输入
+)
+
+var ErrBadFormat = errors.New("protocol: bad message format")
+
+// JSON 协议的信封，请求和服务端事件共用
+type Envelope struct {
+	Version   int        `json:"version,omitempty"`   // 协议版本，只在 hello 中使用
+	Type      string     `json:"type"`                // 请求或事件的类型
+	ID        string     `json:"id,omitempty"`        // 请求的ID，服务端的 ack/error 会带回该ID
+	Room      int        `json:"room,omitempty"`      // 房间ID
+	From      string     `json:"from,omitempty"`      // 消息的发送者
+	To        string     `json:"to,omitempty"`        // 私聊的接收者
+	Body      string     `json:"body,omitempty"`      // 消息体
+	Name      string     `json:"name,omitempty"`      // 注册和登录的账号名，nick 请求的新名字
+	Password  string     `json:"password,omitempty"`  // 注册和登录的密码，只出现在请求中
+	Timestamp int64      `json:"timestamp,omitempty"` // 毫秒时间戳
+	Seq       int64      `json:"seq,omitempty"`       // 广播消息在房间内的序号，私聊在服务器内的序号
+	MsgID     string     `json:"msg_id,omitempty"`    // 服务器分配的消息ID，发送确认、回执和 read 请求带有该ID
+	Status    string     `json:"status,omitempty"`    // 回执或成员的状态，Receipt* 或 Presence* 之一
+	Limit     int        `json:"limit,omitempty"`     // history 请求的消息条数
+	Rooms     []RoomInfo `json:"rooms,omitempty"`     // rooms 请求返回的聊天室列表
+	Token     string     `json:"token,omitempty"`     // 重连令牌，session 事件下发，resume 请求带回
+	Policy    string     `json:"policy,omitempty"`    // create_room 请求指定的广播来不及发送时的处理方式
+	Duration  string     `json:"duration,omitempty"`  // mute 请求的禁言时长，例如 5m
+}
+
+// 聊天室的概况
+type RoomInfo struct {
+	ID       int    `json:"id"`              // 房间ID
+	Name     string `json:"name,omitempty"`  // 房间名字，随机分配创建的房间没有名字
+	Members  int    `json:"members"`         // 当前成员数
+	Capacity int    `json:"capacity"`        // 最大容量
+	Policy   string `json:"policy"`          // 广播消息来不及发送时的处理方式
+	Owner    string `json:"owner,omitempty"` // 房主的用户名，随机分配创建的房间没有房主
+}
+
+// 管道语法中 option 对应的请求类型
+var optionTypes = map[int]string{
+	constants.PrivateChatOption:        TypePrivate,
+	constants.BroadOption:              TypeBroadcast,
+	constants.ShowAllOnlineUsersOption: TypeShow,
+	constants.MyNameOption:             TypeMyName,
+	constants.QuitOption:               TypeQuit,
+	constants.RegisterOption:           TypeRegister,
+	constants.LoginOption:              TypeLogin,
+	constants.HistoryOption:            TypeHistory,
+	constants.RoomsOption:              TypeRooms,
+	constants.CreateRoomOption:         TypeCreateRoom,
+	constants.JoinOption:               TypeJoin,
+	constants.LeaveOption:              TypeLeave,
+	constants.QuickJoinOption:          TypeQuickJoin,
+	constants.ResumeOption:             TypeResume,
+	constants.ModeratorOption:          TypeModerator,
+	constants.MuteOption:               TypeMute,
+	constants.KickOption:               TypeKick,
+	constants.BanOption:                TypeBan,
+	constants.UnbanOption:              TypeUnban,
+	constants.ReadOption:               TypeRead,
+	constants.ReceiptsOption:           TypeReceipts,
+	constants.AwayOption:               TypeAway,
+	constants.BackOption:               TypeBack,
+	constants.TypingOption:             TypeTyping,
+	constants.NickOption:               TypeNick,
+	constants.PingOption:               TypePing,
+	constants.PongOption:               TypePong,
+}
+
+// 客户端的请求类型，JSON 请求只能是其中之一
+var requestTypes = map[string]bool{
+	TypeHello:      true,
+	TypePrivate:    true,
+	TypeBroadcast:  true,
+	TypeShow:       true,
+	TypeMyName:     true,
+	TypeQuit:       true,
+	TypeRegister:   true,
+	TypeLogin:      true,
+	TypeHistory:    true,
+	TypeRooms:      true,
+	TypeCreateRoom: true,
+	TypeJoin:       true,
+	TypeLeave:      true,
+	TypeQuickJoin:  true,
+	TypeResume:     true,
+	TypeModerator:  true,
+	TypeMute:       true,
+	TypeKick:       true,
+	TypeBan:        true,
+	TypeUnban:      true,
+	TypeRead:       true,
+	TypeReceipts:   true,
+	TypeAway:       true,
+	TypeBack:       true,
+	TypeTyping:     true,
+	TypeNick:       true,
+	TypePing:       true,
+	TypePong:       true,
+}
+
+// 根据连接的第一帧协商协议，第一帧是 JSON 的 hello 时使用 JSON 协议，否则使用管道语法
+// 返回的 *Envelope 是 hello 请求本身，使用管道语法时为 nil
+func Negotiate(msg []byte) (Dialect, *Envelope) {
+	env, err := ParseJSON(msg)
+	if err != nil || env.Type != TypeHello {
+		return DialectPipe, nil
+	}
+	return DialectJSON, env
+}
+
+// 按照 dialect 解析一条客户端消息
+func Parse(dialect Dialect, msg []byte) (*Envelope, error) {
+	if dialect == DialectJSON {
+		return ParseJSON(msg)
+	}
+	return ParsePipe(string(msg))
+}
+
+// 解析 JSON 请求
+func ParseJSON(msg []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(msg, env); err != nil {
+		return nil, ErrBadFormat
+	}
+	if !requestTypes[env.Type] {
+		return nil, ErrBadFormat
+	}
+	return env, nil
+}
+
+// 解析管道语法 <option>|<...>
+// eg: 0|<name>|<msgbody>
+// eg: 1|<msgbody>
+// eg: 5|<name>|<password>
+// eg: 7|<n>
+// eg: 9|<roomName>|<policy>
+// eg: 10|<roomId or roomName>
+// eg: 13|<token>
+// eg: 15|<name>|<duration>
+// eg: 19|<msg_id>
+// eg: 20|<on|off>
+// eg: 24|<name>
+// 消息体和密码中的 '|' 会被原样保留
+func ParsePipe(msg string) (*Envelope, error) {
+	optionStr, rest, _ := strings.Cut(msg, "|")
+	option, err := strconv.Atoi(optionStr)
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	msgType, ok := optionTypes[option]
+	if !ok {
+		return nil, ErrBadFormat
+	}
+	env := &Envelope{Type: msgType}
+	switch msgType {
+	case TypePrivate:
+		to, body, found := strings.Cut(rest, "|")
+		if !found || to == "" {
+			return nil, ErrBadFormat
+		}
+		env.To, env.Body = to, body
+	case TypeBroadcast:
+		env.Body = rest
+	case TypeRegister, TypeLogin:
+		name, password, found := strings.Cut(rest, "|")
+		if !found || name == "" {
+			return nil, ErrBadFormat
+		}
+		env.Name, env.Password = name, password
+	case TypeHistory:
+		if rest != "" {
+			limit, err := strconv.Atoi(rest)
+			if err != nil || limit <= 0 {
+				return nil, ErrBadFormat
+			}
+			env.Limit = limit
+		}
+	case TypeCreateRoom:
+		name, policy, _ := strings.Cut(rest, "|")
+		if name == "" {
+			return nil, ErrBadFormat
+		}
+		env.Name, env.Policy = name, policy
+	case TypeJoin:
+		if rest == "" {
+			return nil, ErrBadFormat
+		}
+		// 纯数字按ID加入，否则按名字加入，聊天室的名字不能是纯数字
+		if roomId, err := strconv.Atoi(rest); err == nil {
+			env.Room = roomId
+		} else {
+			env.Name = rest
+		}
+	case TypeResume:
+		if rest == "" {
+			return nil, ErrBadFormat
+		}
+		env.Token = rest
+	case TypeNick:
+		if rest == "" {
+			return nil, ErrBadFormat
+		}
+		env.Name = rest
+	case TypeModerator, TypeKick, TypeBan, TypeUnban:
+		if rest == "" {
+			return nil, ErrBadFormat
+		}
+		env.To = rest
+	case TypeMute:
+		to, duration, found := strings.Cut(rest, "|")
+		if !found || to == "" || duration == "" {
+			return nil, ErrBadFormat
+		}
+		env.To, env.Duration = to, duration
+	case TypeRead:
+		env.MsgID = rest
+	case TypeReceipts:
+		if rest != "on" && rest != "off" {
+			return nil, ErrBadFormat
+		}
+		env.Body = rest
+	case TypeAway:
+		env.Body = rest
+	}
+	return env, nil
+}
+
+// 按照 dialect 把服务端事件渲染成要发送的字节，管道语法只发送消息体
+func Render(dialect Dialect, env *Envelope) []byte {
+	if dialect == DialectJSON {
+		data, err := json.Marshal(env)
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+	return []byte(env.Body)
+}
+
+// 聊天消息事件
+func NewMessage(room int, from, to, body string) *Envelope {
+	return newEvent(TypeMessage, "", room, from, to, body)
+}
+
+// 成员状态变化事件
+func NewPresence(room int, from, body string) *Envelope {
+	return newEvent(TypePresence, "", room, from, "", body)
+}
+
+// 请求出错事件，id 为出错请求的ID
+func NewError(id, body string) *Envelope {
+	return newEvent(TypeError, id, 0, "", "", body)
+}
+
+// 请求已接受事件，id 为被接受请求的ID
+func NewAck(id, body string) *Envelope {
+	return newEvent(TypeAck, id, 0, "", "", body)
+}
+
+// 服务器公告事件，room 为0时发给所有房间
+func NewNotice(room int, body string) *Envelope {
+	return newEvent(TypeNotice, "", room, "server", "", body)
+}
+
+// 私聊回执事件，from 为私聊的接收者，status 为 Receipt* 之一
+func NewReceipt(msgID, from, status, body string) *Envelope {
+	env := newEvent(TypeReceipt, "", 0, from, "", body)
+	env.MsgID, env.Status = msgID, status
+	return env
+}
+
+// 服务端发送的心跳
+func NewPing() *Envelope {
+	return newEvent(TypePing, "", 0, "", "", "ping\n")
+}
+
+// 回复客户端的心跳，id 为 ping 请求的ID
+func NewPong(id string) *Envelope {
+	return newEvent(TypePong, id, 0, "", "", "pong\n")
+}
+
+// 下发重连令牌事件
+func NewSession(token, body string) *Envelope {
+	env := newEvent(TypeSession, "", 0, "", "", body)
+	env.Token = token
+	return env
+}
+
+func newEvent(msgType, id string, room int, from, to, body string) *Envelope {
+	return &Envelope{
+		Type:      msgType,
+		ID:        id,
+		Room:      room,
+		From:      from,
+		To:        to,
+		Body:      body,
+		Timestamp: time.Now().UnixMilli(),
+	}
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePipeKeepsSeparatorsInBody(t *testing.T) {
+	env, err := ParsePipe("0|bob|a|b|c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != TypePrivate || env.To != "bob" || env.Body != "a|b|c" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	env, err = ParsePipe("1|x|y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != TypeBroadcast || env.Body != "x|y" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+}
+
+func TestParsePipeLogin(t *testing.T) {
+	env, err := ParsePipe("6|alice|pa|ss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != TypeLogin || env.Name != "alice" || env.Password != "pa|ss" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+}
+
+func TestParsePipeHistory(t *testing.T) {
+	env, err := ParsePipe("7|30")
+	if err != nil || env.Type != TypeHistory || env.Limit != 30 {
+		t.Fatalf("ParsePipe(7|30) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("7")
+	if err != nil || env.Type != TypeHistory || env.Limit != 0 {
+		t.Fatalf("ParsePipe(7) = %+v, %v", env, err)
+	}
+}
+
+func TestParsePipeJoin(t *testing.T) {
+	env, err := ParsePipe("10|3")
+	if err != nil || env.Type != TypeJoin || env.Room != 3 || env.Name != "" {
+		t.Fatalf("ParsePipe(10|3) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("10|dev")
+	if err != nil || env.Type != TypeJoin || env.Room != 0 || env.Name != "dev" {
+		t.Fatalf("ParsePipe(10|dev) = %+v, %v", env, err)
+	}
+}
+
+func TestParsePipeCreateRoom(t *testing.T) {
+	env, err := ParsePipe("9|dev")
+	if err != nil || env.Type != TypeCreateRoom || env.Name != "dev" || env.Policy != "" {
+		t.Fatalf("ParsePipe(9|dev) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("9|dev|spill_to_disk")
+	if err != nil || env.Name != "dev" || env.Policy != "spill_to_disk" {
+		t.Fatalf("ParsePipe(9|dev|spill_to_disk) = %+v, %v", env, err)
+	}
+}
+
+func TestParsePipeResume(t *testing.T) {
+	env, err := ParsePipe("13|abc123")
+	if err != nil || env.Type != TypeResume || env.Token != "abc123" {
+		t.Fatalf("ParsePipe(13|abc123) = %+v, %v", env, err)
+	}
+}
+
+func TestParsePipeModeration(t *testing.T) {
+	env, err := ParsePipe("15|bob|5m")
+	if err != nil || env.Type != TypeMute || env.To != "bob" || env.Duration != "5m" {
+		t.Fatalf("ParsePipe(15|bob|5m) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("17|bob")
+	if err != nil || env.Type != TypeBan || env.To != "bob" {
+		t.Fatalf("ParsePipe(17|bob) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("19|abc-1")
+	if err != nil || env.Type != TypeRead || env.MsgID != "abc-1" {
+		t.Fatalf("ParsePipe(19|abc-1) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("24|小明")
+	if err != nil || env.Type != TypeNick || env.Name != "小明" {
+		t.Fatalf("ParsePipe(24|小明) = %+v, %v", env, err)
+	}
+	env, err = ParsePipe("20|off")
+	if err != nil || env.Type != TypeReceipts || env.Body != "off" {
+		t.Fatalf("ParsePipe(20|off) = %+v, %v", env, err)
+	}
+}
+
+func TestParsePipeErrors(t *testing.T) {
+	for _, msg := range []string{"", "abc", "99", "0", "0|", "0||body", "5|alice", "6||secret", "7|x", "7|-1", "9", "10|", "13", "14", "15|bob", "15||5m", "16|", "20", "20|maybe", "24", "24|"} {
+		if _, err := ParsePipe(msg); err != ErrBadFormat {
+			t.Errorf("ParsePipe(%q) err = %v, want ErrBadFormat", msg, err)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	env, err := ParseJSON([]byte(`{"type":"private","id":"7","to":"bob","body":"a|b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != TypePrivate || env.ID != "7" || env.To != "bob" || env.Body != "a|b" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	for _, msg := range []string{`not json`, `{"type":"message"}`, `{}`} {
+		if _, err := ParseJSON([]byte(msg)); err != ErrBadFormat {
+			t.Errorf("ParseJSON(%q) err = %v, want ErrBadFormat", msg, err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	dialect, hello := Negotiate([]byte(`{"type":"hello","version":1,"id":"h"}`))
+	if dialect != DialectJSON || hello == nil || hello.ID != "h" {
+		t.Fatalf("dialect = %v, hello = %+v", dialect, hello)
+	}
+	for _, msg := range []string{"1|hi", `{"type":"broadcast","body":"hi"}`} {
+		if dialect, hello := Negotiate([]byte(msg)); dialect != DialectPipe || hello != nil {
+			t.Errorf("Negotiate(%q) = %v, %+v", msg, dialect, hello)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	env := NewMessage(3, "alice", "", "hi")
+	if got := string(Render(DialectPipe, env)); got != "hi" {
+		t.Fatalf("pipe render = %q", got)
+	}
+	var decoded Envelope
+	if err := json.Unmarshal(Render(DialectJSON, env), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, *env) {
+		t.Fatalf("json render = %+v, want %+v", decoded, *env)
+	}
+}
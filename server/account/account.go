@@ -0,0 +1,109 @@
+package account
+
+import (
+	"chatroom/server/user"
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MaxNameLength     = 32 // 账号名的最大长度
+	MinPasswordLength = 6  // 密码的最小长度
+	MaxPasswordLength = 72 // bcrypt 只使用密码的前72个字节
+)
+
+var (
+	ErrAccountExists   = errors.New("account: account already exists")
+	ErrAccountNotFound = errors.New("account: account not found")
+	ErrWrongPassword   = errors.New("account: wrong password")
+	ErrInvalidName     = errors.New("account: invalid name")
+	ErrInvalidPassword = errors.New("account: invalid password")
+)
+
+// 账号对象，保存在 users 集合中
+type Account struct {
+	Name         string    `bson:"name"`          // 账号名，登录后作为用户的名字
+	PasswordHash []byte    `bson:"password_hash"` // bcrypt 哈希后的密码
+	CreatedAt    time.Time `bson:"created_at"`    // 注册时间
+}
+
+// 账号的存储接口，实现 账号存储 必须实现该接口
+type Store interface {
+	// 保存新账号，账号名已存在时返回 ErrAccountExists
+	Create(ctx context.Context, account *Account) error
+	// 按账号名查找，不存在时返回 ErrAccountNotFound
+	Find(ctx context.Context, name string) (*Account, error)
+}
+
+// 注册和登录的逻辑
+type Service struct {
+	store   Store         // 账号的存储
+	timeout time.Duration // 每次访问存储的超时时间
+}
+
+func NewService(store Store, timeout time.Duration) *Service {
+	return &Service{
+		store:   store,
+		timeout: timeout,
+	}
+}
+
+// 注册账号，密码使用 bcrypt 哈希后保存
+func (s *Service) Register(name, password string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.store.Create(ctx, &Account{
+		Name:         name,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	})
+}
+
+// 校验账号和密码，按旧规则注册的、现在不合法的账号名（例如保留的名字）不能登录
+func (s *Service) Login(name, password string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	account, err := s.store.Find(ctx, name)
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// 账号是否已经注册
+func (s *Service) Exists(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err := s.store.Find(ctx, name)
+	if errors.Is(err, ErrAccountNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 账号名登录后就是用户的名字，和改名使用同一套规则（user.ValidateName），另外不能超过 MaxNameLength 个字节
+func validateName(name string) error {
+	if len(name) > MaxNameLength || user.ValidateName(name, MaxNameLength) != nil {
+		return ErrInvalidName
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package account
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	s := NewService(NewMemoryStore(), time.Second)
+	if err := s.Register("alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("alice", "secret2"); err != ErrAccountExists {
+		t.Fatalf("duplicate register err = %v", err)
+	}
+	if err := s.Login("alice", "secret1"); err != nil {
+		t.Fatalf("login err = %v", err)
+	}
+	if err := s.Login("alice", "secret2"); err != ErrWrongPassword {
+		t.Fatalf("wrong password err = %v", err)
+	}
+	if err := s.Login("bob", "secret1"); err != ErrAccountNotFound {
+		t.Fatalf("unknown account err = %v", err)
+	}
+}
+
+func TestPasswordIsHashed(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewService(store, time.Second)
+	if err := s.Register("alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	account, err := store.Find(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(account.PasswordHash) == "secret1" || len(account.PasswordHash) == 0 {
+		t.Fatalf("password stored as %q", account.PasswordHash)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	s := NewService(NewMemoryStore(), time.Second)
+	for _, name := range []string{"", "a|b", "127.0.0.1:4096", "with space", "abcdefghijklmnopqrstuvwxyz0123456789", "admin", "Server", "a@b"} {
+		if err := s.Register(name, "secret1"); err != ErrInvalidName {
+			t.Errorf("Register(%q) err = %v, want ErrInvalidName", name, err)
+		}
+	}
+	if err := s.Register("alice", "short"); err != ErrInvalidPassword {
+		t.Errorf("short password err = %v, want ErrInvalidPassword", err)
+	}
+}
+
+// 按旧规则注册的保留名字的账号不能登录，否则会以 admin 之类的名字出现
+func TestLoginRejectsReservedName(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewService(store, time.Second)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(context.Background(), &Account{Name: "admin", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Login("admin", "secret1"); err != ErrInvalidName {
+		t.Fatalf("Login(admin) err = %v, want ErrInvalidName", err)
+	}
+}
@@ -0,0 +1,40 @@
+package account
+
+import (
+	"context"
+	"sync"
+)
+
+// 保存在内存中的账号存储，用于测试和不需要持久化的场景
+type MemoryStore struct {
+	mu       sync.Mutex
+	accounts map[string]*Account // name -> *Account
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts: make(map[string]*Account),
+	}
+}
+
+func (s *MemoryStore) Create(ctx context.Context, account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, isPresent := s.accounts[account.Name]; isPresent {
+		return ErrAccountExists
+	}
+	saved := *account
+	s.accounts[account.Name] = &saved
+	return nil
+}
+
+func (s *MemoryStore) Find(ctx context.Context, name string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, isPresent := s.accounts[name]
+	if !isPresent {
+		return nil, ErrAccountNotFound
+	}
+	found := *account
+	return &found, nil
+}
@@ -0,0 +1,64 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const UsersCollection = "users" // 保存账号的集合名称
+
+// 保存在 Mongo users 集合中的账号存储
+type MongoStore struct {
+	collection *mongo.Collection
+	indexMu    sync.Mutex
+	indexed    bool // 第一次写入时才创建唯一索引，避免启动时就必须连上数据库；创建失败时下次写入重试
+}
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	return &MongoStore{
+		collection: database.Collection(UsersCollection),
+	}
+}
+
+// 在 name 上创建唯一索引，保证账号名不重复
+func (s *MongoStore) ensureIndex(ctx context.Context) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexed {
+		return nil
+	}
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.indexed = err == nil
+	return err
+}
+
+func (s *MongoStore) Create(ctx context.Context, account *Account) error {
+	if err := s.ensureIndex(ctx); err != nil {
+		return err
+	}
+	_, err := s.collection.InsertOne(ctx, account)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAccountExists
+	}
+	return err
+}
+
+func (s *MongoStore) Find(ctx context.Context, name string) (*Account, error) {
+	account := &Account{}
+	err := s.collection.FindOne(ctx, bson.D{{Key: "name", Value: name}}).Decode(account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
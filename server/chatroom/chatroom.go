@@ -1,171 +1,678 @@
 package chatroom
 
 import (
+	"chatroom/config"
 	"chatroom/constants"
-	"chatroom/parameter"
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/chatroom/message_store_ring"
+	"chatroom/server/history"
+	"chatroom/server/metrics"
+	"chatroom/server/moderation"
+	"chatroom/server/ratelimit"
 	"chatroom/server/user"
 	"chatroom/utils"
 	"fmt"
 	"io"
 	"log"
-	"strconv"
-	"strings"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 聊天室之外的命令（如注册、登录）和断线处理，交给实现了该接口的 ChatServer 处理
+type CommandHandler interface {
+	// 处理 env 对应的命令，不认识该命令时返回 false
+	HandleCommand(cr *Chatroom, u *user.User, env *protocol.Envelope) bool
+	// 用户的连接异常断开，在用户离开房间之前调用，用于保存断线重连的会话
+	HandleDisconnect(cr *Chatroom, u *user.User)
+	// 房间的成员离开或者断开了连接，空出了位置，用于让等待进入房间的用户进入
+	HandleUserLeft(cr *Chatroom)
+}
+
 // 聊天室的接口，实现 聊天室 必须实现该接口
 type IChatroom interface {
 	AddUserToRoom(*user.User) bool
+	TryAddUser(*user.User) bool
+	ResumeUser(u *user.User, lastSeq int64) bool
+	RemoveUser(*user.User) bool
 	MsgHandle(*user.User)
 	TerminalUserConnect(*user.User)
+	Info() protocol.RoomInfo
+	Member(userName string) (*user.User, bool)
+	MemberNames() []string
+	Notice(body string)
+	SetLimits(maxUsers, ringCapacity int)
+	Banned(*user.User) bool
+	Close()
+	Closed() <-chan struct{}
 }
 
 type Chatroom struct {
-	RoomId           int                   // 房间ID, 自增的ID，atomicInt
-	UserMap          map[string]*user.User // 聊天室对应的userName(default:"IP:Port")->User 对应每个用户的map
-	usersMaxCapacity int                   // 房间的最大容量
-	BroadcastChannel chan string           // 广播的channel
-	SignChannel      chan bool             // 房间退出的信号，判断该房间是否被删除
+	RoomId           int                              // 房间ID, 由 ChatroomManager 分配的自增ID
+	Name             string                           // 房间名字，随机分配时创建的房间没有名字
+	mu               sync.RWMutex                     // 保护 members，广播时持有读锁，成员变化时持有写锁
+	members          map[string]*user.User            // 聊天室对应的userName(default:"IP:Port")->User 对应每个用户的map
+	usersMaxCapacity int                              // 房间的最大容量
+	replaySize       int                              // 进入房间时补发的最近消息条数
+	maxPageSize      int                              // history 命令一次最多返回的消息条数
+	idleAwayAfter    time.Duration                    // 成员多久没有发送消息之后自动标记为空闲，为0时不自动标记
+	maxMuteDuration  time.Duration                    // 房主和管理员一次最长可以禁言的时间
+	broadcasts       chan *broadcast                  // 等待发送的广播
+	SignChannel      chan bool                        // 有用户离开房间的信号，判断该房间是否被删除
+	commandHandler   CommandHandler                   // 处理聊天室不认识的命令，可以为 nil
+	MsgRecording     *message_store_ring.MsgRecording // 该房间最近的广播消息
+	msgSeq           int64                            // 最近一条广播消息的序号，只在 listenAndSendBroadMsg 中修改
+	history          *history.History                 // 广播消息的持久化存储，为 nil 时只保存在 MsgRecording 中
+	moderation       *moderation.Service              // 封禁和审计日志，为 nil 时不能封禁
+	owner            uint64                           // 房主的用户ID，随机分配时创建的房间没有房主，为0，由 cr.mu 保护
+	ownerName        string                           // 房主最近的名字，由 cr.mu 保护
+	moderators       map[uint64]bool                  // 管理员的用户ID，由 cr.mu 保护
+	muted            map[uint64]time.Time             // 被禁言的用户ID -> 禁言结束的时间，由 cr.mu 保护
+	reservations     atomic.Int32                     // 等待断线重连回来的用户数，不为0时房间空了也不删除
+	policy           atomic.Int32                     // 广播消息来不及发送时的处理方式 user.SlowConsumerPolicy
+	logger           *slog.Logger                     // 带有 room_id 字段的 logger
+	closing          chan struct{}                    // Close 时关闭，不再接受新的广播
+	done             chan struct{}                    // listenAndSendBroadMsg 退出时关闭
+	closeOnce        sync.Once
 }
 
-// curChatroomCnt当前房间数，为了计算当前房间的ID
-func NewChatroom(curChatroomCnt int) *Chatroom {
+// roomId 由 ChatroomManager 分配，name 为空表示随机分配时创建的房间，cfg 需要已经通过 Validate
+// logger 为该房间日志的上级 logger，会加上 room_id 字段
+func NewChatroom(roomId int, name string, cfg *config.Config, logger *slog.Logger) *Chatroom {
 	cr := &Chatroom{
-		UserMap:          make(map[string]*user.User),
-		usersMaxCapacity: parameter.UsersMaxCapacity,
-		BroadcastChannel: make(chan string),
-		SignChannel:      make(chan bool),
+		RoomId:           roomId,
+		Name:             name,
+		members:          make(map[string]*user.User),
+		moderators:       make(map[uint64]bool),
+		muted:            make(map[uint64]time.Time),
+		usersMaxCapacity: cfg.Chatroom.MaxUsers,
+		replaySize:       cfg.History.ReplaySize,
+		maxPageSize:      cfg.History.MaxPageSize,
+		idleAwayAfter:    cfg.Chatroom.IdleAwayAfter,
+		maxMuteDuration:  cfg.Chatroom.MaxMuteDuration,
+		broadcasts:       make(chan *broadcast),
+		SignChannel:      make(chan bool, 1), // 只需要知道有用户离开过，多次离开合并成一个信号
+		MsgRecording:     message_store_ring.NewMsgRing(cfg.Chatroom.RingCapacity),
+		logger:           logger.With(logging.KeyRoomID, roomId),
+		closing:          make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	policy, err := user.ParseSlowConsumerPolicy(cfg.Chatroom.SlowConsumerPolicy)
+	if err != nil {
+		log.Panicf("chatroom.slow_consumer_policy %q 不合法", cfg.Chatroom.SlowConsumerPolicy)
 	}
-	cr.RoomId = curChatroomCnt + 1
+	cr.SetSlowConsumerPolicy(policy)
 	go cr.listenAndSendBroadMsg()
 	return cr
 }
 
-// 监听BroadcastChannel，发送广播消息
+// 设置该房间广播消息来不及发送时的处理方式
+func (cr *Chatroom) SetSlowConsumerPolicy(policy user.SlowConsumerPolicy) {
+	cr.policy.Store(int32(policy))
+}
+
+// 该房间广播消息来不及发送时的处理方式
+func (cr *Chatroom) SlowConsumerPolicy() user.SlowConsumerPolicy {
+	return user.SlowConsumerPolicy(cr.policy.Load())
+}
+
+// 设置处理聊天室不认识的命令的 CommandHandler
+func (cr *Chatroom) SetCommandHandler(handler CommandHandler) {
+	cr.commandHandler = handler
+}
+
+// 设置广播消息的持久化存储
+func (cr *Chatroom) SetHistory(history *history.History) {
+	cr.history = history
+}
+
+// 一条等待发送的广播，sender 为 nil 时是服务器公告，不需要回复发送者
+type broadcast struct {
+	msg       *protocol.Envelope
+	sender    *user.User
+	requestID string     // 发送者请求的ID，回复发送确认时带回
+	ephemeral bool       // 成员状态变化等不需要记录的事件，不分配序号，也不写入聊天记录
+	exclude   *user.User // 不发给该成员，例如状态变化的成员自己
+}
+
+// 监听 broadcasts，发送广播消息，Close 之后发完正在发送的消息再退出
+// 开启了自动空闲时，同时定期检查长时间没有发送消息的成员
 func (cr *Chatroom) listenAndSendBroadMsg() {
+	defer close(cr.done)
+	var idleCheck <-chan time.Time
+	if cr.idleAwayAfter > 0 {
+		ticker := time.NewTicker(max(cr.idleAwayAfter/2, time.Millisecond))
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
 	for {
-		if msg, open := <-cr.BroadcastChannel; open {
-			log.Printf("%d BroadcastChannel have message: %s", cr.RoomId, msg)
-			for _, u := range cr.UserMap {
-				_, err := u.Conn.Write([]byte(msg))
-				// 如果发送失败就 尝试重复对该用户补偿发送10次 每次间隔1秒，为了避免对方网络波动等相关问题
-				if utils.CheckError(err, fmt.Sprintf("%s broadMsg write", u.Conn.RemoteAddr())) {
-					for i := 0; i < 10; i++ {
-						if _, err := u.Conn.Write([]byte(msg)); err == nil {
-							break
-						}
-						time.Sleep(time.Second)
-					}
-				}
-			}
+		select {
+		case <-cr.closing:
+			return
+		case b := <-cr.broadcasts:
+			cr.send(b)
+		case <-idleCheck:
+			cr.markIdleMembers()
 		}
 	}
 }
 
-// 广播的处理逻辑
-func (cr *Chatroom) broadHandler(msgBody string) {
-	log.Println("已经成功发送了广播消息")
-	cr.BroadcastChannel <- msgBody
+// 把一条广播发给所有成员，只在 listenAndSendBroadMsg 中调用
+func (cr *Chatroom) send(b *broadcast) {
+	msg := b.msg
+	cr.logger.Debug("broadcast", logging.KeyUser, msg.From, logging.Body(msg.Body))
+	start := time.Now()
+	// 记录消息和取成员快照在同一个读锁内，和 AddUserToRoom 的补发互斥，新成员不会漏掉或重复收到消息
+	cr.mu.RLock()
+	if !b.ephemeral {
+		cr.recordMsg(msg)
+	}
+	members := cr.snapshot()
+	cr.mu.RUnlock()
+	// 分配了消息ID和序号之后才算被接受，先于广播本身回复发送者
+	if b.sender != nil {
+		b.sender.Accepted(b.requestID, msg)
+	}
+	// Deliver 只是放进每个用户自己的发送队列，慢的用户按照房间的策略处理，不会拖慢整个房间
+	policy := cr.SlowConsumerPolicy()
+	for _, u := range members {
+		if u == b.exclude {
+			continue
+		}
+		if u.Deliver(msg, policy) != nil {
+			metrics.BroadcastWriteFailures.Inc()
+		}
+	}
+	if !b.ephemeral {
+		metrics.ObserveSince(metrics.BroadcastFanoutSeconds, start)
+	}
+}
+
+// 给广播消息分配消息ID和序号，记录到 MsgRecording 中，开启持久化时同时写入 history
+func (cr *Chatroom) recordMsg(msg *protocol.Envelope) {
+	cr.msgSeq++
+	msg.Seq = cr.msgSeq
+	msg.MsgID = user.NewMessageID()
+	cr.MsgRecording.AddCoverMsg(msg)
+	if cr.history != nil {
+		cr.history.Record(msg)
+	}
+}
+
+// 广播的处理逻辑，房间已经关闭时丢弃消息
+func (cr *Chatroom) broadHandler(msg *protocol.Envelope) {
+	cr.publish(&broadcast{msg: msg})
+}
+
+// 成员发送的广播，被接受之后回复发送者
+func (cr *Chatroom) broadcastFrom(sender *user.User, env *protocol.Envelope) {
+	cr.publish(&broadcast{
+		msg:       protocol.NewMessage(cr.RoomId, sender.Name(), "", env.Body+"\n"),
+		sender:    sender,
+		requestID: env.ID,
+	})
+}
+
+func (cr *Chatroom) publish(b *broadcast) {
+	select {
+	case cr.broadcasts <- b:
+	case <-cr.closing:
+		cr.logger.Info("room closed, broadcast dropped", logging.KeyUser, b.msg.From)
+	}
+}
+
+// 关闭房间: 不再接受新的广播，等待正在发送的广播发完，可以重复调用
+func (cr *Chatroom) Close() {
+	cr.closeOnce.Do(func() {
+		// 和 updateMembersMetric 互斥，关闭之后不会再输出该房间的成员数
+		cr.mu.Lock()
+		close(cr.closing)
+		metrics.DeleteRoom(cr.RoomId)
+		cr.mu.Unlock()
+	})
+	<-cr.done
+}
+
+// Close 开始时关闭的 channel，用来等待房间被关闭
+func (cr *Chatroom) Closed() <-chan struct{} {
+	return cr.closing
+}
+
+// 通过广播发送服务器公告，和普通的广播消息一样记录在聊天记录中
+func (cr *Chatroom) Notice(body string) {
+	cr.broadHandler(protocol.NewNotice(cr.RoomId, body+"\n"))
+}
+
+// 更新该房间的成员数指标，房间关闭之后不再更新，调用者需要持有 cr.mu
+func (cr *Chatroom) updateMembersMetric() {
+	select {
+	case <-cr.closing:
+	default:
+		metrics.SetRoomMembers(cr.RoomId, len(cr.members))
+	}
+}
+
+// 带有 room_id、user 和 remote_addr 字段的 logger
+func (cr *Chatroom) userLogger(user *user.User) *slog.Logger {
+	return user.Logger().With(logging.KeyRoomID, cr.RoomId)
+}
+
+// 当前成员的快照，调用者需要持有 cr.mu
+func (cr *Chatroom) snapshot() []*user.User {
+	members := make([]*user.User, 0, len(cr.members))
+	for _, u := range cr.members {
+		members = append(members, u)
+	}
+	return members
+}
+
+// 按名字查找房间内的成员
+func (cr *Chatroom) Member(userName string) (*user.User, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	u, isPresent := cr.members[userName]
+	return u, isPresent
+}
+
+// 房间内所有成员的名字
+func (cr *Chatroom) MemberNames() []string {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	names := make([]string, 0, len(cr.members))
+	for userName := range cr.members {
+		names = append(names, userName)
+	}
+	return names
 }
 
 // 用户进入房间的逻辑, 检查并保存user, 返回当前分配 成功/失败
 func (cr *Chatroom) AddUserToRoom(user *user.User) bool {
-	if len(cr.UserMap)+1 > cr.usersMaxCapacity {
-		utils.SendMessage(user.Conn, fmt.Sprintf("当前房间已满，你无法进入"))
-		log.Printf("当前房间ID为%d已满，房间人数为%d，%s的用户无法进入", cr.RoomId, len(cr.UserMap), user.UserName)
+	return cr.addUser(user, true)
+}
+
+// 和 AddUserToRoom 一样，但是房间已满或者被封禁时不提示用户
+// 分配房间时会依次尝试很多个房间，只有最后的结果需要告诉用户
+func (cr *Chatroom) TryAddUser(user *user.User) bool {
+	return cr.addUser(user, false)
+}
+
+// notify 为 false 时进不去房间不提示用户，只记录日志
+func (cr *Chatroom) addUser(user *user.User, notify bool) bool {
+	if cr.Banned(user) {
+		if notify {
+			user.Send(protocol.NewError("", "你已被禁止进入该聊天室\n"))
+		}
+		cr.userLogger(user).Info("banned user refused")
+		return false
+	}
+	cr.mu.Lock()
+	if members, capacity := len(cr.members), cr.usersMaxCapacity; members+1 > capacity {
+		cr.mu.Unlock()
+		if notify {
+			user.Send(protocol.NewError("", "当前房间已满，你无法进入"))
+		}
+		cr.userLogger(user).Debug("room full, join refused", "members", members, "capacity", capacity)
+		return false
+	}
+	user.Send(protocol.NewPresence(cr.RoomId, user.Name(), fmt.Sprintf("你已分配到ID为%d的房间", cr.RoomId)))
+	cr.userLogger(user).Info("user joined room")
+	cr.members[user.Name()] = user
+	cr.updateMembersMetric()
+	user.SetRoomId(cr.RoomId)
+	user.Touch()
+	cr.replayHistory(user)
+	cr.mu.Unlock()
+	// 广播需要 cr.mu 的读锁，释放写锁之后再通知其他成员
+	cr.announce(user, protocol.PresenceJoin, fmt.Sprintf("%s 进入了聊天室", user.Name()))
+	return true
+}
+
+// 断线重连的用户回到房间，不再补发最近的消息，只补发断线期间错过的消息
+// lastSeq 是断线时 LastSeen 的返回值，用户已经在该房间时只补发消息
+func (cr *Chatroom) ResumeUser(user *user.User, lastSeq int64) bool {
+	if cr.Banned(user) {
+		user.Send(protocol.NewError("", "你已被禁止进入该聊天室\n"))
 		return false
 	}
-	utils.SendMessage(user.Conn, fmt.Sprintf("你已分配到ID为%d的房间, %d", cr.RoomId))
-	log.Printf("用户名字为%s，已分配到ID为%d的房间", user.UserName, cr.RoomId)
-	cr.UserMap[user.UserName] = user
+	cr.mu.Lock()
+	_, rejoined := cr.members[user.Name()]
+	if !rejoined {
+		if len(cr.members)+1 > cr.usersMaxCapacity {
+			cr.mu.Unlock()
+			user.Send(protocol.NewError("", "当前房间已满，你无法进入"))
+			return false
+		}
+		cr.members[user.Name()] = user
+		cr.updateMembersMetric()
+		user.SetRoomId(cr.RoomId)
+	}
+	defer func() {
+		cr.mu.Unlock()
+		if !rejoined {
+			cr.announce(user, protocol.PresenceJoin, fmt.Sprintf("%s 重新连接到聊天室", user.Name()))
+		}
+	}()
+	cr.userLogger(user).Info("user resumed room")
+	user.Send(protocol.NewPresence(cr.RoomId, user.Name(), fmt.Sprintf("你已回到ID为%d的房间", cr.RoomId)))
+	// 按序号而不是 MsgRecording 的索引补发，断线期间环被覆盖或者 Resize 都不影响
+	var missed []*protocol.Envelope
+	for _, msg := range cr.MsgRecording.GetLastMsg(cr.MsgRecording.Capacity()) {
+		if msg.Seq > lastSeq {
+			missed = append(missed, msg)
+		}
+	}
+	var cursor *protocol.Envelope
+	if len(missed) > 0 {
+		cursor = missed[0]
+	}
+	user.SetHistoryCursor(cursor)
+	policy := cr.SlowConsumerPolicy()
+	for _, msg := range missed {
+		user.Deliver(msg, policy)
+	}
 	return true
 }
 
+// 用户断线时看到的最后位置: 最近一条广播消息的序号
+func (cr *Chatroom) LastSeen() int64 {
+	if last := cr.MsgRecording.GetLastMsg(1); len(last) > 0 {
+		return last[0].Seq
+	}
+	return 0
+}
+
+// 为断线的用户保留房间，宽限期内房间空了也不会被删除
+func (cr *Chatroom) Reserve() {
+	cr.reservations.Add(1)
+}
+
+// 断线的用户已经回来或者会话已经过期，释放 Reserve 保留的房间
+func (cr *Chatroom) Release() {
+	cr.reservations.Add(-1)
+	cr.signUserLeft()
+}
+
+// 房间是否可以删除: 没有成员，也没有等待重连的用户
+func (cr *Chatroom) IsIdle() bool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return len(cr.members) == 0 && cr.reservations.Load() == 0
+}
+
+// 用户离开房间回到大厅，不关闭连接，用户不在该房间时返回 false
+func (cr *Chatroom) RemoveUser(user *user.User) bool {
+	cr.mu.Lock()
+	if cr.members[user.Name()] != user {
+		cr.mu.Unlock()
+		return false
+	}
+	delete(cr.members, user.Name())
+	cr.updateMembersMetric()
+	// 禁言在离开之后仍然有效，只清掉已经结束的
+	cr.sweepMuted()
+	cr.mu.Unlock()
+	user.ClearRoomId(cr.RoomId)
+	cr.userLogger(user).Info("user left room")
+	cr.announce(user, protocol.PresenceLeave, fmt.Sprintf("%s 离开了聊天室", user.Name()))
+	cr.signUserLeft()
+	cr.userLeft()
+	return true
+}
+
+// 修改房间的容量和 MsgRecording 保存的消息条数，不会移出已经在房间里的用户
+// 人数超过新容量的房间只是不再接受新的用户，直到人数降到容量以下
+func (cr *Chatroom) SetLimits(maxUsers, ringCapacity int) {
+	cr.mu.Lock()
+	cr.usersMaxCapacity = maxUsers
+	cr.mu.Unlock()
+	cr.MsgRecording.Resize(ringCapacity)
+}
+
+// 房间的概况
+func (cr *Chatroom) Info() protocol.RoomInfo {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return protocol.RoomInfo{
+		ID:       cr.RoomId,
+		Name:     cr.Name,
+		Members:  len(cr.members),
+		Capacity: cr.usersMaxCapacity,
+		Policy:   cr.SlowConsumerPolicy().String(),
+		Owner:    cr.ownerName,
+	}
+}
+
+// 通知 perCheckDeleteChatroom 有用户离开，已经有未处理的信号时不再重复发送
+func (cr *Chatroom) signUserLeft() {
+	select {
+	case cr.SignChannel <- true:
+	default:
+	}
+}
+
+// 成员离开之后通知 commandHandler 房间空出了位置
+func (cr *Chatroom) userLeft() {
+	if cr.commandHandler != nil {
+		cr.commandHandler.HandleUserLeft(cr)
+	}
+}
+
+// 给刚进入房间的用户补发最近的消息，并把 history 的起点设为补发的第一条消息
+func (cr *Chatroom) replayHistory(user *user.User) {
+	msgs := cr.MsgRecording.GetLastMsg(cr.replaySize)
+	var cursor *protocol.Envelope
+	if len(msgs) > 0 {
+		cursor = msgs[0]
+	}
+	user.SetHistoryCursor(cursor)
+	for _, msg := range msgs {
+		user.Send(msg)
+	}
+}
+
+// 从持久化存储中往前翻 env.Limit 条消息，没有开启持久化时从 MsgRecording 中查找
+func (cr *Chatroom) historyHandler(user *user.User, env *protocol.Envelope) {
+	limit := env.Limit
+	if limit <= 0 || limit > cr.maxPageSize {
+		limit = cr.maxPageSize
+	}
+	var msgs []*protocol.Envelope
+	cursor := user.HistoryCursor()
+	if cr.history != nil {
+		var err error
+		if msgs, err = cr.history.Before(cr.RoomId, cursor, limit); err != nil {
+			cr.userLogger(user).Error("read history failed", logging.Err(err))
+			user.Send(protocol.NewError(env.ID, "聊天记录暂时不可用，请稍后再试\n"))
+			return
+		}
+	} else {
+		msgs = cr.ringBefore(cursor, limit)
+	}
+	if len(msgs) == 0 {
+		user.Send(protocol.NewAck(env.ID, "没有更早的聊天记录了\n"))
+		return
+	}
+	user.SetHistoryCursor(msgs[0])
+	for _, msg := range msgs {
+		user.Send(msg)
+	}
+	user.Send(protocol.NewAck(env.ID, fmt.Sprintf("以上是%d条更早的聊天记录\n", len(msgs))))
+}
+
+// MsgRecording 中序号小于 cursor 的最近 n 条消息，cursor 为 nil 时返回最近的 n 条
+func (cr *Chatroom) ringBefore(cursor *protocol.Envelope, n int) []*protocol.Envelope {
+	msgs := cr.MsgRecording.GetLastMsg(cr.MsgRecording.Capacity())
+	end := len(msgs)
+	if cursor != nil {
+		for end > 0 && msgs[end-1].Seq >= cursor.Seq {
+			end--
+		}
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	return msgs[start:end]
+}
+
 // 处理消息每一个用户消息的逻辑
+// 通过 user.ReadMsg 每次读出一条完整的消息，再交给 parseMsg
+// 用户断开连接或者离开该房间时返回
 func (cr *Chatroom) MsgHandle(user *user.User) {
-	curConn := user.Conn
-	readBytes := make([]byte, 512)
-	for {
-		n, err := curConn.Read(readBytes)
-		//log.Printf("接收字节长度:%d, 字节内容是:%s\n", n, readBytes)
-		if utils.CheckError(err, "Read") {
+	for user.RoomId() == cr.RoomId {
+		msg, err := user.ReadMsg()
+		// 连接已经在 TerminalUserConnect 中关闭，不需要再处理
+		// 发送超时由 listenAndWrite 关闭的连接按断线处理
+		if user.IsClosed() {
+			return
+		}
+		if err == io.EOF || utils.CheckError(err, "Read") {
+			cr.userLogger(user).Info("user disconnected")
+			if cr.commandHandler != nil {
+				cr.commandHandler.HandleDisconnect(cr, user)
+			}
+			cr.TerminalUserConnect(user)
 			return
 		}
-		if n == 0 || err == io.EOF {
-			remoteAddr := curConn.RemoteAddr().String()
-			log.Printf("%s 用户已下线\n", remoteAddr)
-			delete(cr.UserMap, remoteAddr)
+		// 读消息期间被移出了该房间（例如房间被关闭），这条消息不再由该房间处理
+		if user.RoomId() != cr.RoomId {
+			user.Send(protocol.NewError("", "你已经不在该聊天室中，请重新发送\n"))
 			return
 		}
-		cr.parseMsg(string(readBytes[0:n-1]), user)
+		cr.parseMsg(msg, user)
 	}
 }
 
-// 解析消息格式并处理msg
-// <option>|<...>
+// 处理用户在房间之外读到、进入房间之后才交给房间的一条消息（例如等待队列中的用户刚刚进入房间）
+func (cr *Chatroom) HandleMsg(user *user.User, msg []byte) {
+	if user.RoomId() != cr.RoomId {
+		user.Send(protocol.NewError("", "你已经不在该聊天室中，请重新发送\n"))
+		return
+	}
+	cr.parseMsg(msg, user)
+}
+
+// 按照用户协商的协议解析消息并处理msg
+// 管道语法: <option>|<...>
 // eg: 0|<name>|<msgbody>
 // eg: 1|<msgbody>
-func (cr *Chatroom) parseMsg(msg string, user *user.User) {
-	const FormatN = 3
-	curConn := user.Conn
-	remoteAddr := curConn.RemoteAddr().String()
-	msgSplit := strings.Split(msg, "|")
-	if len(msgSplit) > FormatN {
-		utils.SendMessage(curConn, "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr())
-		log.Println(curConn, "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr())
+// JSON 协议: {"type":"private","to":"<name>","body":"<msgbody>"}
+func (cr *Chatroom) parseMsg(msg []byte, user *user.User) {
+	env, err := protocol.Parse(user.Dialect(), msg)
+	if err != nil {
+		user.Send(protocol.NewError("", "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr()))
+		cr.userLogger(user).Debug("malformed request", logging.Err(err))
 		return
 	}
-	// 不是正确的option格式
-	msgOption, err := strconv.Atoi(msgSplit[0])
-	if utils.CheckError(err, "Strconv.Atoi") {
-		utils.SendMessage(curConn, "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr())
-		log.Println(curConn, "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr())
+
+	cr.userLogger(user).Debug("request", logging.KeyOp, env.Type)
+	metrics.Messages.WithLabelValues(env.Type).Inc()
+	if verdict := user.CheckRate(env); verdict != ratelimit.Allow {
+		if verdict == ratelimit.Disconnect {
+			cr.TerminalUserConnect(user)
+		}
 		return
 	}
 
-	log.Println("Message option:", msgOption)
-
-	switch msgOption {
-	case constants.QuitOption:
-		log.Println("Quit remoteAddr:", remoteAddr)
-		u, ok := cr.UserMap[remoteAddr]
-		if !ok {
-			log.Panicf("SafeUserMap没有用户名为: %s的用户", u.UserName)
+	// 心跳不算发送消息，自动标记为空闲的成员发送其他任何消息都算回来了，back 命令自己处理
+	if env.Type != protocol.TypePing && env.Type != protocol.TypePong {
+		user.Touch()
+		if env.Type != protocol.TypeBack && user.Wake() {
+			cr.announce(user, protocol.PresenceBack, fmt.Sprintf("%s 回来了", user.Name()))
 		}
-		utils.SendMessage(curConn, fmt.Sprintf("Bye~ %s\n", u.UserName))
-		log.Println(curConn, fmt.Sprintf("Bye~ %s\n", u.UserName))
+	}
+
+	switch env.Type {
+	case protocol.TypeQuit:
+		user.Send(protocol.NewAck(env.ID, fmt.Sprintf("Bye~ %s\n", user.Name())))
 		cr.TerminalUserConnect(user)
-	case constants.PrivateChatOption:
-		distUserName, msgBody := msgSplit[1], strings.Join(msgSplit[2:], "")
-		if curUser, isPresent := cr.UserMap[distUserName]; !isPresent {
-			utils.SendMessage(curConn, fmt.Sprintf("你发送的%s不存在\n", distUserName))
-			log.Println(curConn, fmt.Sprintf("你发送的%s不存在\n", distUserName))
+	case protocol.TypePrivate:
+		// 接收者可能在其他房间或者不在线，检查禁言之后交给 commandHandler 按全局的用户路由
+		if cr.rejectMuted(user, env) {
 			return
-		} else {
-			curUser.PrivateMsgHandler(distUserName + "#" + msgBody + "\n")
-		}
-	case constants.BroadOption:
-		msgBody := strings.Join(msgSplit[1:], "") + "\n"
-		cr.broadHandler(msgBody)
-	case constants.ShowAllOnlineUsersOption:
-		var userNames string
-		for userName := range cr.UserMap {
-			userNames += userName + "\n"
-		}
-		utils.SendMessage(curConn, userNames)
-	case constants.MyNameOption:
-		utils.SendMessage(curConn, fmt.Sprintf("你的名字是:%s\n", remoteAddr))
-	default: // 格式不对，返回重新输入
-		utils.SendMessage(curConn, constants.DynamicConstIntroduceStr())
-		log.Println(curConn, constants.DynamicConstIntroduceStr())
+		}
+		cr.delegate(user, env)
+	case protocol.TypeBroadcast:
+		if cr.rejectMuted(user, env) {
+			return
+		}
+		cr.broadcastFrom(user, env)
+	case protocol.TypeShow:
+		user.Send(protocol.NewAck(env.ID, cr.memberList()))
+	case protocol.TypeAway, protocol.TypeBack, protocol.TypeTyping:
+		cr.presenceHandler(user, env)
+	case protocol.TypePing:
+		user.Send(protocol.NewPong(env.ID))
+	case protocol.TypePong: // 收到任何消息时读超时已经重新开始计算
+	case protocol.TypeHistory:
+		cr.historyHandler(user, env)
+	case protocol.TypeMyName:
+		user.Send(protocol.NewAck(env.ID, fmt.Sprintf("你的名字是:%s\n", user.Name())))
+	case protocol.TypeModerator, protocol.TypeMute, protocol.TypeKick, protocol.TypeBan, protocol.TypeUnban:
+		cr.moderationHandler(user, env)
+	default:
+		cr.delegate(user, env)
+	}
+}
+
+// 聊天室不认识的命令交给 commandHandler，还是不认识就返回重新输入
+func (cr *Chatroom) delegate(user *user.User, env *protocol.Envelope) {
+	if cr.commandHandler != nil && cr.commandHandler.HandleCommand(cr, user, env) {
 		return
 	}
+	user.Send(protocol.NewError(env.ID, constants.DynamicConstIntroduceStr()))
+	cr.userLogger(user).Debug("unsupported request", logging.KeyOp, env.Type)
+}
+
+// JSON 协议的请求带有ID时，回复 ack 告诉发送者请求已被接受
+// 管道语法没有ID，保持原来不回复的行为
+func (cr *Chatroom) ack(user *user.User, env *protocol.Envelope) {
+	if env.ID != "" {
+		user.Send(protocol.NewAck(env.ID, ""))
+	}
+}
+
+// 修改房间内用户的名字，同时修改全局 SafeUserMap 中的 key
+// newName 已被占用时返回 false
+func (cr *Chatroom) RenameUser(user *user.User, newName string) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	oldName := user.Name()
+	if _, ok := user.UserMap.Rename(oldName, newName); !ok {
+		return false
+	}
+	delete(cr.members, oldName)
+	user.SetName(newName)
+	cr.members[newName] = user
+	// 角色和禁言按用户ID记录，改名之后不变，只需要更新显示的房主名字
+	if cr.owner == user.ID() {
+		cr.ownerName = newName
+	}
+	cr.userLogger(user).Info("user renamed", "old_name", oldName)
+	return true
 }
 
 // 用户退出连接时，所做的后处理
 func (cr *Chatroom) TerminalUserConnect(user *user.User) {
-	log.Printf("删除时: Id为%d的房间的UserMap地址为%p\n", cr.RoomId, cr.UserMap)
-	delete(cr.UserMap, user.Conn.RemoteAddr().String())
-	cr.SignChannel <- true
-	user.Conn.Close()
+	cr.mu.Lock()
+	wasMember := cr.members[user.Name()] == user
+	if wasMember {
+		delete(cr.members, user.Name())
+		cr.updateMembersMetric()
+	}
+	cr.mu.Unlock()
+	if wasMember && user.TimedOut() {
+		cr.announce(user, protocol.PresenceTimeout, fmt.Sprintf("%s 连接超时", user.Name()))
+	} else if wasMember {
+		cr.announce(user, protocol.PresenceDisconnect, fmt.Sprintf("%s 断开了连接", user.Name()))
+	}
+	user.UserMap.DeleteUser(user.Name())
+	user.ClearRoomId(cr.RoomId)
+	cr.signUserLeft()
+	if wasMember {
+		cr.userLeft()
+	}
+	user.Close()
 }
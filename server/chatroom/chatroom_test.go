@@ -0,0 +1,253 @@
+package chatroom
+
+import (
+	"chatroom/config"
+	"chatroom/protocol"
+	"chatroom/server/user"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 创建一个通过 net.Pipe 连接的用户，另一端的数据被持续读走
+func newPipeUser(t *testing.T, name string, userMap *user.SafeUserMap) *user.User {
+	t.Helper()
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	u := user.NewUser(name, "127.0.0.1", name, server, userMap, config.Default(), slog.Default())
+	userMap.SetUser(name, u)
+	t.Cleanup(func() {
+		u.Close()
+		client.Close()
+	})
+	return u
+}
+
+// 并发地进出房间、广播、改名和查看成员，配合 go test -race 检查数据竞争
+func TestConcurrentJoinLeaveBroadcast(t *testing.T) {
+	cr := NewChatroom(1, "", config.Default(), slog.Default())
+	defer cr.Close()
+	userMap := user.NewSafeUserMap()
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		u := newPipeUser(t, fmt.Sprintf("user-%d", w), userMap)
+		wg.Add(1)
+		go func(w int, u *user.User) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if !cr.AddUserToRoom(u) {
+					t.Errorf("%s could not join", u.Name())
+					return
+				}
+				cr.broadHandler(protocol.NewMessage(cr.RoomId, u.Name(), "", fmt.Sprintf("%d-%d", w, i)))
+				if _, ok := cr.Member(u.Name()); !ok {
+					t.Errorf("%s not a member after join", u.Name())
+				}
+				cr.MemberNames()
+				cr.Info()
+				if i%10 == 0 {
+					newName := fmt.Sprintf("user-%d-%d", w, i)
+					if !cr.RenameUser(u, newName) {
+						t.Errorf("rename %s to %s failed", u.Name(), newName)
+					}
+				}
+				if !cr.RemoveUser(u) {
+					t.Errorf("%s could not leave", u.Name())
+				}
+				cr.IsIdle()
+			}
+		}(w, u)
+	}
+	wg.Wait()
+	cr.Close() // 等待最后一条广播发完
+
+	if info := cr.Info(); info.Members != 0 {
+		t.Fatalf("members = %d after everyone left", info.Members)
+	}
+	if got := len(cr.MsgRecording.GetLastMsg(workers * rounds)); got != workers*rounds {
+		t.Fatalf("recorded %d broadcasts, want %d", got, workers*rounds)
+	}
+}
+
+// 一个协程不停地改名，另一个协程同时查看成员、广播和标记空闲，配合 go test -race 检查名字的数据竞争
+func TestRenameWhileShowAndBroadcast(t *testing.T) {
+	cr := NewChatroom(1, "", config.Default(), slog.Default())
+	defer cr.Close()
+	userMap := user.NewSafeUserMap()
+	alice := newPipeUser(t, "alice", userMap)
+	bob := newPipeUser(t, "bob", userMap)
+	cr.AddUserToRoom(alice)
+	cr.AddUserToRoom(bob)
+
+	const rounds = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			if !cr.RenameUser(alice, fmt.Sprintf("alice-%d", i)) {
+				t.Errorf("rename %d failed", i)
+				return
+			}
+		}
+	}()
+	for i := 0; i < rounds; i++ {
+		cr.memberList()
+		cr.markIdleMembers()
+		cr.broadHandler(protocol.NewMessage(cr.RoomId, bob.Name(), "", fmt.Sprint(i)))
+		alice.Logger().Debug("show", "round", i)
+	}
+	<-done
+	if _, ok := cr.Member(fmt.Sprintf("alice-%d", rounds-1)); !ok {
+		t.Fatalf("alice not a member under the last name, members %v", cr.MemberNames())
+	}
+}
+
+// 一个不读数据的用户只会填满自己的发送队列，不会拖慢房间里的其他用户
+func TestSlowUserDoesNotStallRoom(t *testing.T) {
+	cr := NewChatroom(1, "", config.Default(), slog.Default())
+	defer cr.Close()
+	userMap := user.NewSafeUserMap()
+
+	slowServer, slowClient := net.Pipe() // 没有人读 slowClient
+	defer slowClient.Close()
+	slow := user.NewUser("slow", "127.0.0.1", "1", slowServer, userMap, config.Default(), slog.Default())
+	defer slow.Close()
+	cr.AddUserToRoom(slow)
+
+	fastServer, fastClient := net.Pipe()
+	defer fastClient.Close()
+	fast := user.NewUser("fast", "127.0.0.1", "2", fastServer, userMap, config.Default(), slog.Default())
+	defer fast.Close()
+	received := make(chan struct{}, 1024)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := fastClient.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range buf[:n] {
+				if b == '!' {
+					received <- struct{}{}
+				}
+			}
+		}
+	}()
+	cr.AddUserToRoom(fast)
+
+	const total = 600 // 超过发送队列的容量，slow 的队列早就满了
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < total; i++ {
+		cr.broadHandler(protocol.NewMessage(cr.RoomId, "fast", "", "!"))
+		select {
+		case <-received:
+		case <-timeout:
+			t.Fatalf("fast user received %d of %d broadcasts", i, total)
+		}
+	}
+}
+
+// 调低容量不会移出已经在房间里的用户，人数降到容量以下之后才接受新的用户
+func TestLoweredCapacityStopsAdmitting(t *testing.T) {
+	cr := NewChatroom(1, "", config.Default(), slog.Default())
+	defer cr.Close()
+	userMap := user.NewSafeUserMap()
+	alice := newPipeUser(t, "alice", userMap)
+	bob := newPipeUser(t, "bob", userMap)
+	carol := newPipeUser(t, "carol", userMap)
+	cr.AddUserToRoom(alice)
+	cr.AddUserToRoom(bob)
+
+	cr.SetLimits(1, 10)
+	if info := cr.Info(); info.Members != 2 || info.Capacity != 1 {
+		t.Fatalf("info after lowering capacity = %+v", info)
+	}
+	if cr.AddUserToRoom(carol) {
+		t.Fatal("room over capacity admitted a new user")
+	}
+	cr.RemoveUser(alice)
+	if cr.AddUserToRoom(carol) {
+		t.Fatal("room at capacity admitted a new user")
+	}
+	cr.RemoveUser(bob)
+	if !cr.AddUserToRoom(carol) {
+		t.Fatal("room below capacity refused a new user")
+	}
+}
+
+// 房间已满时并发地尝试进入和离开，同时分配房间的协程补发历史、用户自己的协程翻历史，配合 go test -race 检查数据竞争
+func TestTryAddFullRoomAndHistoryCursor(t *testing.T) {
+	cfg := config.Default()
+	cfg.Chatroom.MaxUsers = 1
+	cr := NewChatroom(1, "", cfg, slog.Default())
+	defer cr.Close()
+	userMap := user.NewSafeUserMap()
+	alice := newPipeUser(t, "alice", userMap)
+	bob := newPipeUser(t, "bob", userMap)
+	cr.broadHandler(protocol.NewMessage(cr.RoomId, "alice", "", "hello"))
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if cr.AddUserToRoom(alice) {
+				cr.RemoveUser(alice)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if cr.TryAddUser(bob) {
+				cr.RemoveUser(bob)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			cr.historyHandler(bob, &protocol.Envelope{Type: protocol.TypeHistory, Limit: 1})
+		}
+	}()
+	wg.Wait()
+}
+
+// 结束的禁言在被禁言的用户发言或者有人离开时清掉，断线的用户ID不会一直留在 muted 中
+func TestExpiredMutesAreSwept(t *testing.T) {
+	cr := NewChatroom(1, "", config.Default(), slog.Default())
+	defer cr.Close()
+	userMap := user.NewSafeUserMap()
+	alice := newPipeUser(t, "alice", userMap)
+	bob := newPipeUser(t, "bob", userMap)
+	cr.AddUserToRoom(alice)
+	cr.AddUserToRoom(bob)
+
+	const goneID = math.MaxUint64 // 已经断线的用户
+	cr.mu.Lock()
+	cr.muted[alice.ID()] = time.Now().Add(-time.Second)
+	cr.muted[goneID] = time.Now().Add(-time.Second)
+	cr.muted[bob.ID()] = time.Now().Add(time.Hour)
+	cr.mu.Unlock()
+
+	if cr.rejectMuted(alice, &protocol.Envelope{}) {
+		t.Fatal("alice rejected after the mute ended")
+	}
+	cr.RemoveUser(bob)
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	if len(cr.muted) != 1 {
+		t.Fatalf("muted = %v, want only bob's unfinished mute", cr.muted)
+	}
+	if _, ok := cr.muted[bob.ID()]; !ok {
+		t.Fatal("bob's mute was cleared on leaving the room")
+	}
+}
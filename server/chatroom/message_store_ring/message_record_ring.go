@@ -1,31 +1,67 @@
 package message_store_ring
 
-import "chatroom/parameter"
+import (
+	"chatroom/protocol"
+	"sync"
+)
 
-// 一个环形的消息存储的数据结构
-// 只有插入消息 AddCoverMsg 和返回一段消息 GetSeqMsg 两个公开方法
+// 一个环形的消息存储的数据结构，并发安全
+// 插入消息 AddCoverMsg，返回一段消息 GetSeqMsg 和返回最近的消息 GetLastMsg
 type MsgRecording struct {
-	rIndex      int      // 当前存储消息的索引
-	curSize     int      // 当前消息存储的大小（长度）
-	maxCapacity int      // 整个环形消息数据结构消息存储的最大容量
-	msgRing     []string // 消息存储内部的数据
+	mu          sync.Mutex
+	rIndex      int                  // 当前存储消息的索引
+	curSize     int                  // 当前消息存储的大小（长度）
+	maxCapacity int                  // 整个环形消息数据结构消息存储的最大容量
+	msgRing     []*protocol.Envelope // 消息存储内部的数据
 }
 
-func NewMsgRing() *MsgRecording {
+// capacity 为最多保存的消息条数，由 config.ChatroomConfig.RingCapacity 决定
+func NewMsgRing(capacity int) *MsgRecording {
 	return &MsgRecording{
 		rIndex:      0,
 		curSize:     0,
-		maxCapacity: parameter.RingMaxCapacity,
-		msgRing:     make([]string, parameter.RingMaxCapacity),
+		maxCapacity: capacity,
+		msgRing:     make([]*protocol.Envelope, capacity),
 	}
 }
 
+// 最多保存的消息条数
+func (r *MsgRecording) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.maxCapacity
+}
+
+// 修改最多保存的消息条数，保留最近的消息，变小时丢弃更早的消息
+// 之前 Index 返回的索引在 Resize 之后失效
+func (r *MsgRecording) Resize(capacity int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if capacity == r.maxCapacity {
+		return
+	}
+	n := r.curSize
+	if n > capacity {
+		n = capacity
+	}
+	msgRing := make([]*protocol.Envelope, capacity)
+	for i := 0; i < n; i++ {
+		msgRing[i] = r.msgRing[(r.rIndex-n+i+r.maxCapacity)%r.maxCapacity]
+	}
+	r.msgRing = msgRing
+	r.maxCapacity = capacity
+	r.curSize = n
+	r.rIndex = n % capacity
+}
+
 func (r *MsgRecording) isFull() bool {
 	return r.curSize == r.maxCapacity
 }
 
 // 先插入，后增加Index,
-func (r *MsgRecording) AddCoverMsg(msg string) {
+func (r *MsgRecording) AddCoverMsg(msg *protocol.Envelope) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.msgRing[r.rIndex] = msg
 	r.rIndex = (r.rIndex + 1) % r.maxCapacity
 	if !r.isFull() {
@@ -33,14 +69,37 @@ func (r *MsgRecording) AddCoverMsg(msg string) {
 	}
 }
 
+// 下一条消息将要写入的索引，用户记录下它，之后可以用 GetSeqMsg 取回错过的消息
+func (r *MsgRecording) Index() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rIndex
+}
+
 // 从uIndex读取的消息，从r.index里返回消息
-func (r *MsgRecording) GetSeqMsg(uIndex int) []string {
+func (r *MsgRecording) GetSeqMsg(uIndex int) []*protocol.Envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if uIndex <= r.rIndex {
-		return r.msgRing[uIndex:r.rIndex]
+		return append([]*protocol.Envelope(nil), r.msgRing[uIndex:r.rIndex]...)
 	} else {
 		if r.isFull() {
-			return append(r.msgRing[uIndex:r.maxCapacity], r.msgRing[0:r.rIndex]...)
+			return append(append([]*protocol.Envelope(nil), r.msgRing[uIndex:r.maxCapacity]...), r.msgRing[0:r.rIndex]...)
 		}
 		panic("不应该出现环形数组没满，但user index 大于 ringIndex 的情况")
 	}
 }
+
+// 返回最近的 n 条消息，按从早到晚的顺序排列，不足 n 条时返回全部
+func (r *MsgRecording) GetLastMsg(n int) []*protocol.Envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > r.curSize {
+		n = r.curSize
+	}
+	msgs := make([]*protocol.Envelope, 0, n)
+	for i := n; i > 0; i-- {
+		msgs = append(msgs, r.msgRing[(r.rIndex-i+r.maxCapacity)%r.maxCapacity])
+	}
+	return msgs
+}
@@ -1,15 +1,77 @@
 package message_store_ring
 
 import (
-	"fmt"
+	"chatroom/parameter"
+	"chatroom/protocol"
 	"strconv"
 	"testing"
 )
 
+func addMsgs(r *MsgRecording, from, to int) {
+	for i := from; i < to; i++ {
+		r.AddCoverMsg(&protocol.Envelope{Body: strconv.Itoa(i)})
+	}
+}
+
+func bodies(msgs []*protocol.Envelope) []string {
+	res := make([]string, len(msgs))
+	for i, msg := range msgs {
+		res[i] = msg.Body
+	}
+	return res
+}
+
 func TestMsgRing(t *testing.T) {
-	r := NewMsgRing()
-	for i := 0; i < 70; i++ {
-		r.AddCoverMsg(strconv.Itoa(i))
+	r := NewMsgRing(parameter.RingMaxCapacity)
+	addMsgs(r, 0, 70)
+	got := bodies(r.GetSeqMsg(21))
+	if len(got) != 49 || got[0] != "21" || got[48] != "69" {
+		t.Fatalf("GetSeqMsg(21) = %v", got)
+	}
+}
+
+func TestMsgRingWrapAround(t *testing.T) {
+	r := NewMsgRing(parameter.RingMaxCapacity)
+	addMsgs(r, 0, parameter.RingMaxCapacity)
+	index := r.Index()
+	addMsgs(r, parameter.RingMaxCapacity, parameter.RingMaxCapacity+3)
+	got := bodies(r.GetSeqMsg(index))
+	want := []string{strconv.Itoa(parameter.RingMaxCapacity), strconv.Itoa(parameter.RingMaxCapacity + 1), strconv.Itoa(parameter.RingMaxCapacity + 2)}
+	if len(got) != 3 || got[0] != want[0] || got[2] != want[2] {
+		t.Fatalf("GetSeqMsg(%d) = %v, want %v", index, got, want)
+	}
+}
+
+func TestGetLastMsg(t *testing.T) {
+	r := NewMsgRing(parameter.RingMaxCapacity)
+	if got := r.GetLastMsg(5); len(got) != 0 {
+		t.Fatalf("empty ring GetLastMsg = %v", bodies(got))
+	}
+	addMsgs(r, 0, 3)
+	if got := bodies(r.GetLastMsg(5)); len(got) != 3 || got[0] != "0" || got[2] != "2" {
+		t.Fatalf("GetLastMsg(5) = %v", got)
+	}
+	addMsgs(r, 3, parameter.RingMaxCapacity+10)
+	got := bodies(r.GetLastMsg(2))
+	if len(got) != 2 || got[0] != strconv.Itoa(parameter.RingMaxCapacity+8) || got[1] != strconv.Itoa(parameter.RingMaxCapacity+9) {
+		t.Fatalf("GetLastMsg(2) after wrap = %v", got)
+	}
+}
+
+func TestMsgRingResize(t *testing.T) {
+	r := NewMsgRing(5)
+	addMsgs(r, 0, 7)
+	r.Resize(3)
+	if got := bodies(r.GetLastMsg(10)); len(got) != 3 || got[0] != "4" || got[2] != "6" {
+		t.Fatalf("after shrink GetLastMsg = %v", got)
+	}
+	r.Resize(6)
+	addMsgs(r, 7, 9)
+	if got := bodies(r.GetLastMsg(10)); len(got) != 5 || got[0] != "4" || got[4] != "8" {
+		t.Fatalf("after grow GetLastMsg = %v", got)
+	}
+	addMsgs(r, 9, 12)
+	if got := bodies(r.GetLastMsg(10)); len(got) != 6 || got[0] != "6" || got[5] != "11" || r.Capacity() != 6 {
+		t.Fatalf("after wrap GetLastMsg = %v", got)
 	}
-	fmt.Println(r.GetSeqMsg(21))
 }
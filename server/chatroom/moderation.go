@@ -0,0 +1,275 @@
+package chatroom
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/moderation"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// 成员在聊天室中的角色，角色高的成员才能管理角色低的成员
+type role int
+
+const (
+	roleMember    role = iota // 普通成员
+	roleModerator             // 管理员，由房主任命
+	roleOwner                 // 房主，创建房间的用户
+)
+
+// 设置禁言、封禁和审计日志的服务，为 nil 时不能封禁，管理操作只记录到日志中
+func (cr *Chatroom) SetModeration(m *moderation.Service) {
+	cr.moderation = m
+}
+
+// 设置房主，创建房间的用户成为房主
+// 角色和禁言都按用户ID记录，别人改成同样的名字也拿不到房主的权限，改名也躲不过禁言
+func (cr *Chatroom) SetOwner(u *user.User) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.owner, cr.ownerName = u.ID(), u.Name()
+}
+
+// 断线重连的用户继承断线前的连接 oldID 在该房间中的角色和禁言
+func (cr *Chatroom) InheritRoles(oldID uint64, u *user.User) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.owner == oldID {
+		cr.owner, cr.ownerName = u.ID(), u.Name()
+	}
+	if cr.moderators[oldID] {
+		delete(cr.moderators, oldID)
+		cr.moderators[u.ID()] = true
+	}
+	if until, isPresent := cr.muted[oldID]; isPresent {
+		delete(cr.muted, oldID)
+		cr.muted[u.ID()] = until
+	}
+}
+
+// 该用户的账号或IP是否在该聊天室中被封禁
+func (cr *Chatroom) Banned(user *user.User) bool {
+	return cr.moderation != nil && cr.moderation.Banned(cr.Name, user.Account, user.UserIP)
+}
+
+// 该用户在该房间中的角色，调用者需要持有 cr.mu
+func (cr *Chatroom) role(u *user.User) role {
+	switch {
+	case u.ID() == cr.owner:
+		return roleOwner
+	case cr.moderators[u.ID()]:
+		return roleModerator
+	default:
+		return roleMember
+	}
+}
+
+// 清掉已经结束的禁言，断线的用户ID不会再出现，不清理时会一直留在 muted 中，调用者需要持有 cr.mu
+func (cr *Chatroom) sweepMuted() {
+	now := time.Now()
+	for id, until := range cr.muted {
+		if now.After(until) {
+			delete(cr.muted, id)
+		}
+	}
+}
+
+// 被禁言的用户发送广播或私聊时提示剩余时间，返回 true 表示丢弃该请求，禁言已经结束时顺便删掉
+func (cr *Chatroom) rejectMuted(user *user.User, env *protocol.Envelope) bool {
+	cr.mu.RLock()
+	until, isPresent := cr.muted[user.ID()]
+	cr.mu.RUnlock()
+	if !isPresent {
+		return false
+	}
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		cr.mu.Lock()
+		cr.sweepMuted()
+		cr.mu.Unlock()
+		return false
+	}
+	user.Send(protocol.NewError(env.ID, fmt.Sprintf("你在该聊天室中被禁言，还剩%d秒\n", int(math.Ceil(remaining.Seconds())))))
+	return true
+}
+
+// 处理管理命令: 任命管理员、禁言、移出、封禁和解除封禁
+func (cr *Chatroom) moderationHandler(actor *user.User, env *protocol.Envelope) {
+	switch env.Type {
+	case protocol.TypeModerator:
+		cr.appointModerator(actor, env)
+	case protocol.TypeMute:
+		cr.mute(actor, env)
+	case protocol.TypeKick:
+		cr.kick(actor, env)
+	case protocol.TypeBan:
+		cr.ban(actor, env)
+	case protocol.TypeUnban:
+		cr.unban(actor, env)
+	}
+}
+
+// 检查 actor 能否管理 env.To: actor 的角色至少为 atLeast，并且高于对方
+// 可以时返回对方，不可以时提示 actor 并返回 false
+func (cr *Chatroom) moderationTarget(actor *user.User, env *protocol.Envelope, atLeast role) (*user.User, bool) {
+	cr.mu.RLock()
+	actorRole := cr.role(actor)
+	target, isPresent := cr.members[env.To]
+	targetRole := roleMember
+	if isPresent {
+		targetRole = cr.role(target)
+	}
+	cr.mu.RUnlock()
+	var msg string
+	switch {
+	case actorRole < atLeast && atLeast == roleOwner:
+		msg = "只有房主可以执行该操作\n"
+	case actorRole < atLeast:
+		msg = "只有房主和管理员可以管理聊天室\n"
+	case !isPresent:
+		msg = fmt.Sprintf("%s不在该聊天室中\n", env.To)
+	case target == actor:
+		msg = "不能对自己执行该操作\n"
+	case targetRole >= actorRole:
+		msg = "不能管理房主或者其他管理员\n"
+	default:
+		return target, true
+	}
+	actor.Send(protocol.NewError(env.ID, msg))
+	return nil, false
+}
+
+// 房主任命管理员
+func (cr *Chatroom) appointModerator(actor *user.User, env *protocol.Envelope) {
+	target, ok := cr.moderationTarget(actor, env, roleOwner)
+	if !ok {
+		return
+	}
+	cr.mu.Lock()
+	cr.moderators[target.ID()] = true
+	cr.mu.Unlock()
+	cr.record(actor, moderation.ActionModerator, target.Name(), "")
+	cr.Notice(fmt.Sprintf("%s 被 %s 任命为管理员", target.Name(), actor.Name()))
+	cr.ack(actor, env)
+}
+
+// 禁言 env.Duration，时长为0时解除禁言
+func (cr *Chatroom) mute(actor *user.User, env *protocol.Envelope) {
+	d, err := time.ParseDuration(env.Duration)
+	if err != nil || d < 0 || d > cr.maxMuteDuration {
+		actor.Send(protocol.NewError(env.ID, fmt.Sprintf("禁言时长不合法，例如 5m，最长%s，为0时解除禁言\n", cr.maxMuteDuration)))
+		return
+	}
+	target, ok := cr.moderationTarget(actor, env, roleModerator)
+	if !ok {
+		return
+	}
+	cr.mu.Lock()
+	if d == 0 {
+		delete(cr.muted, target.ID())
+	} else {
+		cr.muted[target.ID()] = time.Now().Add(d)
+	}
+	cr.mu.Unlock()
+	cr.record(actor, moderation.ActionMute, target.Name(), d.String())
+	if d == 0 {
+		cr.Notice(fmt.Sprintf("%s 被 %s 解除禁言", target.Name(), actor.Name()))
+	} else {
+		cr.Notice(fmt.Sprintf("%s 被 %s 禁言%s", target.Name(), actor.Name(), d))
+	}
+	cr.ack(actor, env)
+}
+
+// 把成员移出聊天室，回到大厅
+func (cr *Chatroom) kick(actor *user.User, env *protocol.Envelope) {
+	target, ok := cr.moderationTarget(actor, env, roleModerator)
+	if !ok {
+		return
+	}
+	cr.removeByModerator(actor, target, "移出")
+	cr.record(actor, moderation.ActionKick, target.Name(), "")
+	cr.Notice(fmt.Sprintf("%s 被 %s 移出了聊天室", target.Name(), actor.Name()))
+	cr.ack(actor, env)
+}
+
+// 封禁成员之后把它移出聊天室，登录的用户按账号封禁，未登录的用户按IP封禁
+func (cr *Chatroom) ban(actor *user.User, env *protocol.Envelope) {
+	if cr.moderation == nil || cr.Name == "" {
+		actor.Send(protocol.NewError(env.ID, "只有命名聊天室可以封禁成员\n"))
+		return
+	}
+	target, ok := cr.moderationTarget(actor, env, roleModerator)
+	if !ok {
+		return
+	}
+	ban := &moderation.Ban{Room: cr.Name, Target: target.Account, By: actor.Name(), CreatedAt: time.Now()}
+	if ban.Target == "" {
+		ban.Target, ban.ByIP = target.UserIP, true
+	}
+	if err := cr.moderation.Ban(ban); err != nil {
+		cr.userLogger(actor).Error("save ban failed", "target", ban.Target, logging.Err(err))
+		actor.Send(protocol.NewError(env.ID, "封禁失败，请稍后再试\n"))
+		return
+	}
+	cr.removeByModerator(actor, target, "封禁")
+	cr.record(actor, moderation.ActionBan, ban.Target, target.Name())
+	if !ban.ByIP {
+		cr.Notice(fmt.Sprintf("%s 被 %s 封禁", target.Name(), actor.Name()))
+		cr.ack(actor, env)
+		return
+	}
+	// 按IP封禁会连同一个IP（例如同一个 NAT 后面）的其他未登录用户一起挡在外面，明确告诉管理员
+	cr.Notice(fmt.Sprintf("%s 被 %s 按IP封禁", target.Name(), actor.Name()))
+	actor.Send(protocol.NewAck(env.ID, fmt.Sprintf("%s 没有登录，已按IP %s 封禁，该IP下其他未登录的用户也不能进入该聊天室\n", target.Name(), ban.Target)))
+}
+
+// 按账号或IP解除封禁，env.To 是封禁时的账号或IP
+func (cr *Chatroom) unban(actor *user.User, env *protocol.Envelope) {
+	cr.mu.RLock()
+	actorRole := cr.role(actor)
+	cr.mu.RUnlock()
+	if actorRole < roleModerator {
+		actor.Send(protocol.NewError(env.ID, "只有房主和管理员可以管理聊天室\n"))
+		return
+	}
+	if cr.moderation == nil || cr.Name == "" {
+		actor.Send(protocol.NewError(env.ID, "只有命名聊天室可以封禁成员\n"))
+		return
+	}
+	if err := cr.moderation.Unban(cr.Name, env.To); err != nil {
+		msg := "解除封禁失败，请稍后再试\n"
+		if errors.Is(err, moderation.ErrBanNotFound) {
+			msg = fmt.Sprintf("%s没有被封禁\n", env.To)
+		}
+		actor.Send(protocol.NewError(env.ID, msg))
+		return
+	}
+	cr.record(actor, moderation.ActionUnban, env.To, "")
+	actor.Send(protocol.NewAck(env.ID, fmt.Sprintf("已解除对%s的封禁\n", env.To)))
+}
+
+// 管理员把成员移出聊天室，成员回到大厅，action 为提示中的操作名
+func (cr *Chatroom) removeByModerator(actor, target *user.User, action string) {
+	if cr.RemoveUser(target) {
+		target.Send(protocol.NewNotice(cr.RoomId, fmt.Sprintf("你已被%s从ID为%d的聊天室中%s，你已回到大厅\n", actor.Name(), cr.RoomId, action)))
+	}
+}
+
+// 记录一条管理操作到审计日志中
+func (cr *Chatroom) record(actor *user.User, action, target, detail string) {
+	if cr.moderation == nil {
+		cr.userLogger(actor).Info("moderation", "action", action, "target", target, "detail", detail)
+		return
+	}
+	cr.moderation.Record(&moderation.Entry{
+		RoomId: cr.RoomId,
+		Room:   cr.Name,
+		Actor:  actor.Name(),
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+}
@@ -0,0 +1,77 @@
+package chatroom
+
+import (
+	"chatroom/protocol"
+	"chatroom/server/user"
+	"fmt"
+)
+
+// 成员状态变化的事件，status 为 protocol.Presence* 之一
+func (cr *Chatroom) presenceEvent(u *user.User, status, body string) *broadcast {
+	msg := protocol.NewPresence(cr.RoomId, u.Name(), body+"\n")
+	msg.Status = status
+	return &broadcast{msg: msg, ephemeral: true, exclude: u}
+}
+
+// 通过房间的广播通知其他成员 u 的状态变化，状态变化不记录在聊天记录中
+// 广播需要 cr.mu 的读锁，调用者不能持有 cr.mu
+func (cr *Chatroom) announce(u *user.User, status, body string) {
+	cr.publish(cr.presenceEvent(u, status, body))
+}
+
+// 把超过 idleAwayAfter 没有发送消息的成员标记为空闲，只在 listenAndSendBroadMsg 中调用
+func (cr *Chatroom) markIdleMembers() {
+	cr.mu.RLock()
+	members := cr.snapshot()
+	cr.mu.RUnlock()
+	for _, u := range members {
+		if u.MarkIdle(cr.idleAwayAfter) {
+			cr.send(cr.presenceEvent(u, protocol.PresenceIdle, fmt.Sprintf("%s 空闲", u.Name())))
+		}
+	}
+}
+
+// 处理在线状态的命令: 暂时离开、回来了和正在输入
+func (cr *Chatroom) presenceHandler(u *user.User, env *protocol.Envelope) {
+	switch env.Type {
+	case protocol.TypeAway:
+		u.SetAway(env.Body)
+		body := fmt.Sprintf("%s 暂时离开", u.Name())
+		if env.Body != "" {
+			body += ": " + env.Body
+		}
+		cr.announce(u, protocol.PresenceAway, body)
+		u.Send(protocol.NewAck(env.ID, "你已标记为暂时离开，发送 back 命令回来\n"))
+	case protocol.TypeBack:
+		if !u.SetBack() {
+			u.Send(protocol.NewError(env.ID, "你当前没有离开\n"))
+			return
+		}
+		cr.announce(u, protocol.PresenceBack, fmt.Sprintf("%s 回来了", u.Name()))
+		u.Send(protocol.NewAck(env.ID, "欢迎回来\n"))
+	case protocol.TypeTyping:
+		cr.announce(u, protocol.PresenceTyping, fmt.Sprintf("%s 正在输入...", u.Name()))
+		cr.ack(u, env)
+	}
+}
+
+// show 命令的结果: 每行一个成员，暂时离开和空闲的成员带上状态
+func (cr *Chatroom) memberList() string {
+	cr.mu.RLock()
+	members := cr.snapshot()
+	cr.mu.RUnlock()
+	var list string
+	for _, u := range members {
+		list += u.Name()
+		switch status, awayMsg := u.Presence(); {
+		case status == user.Away && awayMsg != "":
+			list += fmt.Sprintf(" [暂时离开: %s]", awayMsg)
+		case status == user.Away:
+			list += " [暂时离开]"
+		case status == user.Idle:
+			list += " [空闲]"
+		}
+		list += "\n"
+	}
+	return list
+}
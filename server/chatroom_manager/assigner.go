@@ -0,0 +1,171 @@
+package chatroom_manager
+
+import (
+	"chatroom/server/chatroom"
+	"chatroom/server/user"
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+var ErrInvalidStrategy = errors.New("chatroom_manager: invalid assign strategy")
+
+// 给新用户挑选房间的策略，AssignRoomToUser 按照 Order 返回的顺序尝试进入房间，都进不去时新建房间
+// 两个方法都在 cm.mu 内调用，不需要自己加锁
+type RoomAssigner interface {
+	// rooms 是所有没有名字的房间，按房间ID从小到大排列，返回需要尝试的房间，可以重复或者省略
+	Order(u *user.User, rooms []chatroom.IChatroom) []chatroom.IChatroom
+	// 用户进入了 cr，包括新建的房间
+	Assigned(u *user.User, cr chatroom.IChatroom)
+}
+
+// 按名字创建分配房间的策略，名字和 config 中的 manager.assign_strategy 一致
+// maxRetries 是 random 策略概率采样的重试次数，maxEntries 是 affinity 策略最多记住的 IP 或账号数
+func NewRoomAssigner(name string, maxRetries, maxEntries int) (RoomAssigner, error) {
+	switch name {
+	case "random":
+		return &randomAssigner{maxRetries: maxRetries}, nil
+	case "least_loaded":
+		return leastLoadedAssigner{}, nil
+	case "fill_first":
+		return fillFirstAssigner{}, nil
+	case "round_robin":
+		return &roundRobinAssigner{}, nil
+	case "affinity":
+		return &affinityAssigner{rooms: make(map[string]int), max: maxEntries}, nil
+	}
+	return nil, ErrInvalidStrategy
+}
+
+// 所有分配房间的策略的名字
+var AssignStrategies = []string{"random", "least_loaded", "fill_first", "round_robin", "affinity"}
+
+// 概率采样: 随机尝试 maxRetries 个房间，都没有进去再按顺序实际确认每一个房间
+type randomAssigner struct {
+	maxRetries int
+}
+
+func (a *randomAssigner) Order(_ *user.User, rooms []chatroom.IChatroom) []chatroom.IChatroom {
+	if len(rooms) == 0 {
+		return nil
+	}
+	order := make([]chatroom.IChatroom, 0, a.maxRetries+len(rooms))
+	for i := 0; i < a.maxRetries; i++ {
+		order = append(order, rooms[rand.Intn(len(rooms))])
+	}
+	return append(order, rooms...)
+}
+
+func (a *randomAssigner) Assigned(*user.User, chatroom.IChatroom) {}
+
+// 房间还没满时的人数，房间已满时返回 false
+func openSeats(cr chatroom.IChatroom) (int, bool) {
+	info := cr.Info()
+	return info.Members, info.Members < info.Capacity
+}
+
+// 房间是否还没满
+func isOpen(cr chatroom.IChatroom) bool {
+	_, ok := openSeats(cr)
+	return ok
+}
+
+// 没满的房间按人数排序，fullestFirst 为 true 时人数多的在前，人数相同时房间ID小的在前
+func byMembers(rooms []chatroom.IChatroom, fullestFirst bool) []chatroom.IChatroom {
+	order := make([]chatroom.IChatroom, 0, len(rooms))
+	members := make(map[chatroom.IChatroom]int, len(rooms))
+	for _, cr := range rooms {
+		if n, ok := openSeats(cr); ok {
+			order = append(order, cr)
+			members[cr] = n
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if fullestFirst {
+			return members[order[i]] > members[order[j]]
+		}
+		return members[order[i]] < members[order[j]]
+	})
+	return order
+}
+
+// 进入人数最少的房间，让每个房间的人数尽量平均
+type leastLoadedAssigner struct{}
+
+func (leastLoadedAssigner) Order(_ *user.User, rooms []chatroom.IChatroom) []chatroom.IChatroom {
+	return byMembers(rooms, false)
+}
+
+func (leastLoadedAssigner) Assigned(*user.User, chatroom.IChatroom) {}
+
+// 进入人数最多的、还没满的房间，房间尽量坐满，房间数最少
+type fillFirstAssigner struct{}
+
+func (fillFirstAssigner) Order(_ *user.User, rooms []chatroom.IChatroom) []chatroom.IChatroom {
+	return byMembers(rooms, true)
+}
+
+func (fillFirstAssigner) Assigned(*user.User, chatroom.IChatroom) {}
+
+// 从上一次分配的房间的下一个房间开始轮流进入
+type roundRobinAssigner struct {
+	lastRoomId int // 上一次分配的房间ID
+}
+
+func (a *roundRobinAssigner) Order(_ *user.User, rooms []chatroom.IChatroom) []chatroom.IChatroom {
+	start := sort.Search(len(rooms), func(i int) bool { return rooms[i].Info().ID > a.lastRoomId })
+	order := make([]chatroom.IChatroom, 0, len(rooms))
+	for i := range rooms {
+		if cr := rooms[(start+i)%len(rooms)]; isOpen(cr) {
+			order = append(order, cr)
+		}
+	}
+	return order
+}
+
+func (a *roundRobinAssigner) Assigned(_ *user.User, cr chatroom.IChatroom) {
+	a.lastRoomId = cr.Info().ID
+}
+
+// 同一个账号或者同一个IP的用户进入同一个房间，房间满了或者第一次来时进入人数最少的房间
+type affinityAssigner struct {
+	rooms map[string]int // 账号或IP -> 最近一次分配的房间ID
+	max   int            // 最多记住的账号和IP数
+}
+
+// 登录的用户按账号，没有登录的用户按IP
+func affinityKey(u *user.User) string {
+	if u.Account != "" {
+		return "account:" + u.Account
+	}
+	return "ip:" + u.UserIP
+}
+
+func (a *affinityAssigner) Order(u *user.User, rooms []chatroom.IChatroom) []chatroom.IChatroom {
+	order := byMembers(rooms, false)
+	roomId, ok := a.rooms[affinityKey(u)]
+	if !ok {
+		return order
+	}
+	for i, cr := range order {
+		if cr.Info().ID == roomId {
+			// 把上一次的房间移到最前面，其他房间的顺序不变
+			copy(order[1:i+1], order[:i])
+			order[0] = cr
+			break
+		}
+	}
+	return order
+}
+
+func (a *affinityAssigner) Assigned(u *user.User, cr chatroom.IChatroom) {
+	key := affinityKey(u)
+	if _, ok := a.rooms[key]; !ok && len(a.rooms) >= a.max {
+		// 记住的IP和账号太多时随便忘掉一个，被忘掉的用户下次按人数最少分配
+		for old := range a.rooms {
+			delete(a.rooms, old)
+			break
+		}
+	}
+	a.rooms[key] = cr.Info().ID
+}
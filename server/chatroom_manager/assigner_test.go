@@ -0,0 +1,176 @@
+package chatroom_manager
+
+import (
+	"chatroom/config"
+	"chatroom/server/user"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// 创建一个通过 net.Pipe 连接的用户，另一端的数据被持续读走
+func newPipeUser(tb testing.TB, name, ip string) *user.User {
+	tb.Helper()
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	u := user.NewUser(name, ip, name, server, user.NewSafeUserMap(), config.Default(), discardLogger)
+	tb.Cleanup(func() {
+		u.Close()
+		client.Close()
+	})
+	return u
+}
+
+func newTestManager(tb testing.TB, strategy string, maxRooms, maxUsers int) *ChatroomManager {
+	tb.Helper()
+	cfg := config.Default()
+	cfg.History.Persist = false
+	cfg.Manager.MaxRooms = maxRooms
+	cfg.Manager.AssignStrategy = strategy
+	cfg.Chatroom.MaxUsers = maxUsers
+	cm := NewChatroomManager(0, cfg, discardLogger)
+	tb.Cleanup(cm.Close)
+	return cm
+}
+
+// 在初始的房间之外再增加 n 个没有名字的房间
+func addRooms(cm *ChatroomManager, n int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for i := 0; i < n; i++ {
+		cm._addChatroom(cm.newChatroom(""))
+	}
+}
+
+// 分配房间，返回房间ID
+func assign(t *testing.T, cm *ChatroomManager, u *user.User) int {
+	t.Helper()
+	ok, cr := cm.AssignRoomToUser(u)
+	if !ok {
+		t.Fatalf("%s not assigned", u.Name())
+	}
+	return cr.Info().ID
+}
+
+func TestAssignStrategies(t *testing.T) {
+	users := make([]*user.User, 6)
+	for i := range users {
+		users[i] = newPipeUser(t, fmt.Sprintf("user-%d", i), fmt.Sprintf("10.0.0.%d", i))
+	}
+	// 房间1、2、3的人数分别是 2、0、1
+	prepare := func(strategy string) *ChatroomManager {
+		cm := newTestManager(t, strategy, 3, 3)
+		addRooms(cm, 2)
+		rooms := cm.IChatrooms
+		rooms[0].AddUserToRoom(users[0])
+		rooms[0].AddUserToRoom(users[1])
+		rooms[2].AddUserToRoom(users[2])
+		return cm
+	}
+
+	if got := assign(t, prepare("least_loaded"), users[3]); got != 2 {
+		t.Errorf("least_loaded assigned room %d, want 2", got)
+	}
+	if got := assign(t, prepare("fill_first"), users[3]); got != 1 {
+		t.Errorf("fill_first assigned room %d, want 1", got)
+	}
+
+	cm := prepare("round_robin")
+	var got []int
+	for _, u := range users[3:] {
+		got = append(got, assign(t, cm, u))
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("round_robin assigned rooms %v, want [1 2 3]", got)
+	}
+}
+
+func TestAffinityKeepsSameIPTogether(t *testing.T) {
+	cm := newTestManager(t, "affinity", 10, 10)
+	addRooms(cm, 2)
+
+	first := assign(t, cm, newPipeUser(t, "a-1", "10.0.0.1"))
+	other := assign(t, cm, newPipeUser(t, "b-1", "10.0.0.2"))
+	if other == first {
+		t.Fatalf("users from different IPs both assigned room %d", first)
+	}
+	if got := assign(t, cm, newPipeUser(t, "a-2", "10.0.0.1")); got != first {
+		t.Fatalf("second user from 10.0.0.1 assigned room %d, want %d", got, first)
+	}
+}
+
+func TestNewRoomAssignerRejectsUnknownStrategy(t *testing.T) {
+	for _, name := range AssignStrategies {
+		if _, err := NewRoomAssigner(name, 1, 1); err != nil {
+			t.Errorf("NewRoomAssigner(%q) = %v", name, err)
+		}
+	}
+	if _, err := NewRoomAssigner("fastest", 1, 1); err != ErrInvalidStrategy {
+		t.Fatalf("NewRoomAssigner(fastest) = %v, want ErrInvalidStrategy", err)
+	}
+}
+
+// 10k 个用户依次进入，每进入100个用户随机有40个已经进入的用户离开，比较分配的耗时和房间的碎片化程度
+// 每200个用户来自同一个IP；partial 是每次离开之后又进入20个用户时，有空位的房间数的平均值，
+// rooms 是最后还有人的房间数，fill 是这些房间的平均入座率
+//
+//	go test -run '^$' -bench AssignRoom ./server/chatroom_manager/
+func BenchmarkAssignRoom(b *testing.B) {
+	const users, maxUsers = 10000, 100
+	pool := make([]*user.User, users)
+	for i := range pool {
+		pool[i] = newPipeUser(b, fmt.Sprintf("user-%d", i), fmt.Sprintf("10.0.0.%d", i%50))
+	}
+	for _, strategy := range AssignStrategies {
+		b.Run(strategy, func(b *testing.B) {
+			var partial, checks, rooms, members int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for _, u := range pool {
+					u.SetRoomId(0)
+				}
+				cm := newTestManager(b, strategy, users, maxUsers)
+				r := rand.New(rand.NewSource(1))
+				b.StartTimer()
+				for j, u := range pool {
+					if ok, _ := cm.AssignRoomToUser(u); !ok {
+						b.Fatalf("%s not assigned", u.Name())
+					}
+					switch j % 100 {
+					case 19:
+						b.StopTimer()
+						for _, info := range cm.ListRooms() {
+							if info.Members > 0 && info.Members < info.Capacity {
+								partial++
+							}
+						}
+						checks++
+						b.StartTimer()
+					case 99:
+						for k := 0; k < 40; k++ {
+							cm.LeaveRoom(pool[r.Intn(j+1)])
+						}
+					}
+				}
+				b.StopTimer()
+				rooms, members = 0, 0
+				for _, info := range cm.ListRooms() {
+					if info.Members > 0 {
+						rooms++
+						members += info.Members
+					}
+				}
+				cm.Close()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*users), "ns/assign")
+			b.ReportMetric(float64(partial)/float64(checks), "partial")
+			b.ReportMetric(float64(rooms), "rooms")
+			b.ReportMetric(float64(members)/float64(rooms*maxUsers), "fill")
+		})
+	}
+}
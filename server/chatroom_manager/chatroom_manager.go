@@ -1,12 +1,16 @@
 package chatroom_manager
 
 import (
-	"chatroom/parameter"
+	"chatroom/config"
+	"chatroom/logging"
+	"chatroom/protocol"
 	"chatroom/server/chatroom"
+	"chatroom/server/history"
+	"chatroom/server/metrics"
+	"chatroom/server/moderation"
 	"chatroom/server/user"
-	"fmt"
 	"log"
-	"math/rand"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,21 +21,44 @@ type IChatroomManager interface {
 	AddChatroom(chatroom.IChatroom)
 	DeleteChatroom(chatroom.IChatroom)
 	AssignRoomToUser(*user.User) (bool, chatroom.IChatroom)
+	ListRooms() []protocol.RoomInfo
+	CreateRoom(name string) (chatroom.IChatroom, error)
+	JoinRoom(u *user.User, roomId int, name string) (chatroom.IChatroom, error)
+	LeaveRoom(*user.User) error
+	UserRoom(*user.User) (chatroom.IChatroom, bool)
+	ResumeRoom(u *user.User, roomId int, lastSeq int64) (chatroom.IChatroom, error)
+	FindRoom(roomId int) (chatroom.IChatroom, bool)
+	CloseRoom(roomId int) error
+	ApplyLimits(cfg *config.Config)
+	Close()
 }
 
 // 通过channel原子的操作聊天室
 type OperateChatroom struct {
-	option    int                // 操作标识符: 0增加，1删除 可以拓展...
+	option    int                // 操作标识符: 0增加，1删除，2房间仍然空闲时删除 可以拓展...
 	IChatroom chatroom.IChatroom // 被操作Chatroom对象
 }
 
 // 管理聊天室的对象
 type ChatroomManager struct {
-	chatroomManagerId      atomic.Int64          // 自增的ID
-	IChatrooms             []chatroom.IChatroom  // 对应所有聊天室
-	chatroomMaxCapacity    int                   // 所有聊天室的总容量
-	OperateChatroomChannel chan *OperateChatroom // 维护聊天室的channel
-	MsgRecordRingMap       sync.Map              // 维护了一个线程安全的 roomId -> msg record
+	chatroomManagerId      atomic.Int64            // 自增的ID
+	mu                     sync.Mutex              // 保护 IChatrooms 和 lastRoomId，分配房间的过程也在锁内
+	IChatrooms             []chatroom.IChatroom    // 对应所有聊天室
+	lastRoomId             int                     // 最近分配的房间ID，房间ID不会重复使用
+	chatroomMaxCapacity    int                     // 所有聊天室的总容量
+	maxRetries             int                     // 随机分配房间时概率采样的重试次数
+	assigner               RoomAssigner            // 给新用户挑选房间的策略
+	assignStrategy         string                  // assigner 对应的 manager.assign_strategy
+	cfg                    *config.Config          // 交给每个聊天室的配置
+	logger                 *slog.Logger            // 交给每个聊天室，聊天室会加上 room_id 字段
+	OperateChatroomChannel chan *OperateChatroom   // 维护聊天室的channel
+	MsgRecordRingMap       sync.Map                // 维护了一个线程安全的 roomId -> msg record
+	commandHandler         chatroom.CommandHandler // 交给每个聊天室，处理聊天室不认识的命令
+	history                *history.History        // 交给每个聊天室，持久化广播消息
+	moderation             *moderation.Service     // 交给每个聊天室，封禁和审计日志
+	done                   chan struct{}           // Close 时关闭，通知后台协程退出
+	closeOnce              sync.Once
+	wg                     sync.WaitGroup // 后台协程，Close 时等待它们退出
 
 	// --------------------------Deprecated field---------------------------------------------
 	// Deprecated: 关联到 sendMutexChannelSign 方法，该方法已废弃
@@ -40,11 +67,22 @@ type ChatroomManager struct {
 	//blockAndStoreChannel chan *user.User // 在 actualConfirmation 方法时，其他协程存储的通道
 }
 
-func NewChatroomManager(ManagerCnt int64) *ChatroomManager {
+// cfg 需要已经通过 Validate
+func NewChatroomManager(ManagerCnt int64, cfg *config.Config, logger *slog.Logger) *ChatroomManager {
+	assigner, err := NewRoomAssigner(cfg.Manager.AssignStrategy, cfg.Manager.MaxRetries, cfg.Manager.MaxAffinityEntries)
+	if err != nil {
+		log.Panicf("manager.assign_strategy %q 不合法", cfg.Manager.AssignStrategy)
+	}
 	chatroomManager := &ChatroomManager{
-		IChatrooms:             make([]chatroom.IChatroom, 0), // 一定要初始容量为0,否则LogPerCheckCurAllocChatroomNumber方法会空指针
-		chatroomMaxCapacity:    parameter.ChatroomMaxCapacity,
+		IChatrooms:             make([]chatroom.IChatroom, 0),
+		chatroomMaxCapacity:    cfg.Manager.MaxRooms,
+		maxRetries:             cfg.Manager.MaxRetries,
+		assigner:               assigner,
+		assignStrategy:         cfg.Manager.AssignStrategy,
+		cfg:                    cfg,
+		logger:                 logger,
 		OperateChatroomChannel: make(chan *OperateChatroom),
+		done:                   make(chan struct{}),
 
 		// --------------------------Deprecated init---------------------------------------------
 		// Deprecated: 关联到 tryGetMutexSign 方法，该方法已废弃
@@ -53,10 +91,9 @@ func NewChatroomManager(ManagerCnt int64) *ChatroomManager {
 		//blockAndStoreChannel: make(chan *user.User, parameter.BlockBufferChannelSize),
 	}
 	// 在初始化的时候分配一个房间
-	chatroomManager._addChatroom(chatroom.NewChatroom(0))
-	go chatroomManager.LogPerCheckCurAllocChatroomNumber()
+	chatroomManager._addChatroom(chatroomManager.newChatroom(""))
 	chatroomManager.chatroomManagerId.Add(ManagerCnt + 1)
-	go chatroomManager.listenAndOperateChatroom()
+	chatroomManager.goBackground(chatroomManager.listenAndOperateChatroom)
 
 	// --------------------------Deprecated init---------------------------------------------
 	//go chatroomManager.listenFinishConfirm()
@@ -65,117 +102,183 @@ func NewChatroomManager(ManagerCnt int64) *ChatroomManager {
 	return chatroomManager
 }
 
+// 创建由该 manager 管理的聊天室，分配新的房间ID，调用者需要持有 cm.mu
+func (cm *ChatroomManager) newChatroom(name string) *chatroom.Chatroom {
+	cm.lastRoomId++
+	cr := chatroom.NewChatroom(cm.lastRoomId, name, cm.cfg, cm.logger)
+	cr.SetCommandHandler(cm.commandHandler)
+	cr.SetHistory(cm.history)
+	cr.SetModeration(cm.moderation)
+	return cr
+}
+
+// 设置聊天室不认识的命令的处理者，已经存在的聊天室也会使用它
+func (cm *ChatroomManager) SetCommandHandler(handler chatroom.CommandHandler) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.commandHandler = handler
+	for _, IChatroom := range cm.IChatrooms {
+		IChatroom.(*chatroom.Chatroom).SetCommandHandler(handler)
+	}
+}
+
+// 设置广播消息的持久化存储，已经存在的聊天室也会使用它
+func (cm *ChatroomManager) SetHistory(history *history.History) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.history = history
+	for _, IChatroom := range cm.IChatrooms {
+		IChatroom.(*chatroom.Chatroom).SetHistory(history)
+	}
+}
+
+// 设置封禁和审计日志的服务，已经存在的聊天室也会使用它
+func (cm *ChatroomManager) SetModeration(m *moderation.Service) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.moderation = m
+	for _, IChatroom := range cm.IChatrooms {
+		IChatroom.(*chatroom.Chatroom).SetModeration(m)
+	}
+}
+
+// 在后台运行 f，Close 时等待它退出
+func (cm *ChatroomManager) goBackground(f func()) {
+	cm.wg.Add(1)
+	go func() {
+		defer cm.wg.Done()
+		f()
+	}()
+}
+
+// 关闭所有聊天室并停止后台协程，每个聊天室发完正在发送的广播后才关闭，可以重复调用
+func (cm *ChatroomManager) Close() {
+	cm.closeOnce.Do(func() {
+		close(cm.done)
+		cm.mu.Lock()
+		for _, IChatroom := range cm.IChatrooms {
+			IChatroom.Close()
+		}
+		cm.mu.Unlock()
+		cm.wg.Wait()
+		cm.logger.Info("chatroom manager closed")
+	})
+}
+
 // 监听和操作标识符
 func (cm *ChatroomManager) listenAndOperateChatroom() {
 	for {
-		if operateChatroom, open := <-cm.OperateChatroomChannel; open {
+		select {
+		case <-cm.done:
+			return
+		case operateChatroom := <-cm.OperateChatroomChannel:
 			op := operateChatroom.option
 			distChatroom, ok := operateChatroom.IChatroom.(*chatroom.Chatroom)
 			if !ok {
 				log.Panicln("*chatroom.Chatroom 没有实现 IChatroom 接口")
 			}
+			cm.mu.Lock()
 			if op == 0 { // 增加
 				cm._addChatroom(distChatroom)
 			} else if op == 1 { // 删除
 				cm._deleteChatroom(distChatroom)
+			} else if op == 2 && distChatroom.IsIdle() { // 分配房间也在 cm.mu 内，检查之后不会再有用户进入
+				cm._deleteChatroom(distChatroom)
 			}
+			cm.mu.Unlock()
 		}
 	}
 }
 
-// 封装删除 Chatroom 操作
+// 封装删除 Chatroom 操作，调用者需要持有 cm.mu
 func (cm *ChatroomManager) _deleteChatroom(distChatroom *chatroom.Chatroom) {
 	for index, chatroom := range cm.IChatrooms {
 		if chatroom == distChatroom {
 			cm.IChatrooms = append(cm.IChatrooms[:index], cm.IChatrooms[index+1:]...)
-			log.Printf("已删除ID为%d的聊天室", distChatroom.RoomId)
+			cm.MsgRecordRingMap.Delete(distChatroom.RoomId)
+			metrics.Rooms.Set(float64(len(cm.IChatrooms)))
+			distChatroom.Close()
+			cm.logger.Info("room deleted", logging.KeyRoomID, distChatroom.RoomId)
 			return
 		}
 	}
-	log.Printf("ID为%d的聊天室不存在", distChatroom.RoomId)
+	cm.logger.Debug("room already deleted", logging.KeyRoomID, distChatroom.RoomId)
 }
 
-// 封装增加 Chatroom 操作
+// 封装增加 Chatroom 操作，调用者需要持有 cm.mu
 func (cm *ChatroomManager) _addChatroom(IDistChatroom chatroom.IChatroom) {
 	if distChatroom, ok := IDistChatroom.(*chatroom.Chatroom); !ok {
 		log.Panicln("*chatroom.Chatroom 没有实现 IChatroom 接口")
 	} else {
 		if len(cm.IChatrooms) > cm.chatroomMaxCapacity {
-			log.Printf("聊天室已满，无法装下ID为%d的聊天室", distChatroom.RoomId)
+			cm.logger.Warn("too many rooms, room not added", logging.KeyRoomID, distChatroom.RoomId)
 			return
 		}
 		cm.IChatrooms = append(cm.IChatrooms, distChatroom)
-		log.Printf("增加时: Id为%d的房间UserMap的地址为%p\n", distChatroom.RoomId, distChatroom.UserMap)
-		go cm.perCheckDeleteChatroom(distChatroom)
-		log.Printf("已增加ID为%d的聊天室\n", distChatroom.RoomId)
+		cm.MsgRecordRingMap.Store(distChatroom.RoomId, distChatroom.MsgRecording)
+		metrics.Rooms.Set(float64(len(cm.IChatrooms)))
+		cm.goBackground(func() { cm.perCheckDeleteChatroom(distChatroom) })
+		cm.logger.Info("room added", logging.KeyRoomID, distChatroom.RoomId)
 	}
 }
 
-// 对外暴露的 AddChatroom
+// 对外暴露的 AddChatroom，manager 已经关闭时不做任何操作
 func (cm *ChatroomManager) AddChatroom(distChatroom chatroom.IChatroom) {
-	cm.OperateChatroomChannel <- &OperateChatroom{0, distChatroom}
+	cm.operate(&OperateChatroom{0, distChatroom})
 }
 
-// 对外暴露的 DeleteChatroom
+// 对外暴露的 DeleteChatroom，manager 已经关闭时不做任何操作
 func (cm *ChatroomManager) DeleteChatroom(distChatroom chatroom.IChatroom) {
-	cm.OperateChatroomChannel <- &OperateChatroom{1, distChatroom}
+	cm.operate(&OperateChatroom{1, distChatroom})
 }
 
-// 递归的分配房间给用户，随机进入一个已经存在的房间
-// TODO 支持断线重连
-func (cm *ChatroomManager) AssignRoomToUser(user *user.User) (bool, chatroom.IChatroom) {
-	success, foundChatroom := cm.probabilitySamplingTryEnterRoom(user)
-	if success {
-		return true, foundChatroom
-	}
-	//cm.tryGetMutexSign(user)
+// 在 cm.mu 内再检查一次房间是否空闲，空闲时才删除
+// 检查空闲和删除之间可能有等待的用户刚好被分配进这个房间
+func (cm *ChatroomManager) deleteIdleChatroom(distChatroom chatroom.IChatroom) {
+	cm.operate(&OperateChatroom{2, distChatroom})
+}
 
-	// 如果随机分配房间没有成功，manager 单个协程处理，没有并发问题
-	return cm.actualConfirmation(user)
+func (cm *ChatroomManager) operate(operateChatroom *OperateChatroom) {
+	select {
+	case cm.OperateChatroomChannel <- operateChatroom:
+	case <-cm.done:
+	}
 }
 
-// 实际确定房间是否已满的逻辑:
-// 遍历所有房间，实际确认:
-//  1. 房间确实满了：增加新聊天室，并将用户放进去
-//  2. 房间没有满：将该用户送进空置聊天室
-func (cm *ChatroomManager) actualConfirmation(user *user.User) (bool, chatroom.IChatroom) {
-	for i := 0; i < len(cm.IChatrooms); i++ {
-		curIChatroom := cm.IChatrooms[i]
-		// 成功找到空置聊天室
-		if curIChatroom.AddUserToRoom(user) {
-			return true, curIChatroom
+// 按照 assigner 的策略分配房间给用户，只会进入已经存在的、没有名字的房间，都进不去时新建房间
+// 尝试的房间满了时不提示用户，分配失败时由调用者告诉用户结果
+// 命名的房间只能通过 JoinRoom 主动加入，断线重连通过 ResumeRoom 回到原来的房间
+func (cm *ChatroomManager) AssignRoomToUser(user *user.User) (bool, chatroom.IChatroom) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	rooms := make([]chatroom.IChatroom, 0, len(cm.IChatrooms))
+	for _, IChatroom := range cm.IChatrooms {
+		if IChatroom.Info().Name == "" {
+			rooms = append(rooms, IChatroom)
+		}
+	}
+	for _, IChatroom := range cm.assigner.Order(user, rooms) {
+		if IChatroom.TryAddUser(user) {
+			cm.assigner.Assigned(user, IChatroom)
+			return true, IChatroom
 		}
 	}
 	// 没有空置聊天室，尝试新创建一个聊天室，并将用户放进去
 	if len(cm.IChatrooms)+1 > cm.chatroomMaxCapacity {
-		log.Printf("聊天室已经超过最大分配额度了，%d", cm.chatroomMaxCapacity)
+		cm.logger.Warn("too many rooms, user not assigned", logging.KeyUser, user.Name(), "max_rooms", cm.chatroomMaxCapacity)
 		return false, nil
 	}
-	cr := chatroom.NewChatroom(len(cm.IChatrooms))
+	cr := cm.newChatroom("")
 	cm._addChatroom(cr)
-	cr.AddUserToRoom(user)
-	return true, cr
-}
-
-// 概率采样，尝试进房间
-// 概率采样失败，需要实际确认 是否分配新房间
-func (cm *ChatroomManager) probabilitySamplingTryEnterRoom(user *user.User) (bool, chatroom.IChatroom) {
-	var chatroomIndex int
-	for i := 0; i < parameter.MaxNumberOfRetries; i++ {
-		chatroomIndex = rand.Intn(len(cm.IChatrooms))
-		// 尝试进房间
-		successEnter := cm.IChatrooms[chatroomIndex].AddUserToRoom(user)
-		// 成功找到房间
-		if successEnter {
-			return true, cm.IChatrooms[chatroomIndex]
-		}
+	if !cr.TryAddUser(user) {
+		return false, nil
 	}
-	// 没有找到房间，概率采样失败
-	return false, nil
+	cm.assigner.Assigned(user, cr)
+	return true, cr
 }
 
 // 每一个房间在New出来时，就调用。
-// 每秒检查 distChatroom.UserMap，如果为len == 0, 则删除该 distChatroom
+// 每次有用户离开时检查 distChatroom，如果没有成员也没有等待重连的用户, 则删除该 distChatroom
 func (cm *ChatroomManager) perCheckDeleteChatroom(IDistChatroom chatroom.IChatroom) {
 	distChatroom, ok := IDistChatroom.(*chatroom.Chatroom)
 	if !ok {
@@ -184,32 +287,25 @@ func (cm *ChatroomManager) perCheckDeleteChatroom(IDistChatroom chatroom.IChatro
 	for {
 		//log.Printf("房间ID为%d 的UserMap 长度为: %d\n", distChatroom.RoomId.Load(), distChatroom.UserMap.Len())
 		//log.Println("distChatroom.SignChannel:", distChatroom.SignChannel)
-		if _, open := <-distChatroom.SignChannel; open {
-			if len(distChatroom.UserMap) == 0 {
-				cm.DeleteChatroom(distChatroom)
-				return
+		select {
+		case <-cm.done:
+			return
+		case <-distChatroom.Closed():
+			return
+		case <-distChatroom.SignChannel:
+			// 房间被删除之后会被关闭，下一次循环时退出
+			if distChatroom.IsIdle() {
+				cm.deleteIdleChatroom(distChatroom)
+				continue
 			}
 		}
-		time.Sleep(time.Second)
-	}
-
-}
-
-// 每秒检查聊天室数量的Logger
-func (cm *ChatroomManager) LogPerCheckCurAllocChatroomNumber() {
-	for {
-		n := len(cm.IChatrooms)
-		fmt.Println("The current chat room number is:", n)
-		for i := 0; i < n; i++ {
-			cr := cm.IChatrooms[i].(*chatroom.Chatroom)
-			//log.Printf("第%d个聊天室的用户数量有%d位，用户分别是------>:\n", i+1, len(cr.UserMap))
-			//for _, u := range cr.UserMap {
-			//	log.Printf("%v ", u.UserName)
-			//}
-			log.Printf("第%d个聊天室的用户数量有%d位\n", i+1, len(cr.UserMap))
+		select {
+		case <-cm.done:
+			return
+		case <-time.After(time.Second):
 		}
-		time.Sleep(time.Second)
 	}
+
 }
 
 //  -----------------------------Deprecated method -------------------------------------------
@@ -0,0 +1,195 @@
+package chatroom_manager
+
+import (
+	"chatroom/config"
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const MaxRoomNameLength = 32 // 聊天室名字的最大长度
+
+var (
+	ErrRoomNotFound    = errors.New("chatroom_manager: room not found")
+	ErrRoomExists      = errors.New("chatroom_manager: room name already exists")
+	ErrRoomFull        = errors.New("chatroom_manager: room is full")
+	ErrTooManyRooms    = errors.New("chatroom_manager: too many rooms")
+	ErrInvalidRoomName = errors.New("chatroom_manager: invalid room name")
+	ErrAlreadyInRoom   = errors.New("chatroom_manager: user already in room")
+	ErrNotInRoom       = errors.New("chatroom_manager: user not in any room")
+	ErrBanned          = errors.New("chatroom_manager: user is banned from room")
+)
+
+// 所有聊天室的概况，按房间ID从小到大排列
+func (cm *ChatroomManager) ListRooms() []protocol.RoomInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	rooms := make([]protocol.RoomInfo, 0, len(cm.IChatrooms))
+	for _, IChatroom := range cm.IChatrooms {
+		rooms = append(rooms, IChatroom.Info())
+	}
+	return rooms
+}
+
+// 创建命名聊天室，名字不能重复，不能是纯数字
+func (cm *ChatroomManager) CreateRoom(name string) (chatroom.IChatroom, error) {
+	if err := validateRoomName(name); err != nil {
+		return nil, err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.findRoom(0, name) != nil {
+		return nil, ErrRoomExists
+	}
+	if len(cm.IChatrooms)+1 > cm.chatroomMaxCapacity {
+		return nil, ErrTooManyRooms
+	}
+	cr := cm.newChatroom(name)
+	cm._addChatroom(cr)
+	cm.logger.Info("room created", logging.KeyRoomID, cr.RoomId, "name", name)
+	return cr, nil
+}
+
+// 按 roomId 加入聊天室，roomId 为0时按 name 加入
+// 加入成功后才会离开原来的房间，房间已满时留在原来的房间
+func (cm *ChatroomManager) JoinRoom(u *user.User, roomId int, name string) (chatroom.IChatroom, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	target := cm.findRoom(roomId, name)
+	if target == nil {
+		return nil, ErrRoomNotFound
+	}
+	if target.Info().ID == u.RoomId() {
+		return nil, ErrAlreadyInRoom
+	}
+	if target.Banned(u) {
+		return nil, ErrBanned
+	}
+	current := cm.findRoom(u.RoomId(), "")
+	if !target.AddUserToRoom(u) {
+		return nil, ErrRoomFull
+	}
+	if current != nil {
+		current.RemoveUser(u)
+	}
+	return target, nil
+}
+
+// 断线重连的用户回到 roomId 对应的房间，补发序号大于 lastSeq 的消息
+// 成功后离开重连时临时分配的房间
+func (cm *ChatroomManager) ResumeRoom(u *user.User, roomId int, lastSeq int64) (chatroom.IChatroom, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	target := cm.findRoom(roomId, "")
+	if target == nil {
+		return nil, ErrRoomNotFound
+	}
+	current := cm.findRoom(u.RoomId(), "")
+	if !target.ResumeUser(u, lastSeq) {
+		return nil, ErrRoomFull
+	}
+	if current != nil && current != target {
+		current.RemoveUser(u)
+	}
+	return target, nil
+}
+
+// 按ID查找聊天室
+func (cm *ChatroomManager) FindRoom(roomId int) (chatroom.IChatroom, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	IChatroom := cm.findRoom(roomId, "")
+	return IChatroom, IChatroom != nil
+}
+
+// 关闭 roomId 对应的聊天室，房间里的用户收到通知后回到大厅
+// 等待断线重连回到该房间的用户恢复会话之后留在重连时分配的房间
+func (cm *ChatroomManager) CloseRoom(roomId int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	target := cm.findRoom(roomId, "")
+	if target == nil {
+		return ErrRoomNotFound
+	}
+	for _, name := range target.MemberNames() {
+		if u, ok := target.Member(name); ok && target.RemoveUser(u) {
+			u.Send(protocol.NewNotice(roomId, fmt.Sprintf("ID为%d的聊天室已被关闭，你已回到大厅\n", roomId)))
+		}
+	}
+	cm._deleteChatroom(target.(*chatroom.Chatroom))
+	return nil
+}
+
+// 离开当前的聊天室，回到大厅
+func (cm *ChatroomManager) LeaveRoom(u *user.User) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	current := cm.findRoom(u.RoomId(), "")
+	if current == nil || !current.RemoveUser(u) {
+		return ErrNotInRoom
+	}
+	return nil
+}
+
+// 用户当前所在的聊天室，在大厅中时返回 false
+func (cm *ChatroomManager) UserRoom(u *user.User) (chatroom.IChatroom, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	current := cm.findRoom(u.RoomId(), "")
+	return current, current != nil
+}
+
+// 热更新容量限制和分配房间的策略: 最大房间数、每个房间的容量和消息环的大小，之后新建的房间也使用 cfg
+// 已经超过新限制的房间和用户都会保留，只是不再创建新的房间或者接受新的用户
+func (cm *ChatroomManager) ApplyLimits(cfg *config.Config) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	// 换了策略之后重新开始，之前策略记住的状态（例如 affinity 的房间）不再使用
+	if cfg.Manager.AssignStrategy != cm.assignStrategy || cfg.Manager.MaxRetries != cm.maxRetries ||
+		cfg.Manager.MaxAffinityEntries != cm.cfg.Manager.MaxAffinityEntries {
+		if assigner, err := NewRoomAssigner(cfg.Manager.AssignStrategy, cfg.Manager.MaxRetries, cfg.Manager.MaxAffinityEntries); err == nil {
+			cm.assigner, cm.assignStrategy = assigner, cfg.Manager.AssignStrategy
+		}
+	}
+	cm.cfg = cfg
+	cm.chatroomMaxCapacity = cfg.Manager.MaxRooms
+	cm.maxRetries = cfg.Manager.MaxRetries
+	for _, IChatroom := range cm.IChatrooms {
+		IChatroom.SetLimits(cfg.Chatroom.MaxUsers, cfg.Chatroom.RingCapacity)
+	}
+	cm.logger.Info("limits updated", "max_rooms", cfg.Manager.MaxRooms, "assign_strategy", cm.assignStrategy,
+		"max_users", cfg.Chatroom.MaxUsers, "ring_capacity", cfg.Chatroom.RingCapacity)
+}
+
+// 按 roomId 查找聊天室，roomId 为0时按 name 查找，调用者需要持有 cm.mu
+func (cm *ChatroomManager) findRoom(roomId int, name string) chatroom.IChatroom {
+	if roomId == 0 && name == "" {
+		return nil
+	}
+	for _, IChatroom := range cm.IChatrooms {
+		info := IChatroom.Info()
+		if (roomId != 0 && info.ID == roomId) || (roomId == 0 && info.Name == name) {
+			return IChatroom
+		}
+	}
+	return nil
+}
+
+// 名字不能为空、不能过长、不能是纯数字，不能包含空白字符和协议中使用的分隔符
+func validateRoomName(name string) error {
+	if name == "" || len(name) > MaxRoomNameLength {
+		return ErrInvalidRoomName
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return ErrInvalidRoomName
+	}
+	if strings.ContainsAny(name, "|:# \t\r\n") {
+		return ErrInvalidRoomName
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package history
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 保存在存储中的一条聊天记录
+type Record struct {
+	Room      int    `bson:"room"`      // 房间ID
+	Seq       int64  `bson:"seq"`       // 房间内的消息序号
+	MsgID     string `bson:"msg_id"`    // 服务器分配的消息ID
+	Timestamp int64  `bson:"timestamp"` // 毫秒时间戳
+	From      string `bson:"from"`      // 发送者
+	Body      string `bson:"body"`      // 消息体
+}
+
+// 聊天记录的存储接口，实现 聊天记录存储 必须实现该接口
+type Store interface {
+	// 批量保存聊天记录
+	Save(ctx context.Context, records []*Record) error
+	// 返回 room 中排在 (timestamp, seq) 之前的最近 n 条记录，按从早到晚的顺序排列
+	Before(ctx context.Context, room int, timestamp, seq int64, n int) ([]*Record, error)
+}
+
+// 聊天记录: 广播消息异步地批量写入 Store，并从 Store 中往前分页读取
+type History struct {
+	store   Store
+	pending chan *Record  // 等待写入 Store 的记录
+	batch   int           // 每次批量写入 Store 的最大条数
+	timeout time.Duration // 每次访问存储的超时时间
+	closing chan struct{} // Close 时关闭，通知 listenAndFlush 写完剩下的记录后退出
+	done    chan struct{} // listenAndFlush 退出时关闭
+	once    sync.Once
+}
+
+// bufferSize 为等待写入的记录的缓冲区大小，batchSize 为每次批量写入的最大条数
+func New(store Store, bufferSize, batchSize int, timeout time.Duration) *History {
+	h := &History{
+		store:   store,
+		pending: make(chan *Record, bufferSize),
+		batch:   batchSize,
+		timeout: timeout,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go h.listenAndFlush()
+	return h
+}
+
+// 记录一条广播消息，不会阻塞广播，缓冲区满或者已经 Close 时丢弃该记录
+func (h *History) Record(msg *protocol.Envelope) {
+	select {
+	case <-h.closing:
+		slog.Warn("history closed, record dropped", logging.KeyRoomID, msg.Room, "seq", msg.Seq)
+		return
+	default:
+	}
+	record := &Record{
+		Room:      msg.Room,
+		Seq:       msg.Seq,
+		MsgID:     msg.MsgID,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Body:      msg.Body,
+	}
+	select {
+	case h.pending <- record:
+	default:
+		slog.Warn("history buffer full, record dropped", logging.KeyRoomID, msg.Room, "seq", msg.Seq)
+	}
+}
+
+// 返回 room 中排在 cursor 之前的最近 n 条消息，cursor 为 nil 时从现在开始往前
+func (h *History) Before(room int, cursor *protocol.Envelope, n int) ([]*protocol.Envelope, error) {
+	timestamp, seq := time.Now().UnixMilli()+1, int64(0)
+	if cursor != nil {
+		timestamp, seq = cursor.Timestamp, cursor.Seq
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	records, err := h.store.Before(ctx, room, timestamp, seq, n)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*protocol.Envelope, len(records))
+	for i, record := range records {
+		msgs[i] = &protocol.Envelope{
+			Type:      protocol.TypeMessage,
+			Room:      record.Room,
+			Seq:       record.Seq,
+			MsgID:     record.MsgID,
+			Timestamp: record.Timestamp,
+			From:      record.From,
+			Body:      record.Body,
+		}
+	}
+	return msgs, nil
+}
+
+// 写完缓冲区中剩下的记录后停止，ctx 结束时不再等待
+func (h *History) Close(ctx context.Context) error {
+	h.once.Do(func() { close(h.closing) })
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 监听 pending，每次把已经积累的记录批量写入 Store，Close 之后写完剩下的记录再退出
+func (h *History) listenAndFlush() {
+	defer close(h.done)
+	for {
+		select {
+		case record := <-h.pending:
+			h.flush(h.collect(record))
+		case <-h.closing:
+			for {
+				select {
+				case record := <-h.pending:
+					h.flush(h.collect(record))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// 以 record 开头，把 pending 中已经积累的记录凑成一批
+func (h *History) collect(record *Record) []*Record {
+	batch := []*Record{record}
+	for len(batch) < h.batch {
+		select {
+		case record := <-h.pending:
+			batch = append(batch, record)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (h *History) flush(batch []*Record) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	if err := h.store.Save(ctx, batch); err != nil {
+		slog.Error("save history failed", "records", len(batch), logging.Err(err))
+	}
+}
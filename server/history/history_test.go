@@ -0,0 +1,73 @@
+package history
+
+import (
+	"chatroom/protocol"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 等待 store 中保存了 n 条 room 的记录
+func waitForRecords(t *testing.T, store Store, room, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		records, _ := store.Before(context.Background(), room, time.Now().UnixMilli()+1, 0, n+1)
+		if len(records) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("store did not receive %d records", n)
+}
+
+func TestHistoryPagesBackwards(t *testing.T) {
+	store := NewMemoryStore()
+	h := New(store, 1024, 100, time.Second)
+	for i := 1; i <= 5; i++ {
+		// 同一毫秒内的消息靠序号排序
+		h.Record(&protocol.Envelope{Room: 1, Seq: int64(i), Timestamp: 1000, From: "alice", Body: strconv.Itoa(i)})
+	}
+	h.Record(&protocol.Envelope{Room: 2, Seq: 1, Timestamp: 1000, Body: "other room"})
+	waitForRecords(t, store, 1, 5)
+
+	page, err := h.Before(1, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Body != "4" || page[1].Body != "5" || page[0].Type != protocol.TypeMessage {
+		t.Fatalf("first page = %+v", page)
+	}
+	page, err = h.Before(1, page[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 3 || page[0].Body != "1" || page[2].Body != "3" {
+		t.Fatalf("second page = %+v", page)
+	}
+	page, err = h.Before(1, page[0], 10)
+	if err != nil || len(page) != 0 {
+		t.Fatalf("last page = %+v, %v", page, err)
+	}
+}
+
+func TestCloseFlushesPendingRecords(t *testing.T) {
+	store := NewMemoryStore()
+	h := New(store, 1024, 100, time.Second)
+	for i := 1; i <= 3; i++ {
+		h.Record(&protocol.Envelope{Room: 1, Seq: int64(i), Timestamp: 1000, Body: strconv.Itoa(i)})
+	}
+	if err := h.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := store.Before(context.Background(), 1, 2000, 0, 10)
+	if len(records) != 3 {
+		t.Fatalf("records after Close = %d, want 3", len(records))
+	}
+	// Close 之后的记录被丢弃，不会阻塞也不会 panic
+	h.Record(&protocol.Envelope{Room: 1, Seq: 4, Timestamp: 1000})
+	if err := h.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package history
+
+import (
+	"context"
+	"sync"
+)
+
+// 保存在内存中的聊天记录存储，用于测试和不需要持久化的场景
+type MemoryStore struct {
+	mu      sync.Mutex
+	records []*Record // 按写入顺序排列
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, records []*Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		saved := *record
+		s.records = append(s.records, &saved)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Before(ctx context.Context, room int, timestamp, seq int64, n int) ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*Record
+	for i := len(s.records) - 1; i >= 0 && len(res) < n; i-- {
+		record := s.records[i]
+		if record.Room == room && isBefore(record, timestamp, seq) {
+			found := *record
+			res = append(res, &found)
+		}
+	}
+	reverse(res)
+	return res, nil
+}
+
+// record 是否排在 (timestamp, seq) 之前
+func isBefore(record *Record, timestamp, seq int64) bool {
+	return record.Timestamp < timestamp || (record.Timestamp == timestamp && record.Seq < seq)
+}
+
+func reverse(records []*Record) {
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+}
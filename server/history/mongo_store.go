@@ -0,0 +1,74 @@
+package history
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const MessagesCollection = "messages" // 保存聊天记录的集合名称
+
+// 保存在 Mongo messages 集合中的聊天记录存储
+type MongoStore struct {
+	collection *mongo.Collection
+	indexMu    sync.Mutex
+	indexed    bool // 第一次写入时才创建索引，避免启动时就必须连上数据库；创建失败时下次写入重试
+}
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	return &MongoStore{
+		collection: database.Collection(MessagesCollection),
+	}
+}
+
+// 在 (room, timestamp, seq) 上创建索引，用于往前分页
+func (s *MongoStore) ensureIndex(ctx context.Context) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexed {
+		return nil
+	}
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "room", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "seq", Value: -1}},
+	})
+	s.indexed = err == nil
+	return err
+}
+
+func (s *MongoStore) Save(ctx context.Context, records []*Record) error {
+	if err := s.ensureIndex(ctx); err != nil {
+		return err
+	}
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		docs[i] = record
+	}
+	_, err := s.collection.InsertMany(ctx, docs)
+	return err
+}
+
+func (s *MongoStore) Before(ctx context.Context, room int, timestamp, seq int64, n int) ([]*Record, error) {
+	filter := bson.D{
+		{Key: "room", Value: room},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: timestamp}}}},
+			bson.D{{Key: "timestamp", Value: timestamp}, {Key: "seq", Value: bson.D{{Key: "$lt", Value: seq}}}},
+		}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "seq", Value: -1}}).
+		SetLimit(int64(n))
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	reverse(records)
+	return records, nil
+}
@@ -1,20 +1,134 @@
 package main
 
 import (
+	"chatroom/config"
+	"chatroom/logging"
 	"chatroom/server/server"
+	"context"
 	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-var serverIp string   // 聊天室的IP地址
-var serverPort string // 聊天室的端口号
+var configFile string    // YAML 配置文件，为空时只使用默认值和 CHATROOM_* 环境变量
+var serverIp string      // 聊天室的IP地址
+var serverPort string    // 聊天室的端口号
+var webSocketPort string // WebSocket 网关的端口号，为空时不开启
+var webSocketPath string // WebSocket 网关的路径
+var certFile string      // TLS 证书文件，为空时使用明文
+var keyFile string       // TLS 私钥文件
+var clientCAFile string  // 校验客户端证书的 CA 文件，设置后证书的 CommonName 作为用户名
 
 func init() {
+	flag.StringVar(&configFile, "config", "", "YAML 配置文件，为空时只使用默认值和 CHATROOM_* 环境变量")
 	flag.StringVar(&serverIp, "i", "127.0.0.1", "聊天室的IP地址")
 	flag.StringVar(&serverPort, "p", "4096", "聊天室的端口号")
+	flag.StringVar(&webSocketPort, "wp", "", "WebSocket 网关的端口号，为空时不开启")
+	flag.StringVar(&webSocketPath, "wpath", "/ws", "WebSocket 网关的路径")
+	flag.StringVar(&certFile, "cert", "", "TLS 证书文件，为空时使用明文")
+	flag.StringVar(&keyFile, "key", "", "TLS 私钥文件")
+	flag.StringVar(&clientCAFile, "clientca", "", "校验客户端证书的 CA 文件，设置后证书的 CommonName 作为用户名")
+}
+
+// 读取配置文件和环境变量，命令行中显式给出的参数优先级最高
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(configFile, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "i":
+			cfg.Server.IP = serverIp
+		case "p":
+			cfg.Server.Port = serverPort
+		case "wp":
+			cfg.Server.WebSocketPort = webSocketPort
+		case "wpath":
+			cfg.Server.WebSocketPath = webSocketPath
+		case "cert":
+			cfg.Server.CertFile = certFile
+		case "key":
+			cfg.Server.KeyFile = keyFile
+		case "clientca":
+			cfg.Server.ClientCAFile = clientCAFile
+		}
+	})
+	return cfg, cfg.Validate()
 }
 
 func main() {
 	flag.Parse()
-	chatServer := server.NewChatServer(serverIp, serverPort)
-	chatServer.Start()
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("load config failed", logging.Err(err))
+	}
+	logging.Setup(os.Stderr, cfg.Log)
+	chatServer := server.NewChatServer(cfg)
+	if chatServer == nil {
+		fatal("create chat server failed")
+	}
+	if err := chatServer.Moderation.Load(); err != nil {
+		slog.Error("load bans failed, starting without them", logging.Err(err))
+	}
+	if cfg.Server.CertFile != "" {
+		tlsConfig, err := server.LoadTLSConfig(cfg.Server.CertFile, cfg.Server.KeyFile, cfg.Server.ClientCAFile)
+		if err != nil {
+			fatal("load TLS certificate failed", logging.Err(err))
+		}
+		chatServer.TLSConfig = tlsConfig
+	}
+	if cfg.Server.WebSocketPort != "" {
+		go chatServer.StartWebSocket(cfg.Server.WebSocketPort, cfg.Server.WebSocketPath)
+	}
+	if cfg.Admin.Addr != "" {
+		go chatServer.StartAdmin(cfg.Admin.Addr, cfg.Admin.Token)
+	}
+	if cfg.Metrics.Addr != "" {
+		go chatServer.StartMetrics(cfg.Metrics.Addr)
+	}
+	go reloadOnHangup(chatServer)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveDone := make(chan struct{})
+	go func() {
+		chatServer.Start()
+		close(serveDone)
+	}()
+	select {
+	case <-ctx.Done():
+		slog.Info("signal received, shutting down")
+	case <-serveDone:
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := chatServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown did not finish in time", logging.Err(err))
+	}
+}
+
+// 收到 SIGHUP 时重新读取配置文件和环境变量，热更新容量限制
+func reloadOnHangup(chatServer *server.ChatServer) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		cfg, err := loadConfig()
+		if err != nil {
+			slog.Error("reload config failed, keeping the old config", logging.Err(err))
+			continue
+		}
+		if err := chatServer.Reload(cfg); err != nil {
+			slog.Error("reload config failed, keeping the old config", logging.Err(err))
+		}
+	}
+}
+
+// 记录错误后退出
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chatroom"
+
+// 聊天服务器的所有指标都注册在这里，不使用 prometheus 的全局 Registry
+var Registry = prometheus.NewRegistry()
+
+var (
+	// 当前连接的用户数，包括大厅中的用户
+	ConnectedUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_users",
+		Help:      "Number of connected users, including users in the lobby.",
+	})
+	// 当前的聊天室数量
+	Rooms = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rooms",
+		Help:      "Number of chat rooms.",
+	})
+	// 每个聊天室的成员数
+	RoomMembers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "room_members",
+		Help:      "Number of members in each chat room.",
+	}, []string{"room"})
+	// 按请求类型统计收到的消息数
+	Messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_total",
+		Help:      "Messages received from clients, by request type.",
+	}, []string{"type"})
+	// 送达的私聊消息数
+	PrivateMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "private_messages_total",
+		Help:      "Private messages handed to the recipient.",
+	})
+	// 没能放进成员发送队列的广播消息数
+	BroadcastWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "broadcast_write_failures_total",
+		Help:      "Broadcast deliveries that could not be queued for a member.",
+	})
+	// 没有写给用户就丢弃的消息数，reason 为 drop_oldest、high_water、queue_full 或 spill_failed
+	MessagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dropped_total",
+		Help:      "Events dropped from a user's send path before being written, by reason.",
+	}, []string{"reason"})
+	// 超过限流的请求和连接数，action 为 warn、mute、muted、disconnect 或 reject_conn
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests and connections rejected by rate limiting, by action taken.",
+	}, []string{"action"})
+	// 一条广播消息交给所有成员所用的时间
+	BroadcastFanoutSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broadcast_fanout_seconds",
+		Help:      "Time to hand one broadcast to every member of the room.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+	// 所有房间都满时等待进入房间的用户数
+	WaitingUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "waiting_users",
+		Help:      "Number of users queued for a room slot because every room is full.",
+	})
+	// 用户在 EnterRoomChannel 中等待被消费的时间
+	EnterRoomWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "enter_room_wait_seconds",
+		Help:      "Time a new connection waits on EnterRoomChannel before being assigned.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ConnectedUsers,
+		Rooms,
+		RoomMembers,
+		Messages,
+		PrivateMessages,
+		BroadcastWriteFailures,
+		MessagesDropped,
+		RateLimited,
+		BroadcastFanoutSeconds,
+		WaitingUsers,
+		EnterRoomWaitSeconds,
+	)
+}
+
+// 以 Prometheus 文本格式输出 Registry 中的指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// 设置 roomId 对应聊天室的成员数
+func SetRoomMembers(roomId, members int) {
+	RoomMembers.WithLabelValues(strconv.Itoa(roomId)).Set(float64(members))
+}
+
+// 聊天室被删除之后不再输出它的成员数
+func DeleteRoom(roomId int) {
+	RoomMembers.DeleteLabelValues(strconv.Itoa(roomId))
+}
+
+// 记录从 start 到现在经过的秒数
+func ObserveSince(h prometheus.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerServesTextFormat(t *testing.T) {
+	SetRoomMembers(7, 3)
+	Messages.WithLabelValues("broadcast").Inc()
+	MessagesDropped.WithLabelValues("drop_oldest").Inc()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`chatroom_room_members{room="7"} 3`,
+		`chatroom_messages_total{type="broadcast"}`,
+		`chatroom_messages_dropped_total{reason="drop_oldest"}`,
+		"# TYPE chatroom_broadcast_fanout_seconds histogram",
+		"# TYPE chatroom_connected_users gauge",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+
+	DeleteRoom(7)
+	rec = httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), `room="7"`) {
+		t.Error("deleted room is still exported")
+	}
+}
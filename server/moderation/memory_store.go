@@ -0,0 +1,68 @@
+package moderation
+
+import (
+	"context"
+	"sync"
+)
+
+// 保存在内存中的封禁和审计日志，用于测试和不需要持久化的场景
+type MemoryStore struct {
+	mu      sync.Mutex
+	bans    map[banKey]*Ban
+	entries []*Entry // 按写入顺序排列
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		bans: make(map[banKey]*Ban),
+	}
+}
+
+func (s *MemoryStore) SaveBan(ctx context.Context, ban *Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *ban
+	s.bans[banKey{ban.Room, ban.Target}] = &saved
+	return nil
+}
+
+func (s *MemoryStore) DeleteBan(ctx context.Context, room, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, isPresent := s.bans[banKey{room, target}]; !isPresent {
+		return ErrBanNotFound
+	}
+	delete(s.bans, banKey{room, target})
+	return nil
+}
+
+func (s *MemoryStore) Bans(ctx context.Context) ([]*Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bans := make([]*Ban, 0, len(s.bans))
+	for _, ban := range s.bans {
+		saved := *ban
+		bans = append(bans, &saved)
+	}
+	return bans, nil
+}
+
+func (s *MemoryStore) Append(ctx context.Context, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *entry
+	s.entries = append(s.entries, &saved)
+	return nil
+}
+
+// 按写入顺序返回所有的审计日志
+func (s *MemoryStore) Entries() []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*Entry, len(s.entries))
+	for i, entry := range s.entries {
+		saved := *entry
+		entries[i] = &saved
+	}
+	return entries
+}
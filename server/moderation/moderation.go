@@ -0,0 +1,148 @@
+package moderation
+
+import (
+	"chatroom/logging"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var ErrBanNotFound = errors.New("moderation: ban not found")
+
+// 管理操作的类型
+const (
+	ActionModerator = "moderator" // 房主任命管理员
+	ActionMute      = "mute"      // 禁言
+	ActionKick      = "kick"      // 移出聊天室
+	ActionBan       = "ban"       // 封禁
+	ActionUnban     = "unban"     // 解除封禁
+)
+
+// 一个聊天室中的封禁，按账号封禁登录的用户，按IP封禁未登录的用户
+type Ban struct {
+	Room      string    `bson:"room"`       // 聊天室的名字，房间ID重启后会变化
+	Target    string    `bson:"target"`     // 被封禁的账号或IP
+	ByIP      bool      `bson:"by_ip"`      // Target 是否为IP
+	By        string    `bson:"by"`         // 执行封禁的用户
+	CreatedAt time.Time `bson:"created_at"` // 封禁的时间
+}
+
+// 审计日志中的一条管理操作
+type Entry struct {
+	Time   time.Time `bson:"time"`             // 操作的时间
+	RoomId int       `bson:"room_id"`          // 聊天室的ID
+	Room   string    `bson:"room"`             // 聊天室的名字，随机分配的聊天室没有名字
+	Actor  string    `bson:"actor"`            // 执行操作的用户
+	Action string    `bson:"action"`           // 操作的类型，Action* 之一
+	Target string    `bson:"target"`           // 操作的对象: 用户名、账号或IP
+	Detail string    `bson:"detail,omitempty"` // 操作的细节，例如禁言的时长
+}
+
+// 封禁和审计日志的存储接口，实现 管理存储 必须实现该接口
+type Store interface {
+	// 保存封禁，同一个聊天室中的同一个对象已经被封禁时覆盖
+	SaveBan(ctx context.Context, ban *Ban) error
+	// 解除 room 中对 target 的封禁，不存在时返回 ErrBanNotFound
+	DeleteBan(ctx context.Context, room, target string) error
+	// 所有的封禁
+	Bans(ctx context.Context) ([]*Ban, error)
+	// 追加一条审计日志
+	Append(ctx context.Context, entry *Entry) error
+}
+
+type banKey struct {
+	room   string
+	target string
+}
+
+// 封禁和审计日志: 封禁写入 Store 并缓存在内存中，进入聊天室时只查内存
+type Service struct {
+	store   Store
+	timeout time.Duration // 每次访问存储的超时时间
+	logger  *slog.Logger
+	mu      sync.RWMutex
+	bans    map[banKey]*Ban
+}
+
+func NewService(store Store, timeout time.Duration, logger *slog.Logger) *Service {
+	return &Service{
+		store:   store,
+		timeout: timeout,
+		logger:  logger,
+		bans:    make(map[banKey]*Ban),
+	}
+}
+
+// 从 Store 中加载所有的封禁，启动时调用
+func (s *Service) Load() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	bans, err := s.store.Bans(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ban := range bans {
+		s.bans[banKey{ban.Room, ban.Target}] = ban
+	}
+	return nil
+}
+
+// account 或 ip 是否在 room 中被封禁，没有名字的聊天室不能封禁
+func (s *Service) Banned(room, account, ip string) bool {
+	if room == "" {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if account != "" {
+		if _, isPresent := s.bans[banKey{room, account}]; isPresent {
+			return true
+		}
+	}
+	ban, isPresent := s.bans[banKey{room, ip}]
+	return isPresent && ban.ByIP
+}
+
+// 保存封禁，写入 Store 成功之后才生效
+func (s *Service) Ban(ban *Ban) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.store.SaveBan(ctx, ban); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[banKey{ban.Room, ban.Target}] = ban
+	return nil
+}
+
+// 解除 room 中对 target 的封禁
+func (s *Service) Unban(room, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.store.DeleteBan(ctx, room, target); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bans, banKey{room, target})
+	return nil
+}
+
+// 记录一条管理操作，同时写到日志中；写入 Store 失败时只记录日志
+func (s *Service) Record(entry *Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	s.logger.Info("moderation", logging.KeyOp, "moderation."+entry.Action, logging.KeyRoomID, entry.RoomId, "room", entry.Room,
+		"actor", entry.Actor, "target", entry.Target, "detail", entry.Detail)
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.store.Append(ctx, entry); err != nil {
+		s.logger.Error("append audit log failed", logging.KeyOp, "moderation."+entry.Action, logging.Err(err))
+	}
+}
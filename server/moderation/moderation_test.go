@@ -0,0 +1,62 @@
+package moderation
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBanPersistsAcrossLoad(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewService(store, time.Second, slog.Default())
+	if err := s.Ban(&Ban{Room: "dev", Target: "mallory", By: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ban(&Ban{Room: "dev", Target: "10.0.0.9", ByIP: true, By: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewService(store, time.Second, slog.Default())
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		room, account, ip string
+		want              bool
+	}{
+		{"dev", "mallory", "10.0.0.1", true},
+		{"dev", "", "10.0.0.9", true},
+		{"dev", "bob", "10.0.0.9", true},
+		{"dev", "bob", "10.0.0.1", false},
+		{"ops", "mallory", "10.0.0.9", false},
+		{"", "mallory", "10.0.0.9", false},
+		// 按账号的封禁不会因为IP恰好相同而生效
+		{"dev", "", "mallory", false},
+	}
+	for _, c := range cases {
+		if got := loaded.Banned(c.room, c.account, c.ip); got != c.want {
+			t.Errorf("Banned(%q, %q, %q) = %v, want %v", c.room, c.account, c.ip, got, c.want)
+		}
+	}
+
+	if err := loaded.Unban("dev", "mallory"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Banned("dev", "mallory", "10.0.0.1") {
+		t.Fatal("still banned after Unban")
+	}
+	if err := loaded.Unban("dev", "mallory"); !errors.Is(err, ErrBanNotFound) {
+		t.Fatalf("second Unban err = %v, want ErrBanNotFound", err)
+	}
+}
+
+func TestRecordAppendsAuditEntry(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewService(store, time.Second, slog.Default())
+	s.Record(&Entry{Room: "dev", Actor: "alice", Action: ActionMute, Target: "bob", Detail: "5m0s"})
+	entries := store.Entries()
+	if len(entries) != 1 || entries[0].Action != ActionMute || entries[0].Target != "bob" {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
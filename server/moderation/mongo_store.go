@@ -0,0 +1,82 @@
+package moderation
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BansCollection  = "bans"  // 保存封禁的集合名称
+	AuditCollection = "audit" // 保存审计日志的集合名称
+)
+
+// 保存在 Mongo bans 和 audit 集合中的封禁和审计日志
+type MongoStore struct {
+	bans    *mongo.Collection
+	audit   *mongo.Collection
+	indexMu sync.Mutex
+	indexed bool // 第一次写入时才创建唯一索引，避免启动时就必须连上数据库；创建失败时下次写入重试
+}
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	return &MongoStore{
+		bans:  database.Collection(BansCollection),
+		audit: database.Collection(AuditCollection),
+	}
+}
+
+// 在 (room, target) 上创建唯一索引，同一个对象在一个聊天室中只有一条封禁
+func (s *MongoStore) ensureIndex(ctx context.Context) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexed {
+		return nil
+	}
+	_, err := s.bans.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "room", Value: 1}, {Key: "target", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	s.indexed = err == nil
+	return err
+}
+
+func (s *MongoStore) SaveBan(ctx context.Context, ban *Ban) error {
+	if err := s.ensureIndex(ctx); err != nil {
+		return err
+	}
+	filter := bson.D{{Key: "room", Value: ban.Room}, {Key: "target", Value: ban.Target}}
+	_, err := s.bans.ReplaceOne(ctx, filter, ban, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) DeleteBan(ctx context.Context, room, target string) error {
+	result, err := s.bans.DeleteOne(ctx, bson.D{{Key: "room", Value: room}, {Key: "target", Value: target}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) Bans(ctx context.Context) ([]*Ban, error) {
+	cursor, err := s.bans.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var bans []*Ban
+	if err := cursor.All(ctx, &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func (s *MongoStore) Append(ctx context.Context, entry *Entry) error {
+	_, err := s.audit.InsertOne(ctx, entry)
+	return err
+}
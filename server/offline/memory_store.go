@@ -0,0 +1,40 @@
+package offline
+
+import (
+	"context"
+	"sync"
+)
+
+// 保存在内存中的离线私聊，用于测试和不需要持久化的场景
+type MemoryStore struct {
+	mu       sync.Mutex
+	messages map[string][]*Message // 接收者 -> 按发送顺序排列的离线私聊
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		messages: make(map[string][]*Message),
+	}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *msg
+	s.messages[msg.To] = append(s.messages[msg.To], &saved)
+	return nil
+}
+
+func (s *MemoryStore) Count(ctx context.Context, to string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages[to]), nil
+}
+
+func (s *MemoryStore) Take(ctx context.Context, to string) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.messages[to]
+	delete(s.messages, to)
+	return msgs, nil
+}
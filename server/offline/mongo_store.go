@@ -0,0 +1,85 @@
+package offline
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const OfflineCollection = "offline_messages" // 保存离线私聊的集合名称
+
+// 从 Mongo 中读出的离线私聊，带有用来删除的 _id
+type storedMessage struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	Message `bson:",inline"`
+}
+
+// 保存在 Mongo offline_messages 集合中的离线私聊
+type MongoStore struct {
+	collection *mongo.Collection
+	indexMu    sync.Mutex
+	indexed    bool // 第一次写入时才创建索引，避免启动时就必须连上数据库；创建失败时下次写入重试
+}
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	return &MongoStore{
+		collection: database.Collection(OfflineCollection),
+	}
+}
+
+// 在 (to, timestamp) 上创建索引，用于按接收者取出离线私聊
+func (s *MongoStore) ensureIndex(ctx context.Context) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexed {
+		return nil
+	}
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "to", Value: 1}, {Key: "timestamp", Value: 1}},
+	})
+	s.indexed = err == nil
+	return err
+}
+
+func (s *MongoStore) Save(ctx context.Context, msg *Message) error {
+	if err := s.ensureIndex(ctx); err != nil {
+		return err
+	}
+	_, err := s.collection.InsertOne(ctx, msg)
+	return err
+}
+
+func (s *MongoStore) Count(ctx context.Context, to string) (int, error) {
+	n, err := s.collection.CountDocuments(ctx, bson.D{{Key: "to", Value: to}})
+	return int(n), err
+}
+
+// 先读出再按 _id 删除，取出期间新保存的离线私聊留到下次再取
+func (s *MongoStore) Take(ctx context.Context, to string) ([]*Message, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.D{{Key: "to", Value: to}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var stored []*storedMessage
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		return nil, nil
+	}
+	ids := make(bson.A, len(stored))
+	msgs := make([]*Message, len(stored))
+	for i, msg := range stored {
+		ids[i] = msg.ID
+		msgs[i] = &msg.Message
+	}
+	if _, err := s.collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
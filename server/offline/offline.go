@@ -0,0 +1,93 @@
+package offline
+
+import (
+	"chatroom/protocol"
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrMailboxFull = errors.New("offline: mailbox full")
+
+// 保存在存储中的一条离线私聊
+type Message struct {
+	To        string `bson:"to"`        // 接收者的账号
+	From      string `bson:"from"`      // 发送者
+	Room      int    `bson:"room"`      // 发送者发送时所在的房间ID，在大厅中时为0
+	MsgID     string `bson:"msg_id"`    // 服务器分配的消息ID，送达和已读回执带有该ID
+	Seq       int64  `bson:"seq"`       // 私聊在服务器内的序号
+	Timestamp int64  `bson:"timestamp"` // 毫秒时间戳
+	Body      string `bson:"body"`      // 消息体
+}
+
+// 离线私聊的存储接口，实现 离线消息存储 必须实现该接口
+type Store interface {
+	// 保存一条离线私聊
+	Save(ctx context.Context, msg *Message) error
+	// 发给 to 的离线私聊条数
+	Count(ctx context.Context, to string) (int, error)
+	// 取出并删除发给 to 的所有离线私聊，按发送顺序排列
+	Take(ctx context.Context, to string) ([]*Message, error)
+}
+
+// 离线私聊: 接收者不在线时保存私聊，接收者下次登录时取出
+type Mailbox struct {
+	store   Store
+	max     int           // 每个账号最多保存的离线私聊条数
+	timeout time.Duration // 每次访问存储的超时时间
+}
+
+// max 为每个账号最多保存的离线私聊条数
+func New(store Store, max int, timeout time.Duration) *Mailbox {
+	return &Mailbox{
+		store:   store,
+		max:     max,
+		timeout: timeout,
+	}
+}
+
+// 保存一条发给离线账号的私聊，该账号的离线私聊已满时返回 ErrMailboxFull
+func (m *Mailbox) Save(msg *protocol.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	n, err := m.store.Count(ctx, msg.To)
+	if err != nil {
+		return err
+	}
+	if n >= m.max {
+		return ErrMailboxFull
+	}
+	return m.store.Save(ctx, &Message{
+		To:        msg.To,
+		From:      msg.From,
+		Room:      msg.Room,
+		MsgID:     msg.MsgID,
+		Seq:       msg.Seq,
+		Timestamp: msg.Timestamp,
+		Body:      msg.Body,
+	})
+}
+
+// 取出发给 account 的所有离线私聊，取出之后不会再次返回
+func (m *Mailbox) Take(account string) ([]*protocol.Envelope, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	saved, err := m.store.Take(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*protocol.Envelope, len(saved))
+	for i, msg := range saved {
+		msgs[i] = &protocol.Envelope{
+			Type:      protocol.TypeMessage,
+			Room:      msg.Room,
+			MsgID:     msg.MsgID,
+			Seq:       msg.Seq,
+			Timestamp: msg.Timestamp,
+			From:      msg.From,
+			To:        msg.To,
+			Body:      msg.Body,
+		}
+	}
+	return msgs, nil
+}
@@ -0,0 +1,49 @@
+package offline
+
+import (
+	"chatroom/protocol"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTakeReturnsMessagesOnce(t *testing.T) {
+	m := New(NewMemoryStore(), 100, time.Second)
+	for _, body := range []string{"first\n", "second\n"} {
+		if err := m.Save(protocol.NewMessage(1, "alice", "bob", body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Save(protocol.NewMessage(0, "alice", "carol", "other\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := m.Take("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Body != "first\n" || msgs[1].Body != "second\n" {
+		t.Fatalf("msgs = %+v", msgs)
+	}
+	if msgs[0].Type != protocol.TypeMessage || msgs[0].From != "alice" || msgs[0].To != "bob" || msgs[0].Room != 1 {
+		t.Fatalf("msgs[0] = %+v", msgs[0])
+	}
+	if msgs, _ := m.Take("bob"); len(msgs) != 0 {
+		t.Fatalf("second Take = %+v, want none", msgs)
+	}
+	if msgs, _ := m.Take("carol"); len(msgs) != 1 {
+		t.Fatalf("carol's messages = %+v", msgs)
+	}
+}
+
+func TestSaveRejectsFullMailbox(t *testing.T) {
+	m := New(NewMemoryStore(), 3, time.Second)
+	for i := 0; i < 3; i++ {
+		if err := m.Save(protocol.NewMessage(0, "alice", "bob", "hi\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Save(protocol.NewMessage(0, "alice", "bob", "hi\n")); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("err = %v, want ErrMailboxFull", err)
+	}
+}
@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"chatroom/config"
+	"sync"
+	"time"
+)
+
+// 时钟的接口，测试中用假的时钟代替 time.Now
+type IClock interface {
+	Now() time.Time
+}
+
+// 使用 time.Now 的时钟
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// 请求的类型，每种类型有自己的令牌桶
+type Kind int
+
+const (
+	Broadcast Kind = iota // 广播
+	Private               // 私聊
+	Command               // 其他命令
+)
+
+// 检查一次请求的结果，超过限制时逐步升级: 警告 -> 禁言 -> 断开连接
+type Verdict int
+
+const (
+	Allow      Verdict = iota // 允许该请求
+	Warn                      // 超过限制，丢弃该请求并警告
+	Mute                      // 连续超过限制，丢弃该请求并开始禁言
+	Muted                     // 禁言期间的广播或私聊，丢弃该请求
+	Disconnect                // 被禁言多次之后仍然超过限制，断开连接
+)
+
+var verdictNames = map[Verdict]string{
+	Allow:      "allow",
+	Warn:       "warn",
+	Mute:       "mute",
+	Muted:      "muted",
+	Disconnect: "disconnect",
+}
+
+func (v Verdict) String() string {
+	if name, ok := verdictNames[v]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// 令牌桶: 最多攒下 burst 个令牌，每隔 interval 恢复一个
+// burst 为0时不限制
+type bucket struct {
+	burst    int
+	interval time.Duration
+	tokens   float64   // 当前的令牌数
+	last     time.Time // 上次计算令牌数的时间
+}
+
+func newBucket(burst int, interval time.Duration, now time.Time) *bucket {
+	return &bucket{burst: burst, interval: interval, tokens: float64(burst), last: now}
+}
+
+// 补上从 last 到 now 恢复的令牌，有令牌时取走一个并返回 true
+func (b *bucket) take(now time.Time) bool {
+	if b.burst == 0 {
+		return true
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(b.interval)
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 一个用户的限流状态，可以在多个协程中使用
+type Limiter struct {
+	mu         sync.Mutex
+	clock      IClock
+	cfg        config.RateLimitConfig
+	buckets    [3]*bucket // Kind -> 对应的令牌桶
+	strikes    int        // 禁言之前连续超过限制的次数
+	mutes      int        // 已经被禁言的次数
+	lastStrike time.Time  // 最近一次超过限制的时间
+	mutedUntil time.Time  // 禁言结束的时间
+}
+
+func NewLimiter(cfg config.RateLimitConfig, clock IClock) *Limiter {
+	now := clock.Now()
+	return &Limiter{
+		clock: clock,
+		cfg:   cfg,
+		buckets: [3]*bucket{
+			Broadcast: newBucket(cfg.BroadcastBurst, cfg.BroadcastInterval, now),
+			Private:   newBucket(cfg.PrivateBurst, cfg.PrivateInterval, now),
+			Command:   newBucket(cfg.CommandBurst, cfg.CommandInterval, now),
+		},
+	}
+}
+
+// 检查一次 kind 类型的请求
+// 禁言期间的广播和私聊直接返回 Muted，不消耗令牌也不算作超过限制，命令不受禁言影响
+func (l *Limiter) Check(kind Kind) Verdict {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if !l.lastStrike.IsZero() && now.Sub(l.lastStrike) >= l.cfg.ForgiveAfter && !now.Before(l.mutedUntil) {
+		l.strikes, l.mutes = 0, 0
+	}
+	if kind != Command && now.Before(l.mutedUntil) {
+		return Muted
+	}
+	if l.buckets[kind].take(now) {
+		return Allow
+	}
+	l.lastStrike = now
+	l.strikes++
+	if l.strikes < l.cfg.MuteAfter {
+		return Warn
+	}
+	l.strikes = 0
+	if l.mutes >= l.cfg.MaxMutes {
+		return Disconnect
+	}
+	l.mutes++
+	l.mutedUntil = now.Add(l.cfg.MuteFor)
+	return Mute
+}
+
+// 禁言剩余的时间，没有被禁言时返回0
+func (l *Limiter) MutedFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if remaining := l.mutedUntil.Sub(l.clock.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// 每个IP同时建立的连接数的限制，可以在多个协程中使用
+type ConnLimiter struct {
+	mu    sync.Mutex
+	max   int            // 每个IP最多同时建立的连接数，为0时不限制
+	conns map[string]int // IP -> 当前的连接数
+}
+
+func NewConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{max: max, conns: make(map[string]int)}
+}
+
+// 为 ip 占用一个连接，已经达到上限时返回 false
+// 返回 true 时，连接关闭后需要调用 Release
+func (c *ConnLimiter) Acquire(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max > 0 && c.conns[ip] >= c.max {
+		return false
+	}
+	c.conns[ip]++
+	return true
+}
+
+// 释放 Acquire 占用的连接
+func (c *ConnLimiter) Release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[ip] <= 1 {
+		delete(c.conns, ip)
+		return
+	}
+	c.conns[ip]--
+}
+
+// ip 当前的连接数
+func (c *ConnLimiter) Conns(ip string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conns[ip]
+}
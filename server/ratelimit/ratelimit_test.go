@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"chatroom/config"
+	"testing"
+	"time"
+)
+
+// 只有手动 Advance 才会前进的时钟
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func testConfig() config.RateLimitConfig {
+	return config.RateLimitConfig{
+		BroadcastBurst:    2,
+		BroadcastInterval: time.Second,
+		PrivateBurst:      1,
+		PrivateInterval:   time.Second,
+		CommandBurst:      0,
+		MuteAfter:         2,
+		MuteFor:           10 * time.Second,
+		MaxMutes:          1,
+		ForgiveAfter:      time.Minute,
+	}
+}
+
+func expect(t *testing.T, l *Limiter, kind Kind, want ...Verdict) {
+	t.Helper()
+	for i, w := range want {
+		if got := l.Check(kind); got != w {
+			t.Fatalf("check %d of kind %d = %v, want %v", i, kind, got, w)
+		}
+	}
+}
+
+func TestBucketRefills(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := NewLimiter(testConfig(), clock)
+	expect(t, l, Broadcast, Allow, Allow, Warn)
+	clock.Advance(500 * time.Millisecond)
+	expect(t, l, Broadcast, Mute)
+	// 每种类型有自己的令牌桶，禁言不影响命令
+	expect(t, l, Command, Allow, Allow, Allow)
+	clock.Advance(time.Hour)
+	expect(t, l, Broadcast, Allow, Allow, Warn)
+}
+
+func TestEscalation(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := NewLimiter(testConfig(), clock)
+	expect(t, l, Private, Allow, Warn, Mute, Muted)
+	if got := l.MutedFor(); got != 10*time.Second {
+		t.Fatalf("MutedFor = %v, want 10s", got)
+	}
+	clock.Advance(10 * time.Second)
+	if got := l.MutedFor(); got != 0 {
+		t.Fatalf("MutedFor after mute = %v, want 0", got)
+	}
+	// 禁言期间恢复了令牌，再超过 mute_after 次之后已经用完了 max_mutes，断开连接
+	expect(t, l, Private, Allow, Warn, Disconnect)
+}
+
+func TestForgiveAfterQuietPeriod(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := NewLimiter(testConfig(), clock)
+	expect(t, l, Private, Allow, Warn, Mute)
+	clock.Advance(time.Minute)
+	expect(t, l, Private, Allow, Warn, Mute)
+}
+
+func TestConnLimiter(t *testing.T) {
+	c := NewConnLimiter(2)
+	if !c.Acquire("10.0.0.1") || !c.Acquire("10.0.0.1") {
+		t.Fatal("Acquire under the limit failed")
+	}
+	if c.Acquire("10.0.0.1") {
+		t.Fatal("Acquire over the limit succeeded")
+	}
+	if !c.Acquire("10.0.0.2") {
+		t.Fatal("limit is not per ip")
+	}
+	c.Release("10.0.0.1")
+	if !c.Acquire("10.0.0.1") {
+		t.Fatal("Acquire after Release failed")
+	}
+	c.Release("10.0.0.2")
+	if got := c.Conns("10.0.0.2"); got != 0 {
+		t.Fatalf("Conns = %d, want 0", got)
+	}
+
+	unlimited := NewConnLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.Acquire("10.0.0.1") {
+			t.Fatal("unlimited ConnLimiter refused a connection")
+		}
+	}
+}
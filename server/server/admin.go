@@ -0,0 +1,272 @@
+package server
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/chatroom_manager"
+	"chatroom/server/user"
+	"chatroom/utils"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 管理接口的路径前缀
+const AdminPathPrefix = "/admin/"
+
+// 管理接口中的聊天室: 房间概况和成员名字
+type AdminRoom struct {
+	protocol.RoomInfo
+	Users []string `json:"users"`
+}
+
+// 管理接口中的用户
+type AdminUser struct {
+	Name       string `json:"name"`
+	Account    string `json:"account,omitempty"`
+	Room       int    `json:"room"` // 为0时在大厅中
+	RemoteAddr string `json:"remote_addr"`
+	Dialect    string `json:"dialect"`
+	Queued     int    `json:"queued"`  // 发送队列中等待写出的消息数
+	OnDisk     int    `json:"on_disk"` // 磁盘上等待补发的消息数
+	Dropped    int64  `json:"dropped"` // 累计丢弃的消息数
+	Spilled    int64  `json:"spilled"` // 累计写到磁盘上的消息数
+}
+
+// 管理接口请求的 body
+type adminRequest struct {
+	Name   string `json:"name"`   // 创建聊天室时的名字
+	Policy string `json:"policy"` // 创建聊天室时的慢消费者策略，为空时使用默认值
+	Body   string `json:"body"`   // 公告的内容
+	Reason string `json:"reason"` // 移出用户的原因
+}
+
+// 在 addr 上监听管理接口，请求需要带上 Authorization: Bearer <token>
+// 管理接口不使用 TLS，应该只监听在本机或者内网地址上
+func (c *ChatServer) StartAdmin(addr, token string) {
+	c.logger.Info("admin listening", "addr", addr, "path", AdminPathPrefix)
+	httpServer := &http.Server{Addr: addr, Handler: c.AdminHandler(token)}
+	if !c.addHTTPServer(httpServer) {
+		return
+	}
+	err := httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	utils.CheckError(err, "Admin Listener")
+}
+
+// 管理接口，只通过 IChatroomManager 和 SafeUserMap 操作房间和用户
+//
+//	GET    /admin/rooms              列出所有聊天室和成员
+//	POST   /admin/rooms              创建聊天室 {"name":"dev","policy":"drop_oldest"}
+//	DELETE /admin/rooms/<id>         关闭聊天室，成员回到大厅
+//	POST   /admin/rooms/<id>/notice  给一个聊天室发公告 {"body":"..."}
+//	POST   /admin/notice             给所有聊天室发公告 {"body":"..."}
+//	GET    /admin/users/<name>       查看用户
+//	POST   /admin/users/<name>/kick  断开用户的连接 {"reason":"..."}
+func (c *ChatServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPathPrefix+"rooms", c.adminRooms)
+	mux.HandleFunc(AdminPathPrefix+"rooms/", c.adminRoom)
+	mux.HandleFunc(AdminPathPrefix+"notice", c.adminNoticeAll)
+	mux.HandleFunc(AdminPathPrefix+"users/", c.adminUser)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if token == "" || given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// GET 列出所有聊天室，POST 创建聊天室
+func (c *ChatServer) adminRooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rooms := make([]AdminRoom, 0)
+		for _, info := range c.IChatroomManager.ListRooms() {
+			room := AdminRoom{RoomInfo: info, Users: []string{}}
+			if IChatroom, ok := c.IChatroomManager.FindRoom(info.ID); ok {
+				room.Users = IChatroom.MemberNames()
+			}
+			rooms = append(rooms, room)
+		}
+		writeAdminJSON(w, http.StatusOK, rooms)
+	case http.MethodPost:
+		var req adminRequest
+		if !readAdminRequest(w, r, &req) {
+			return
+		}
+		policy, err := user.ParseSlowConsumerPolicy(req.Policy)
+		if req.Policy != "" && err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		IChatroom, err := c.IChatroomManager.CreateRoom(req.Name)
+		if err != nil {
+			writeAdminError(w, adminStatus(err), err)
+			return
+		}
+		if req.Policy != "" {
+			IChatroom.(*chatroom.Chatroom).SetSlowConsumerPolicy(policy)
+		}
+		c.logger.Info("admin created room", logging.KeyOp, "admin.create_room", logging.KeyRoomID, IChatroom.Info().ID, "name", req.Name)
+		writeAdminJSON(w, http.StatusCreated, AdminRoom{RoomInfo: IChatroom.Info(), Users: []string{}})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// DELETE /admin/rooms/<id> 关闭聊天室，POST /admin/rooms/<id>/notice 给聊天室发公告
+func (c *ChatServer) adminRoom(w http.ResponseWriter, r *http.Request) {
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, AdminPathPrefix+"rooms/"), "/")
+	roomId, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, chatroom_manager.ErrRoomNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		if err := c.IChatroomManager.CloseRoom(roomId); err != nil {
+			writeAdminError(w, adminStatus(err), err)
+			return
+		}
+		c.logger.Info("admin closed room", logging.KeyOp, "admin.close_room", logging.KeyRoomID, roomId)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "notice" && r.Method == http.MethodPost:
+		var req adminRequest
+		if !readAdminRequest(w, r, &req) {
+			return
+		}
+		IChatroom, ok := c.IChatroomManager.FindRoom(roomId)
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, chatroom_manager.ErrRoomNotFound)
+			return
+		}
+		IChatroom.Notice(req.Body)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// POST /admin/notice 给所有聊天室发公告
+func (c *ChatServer) adminNoticeAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var req adminRequest
+	if !readAdminRequest(w, r, &req) {
+		return
+	}
+	for _, info := range c.IChatroomManager.ListRooms() {
+		if IChatroom, ok := c.IChatroomManager.FindRoom(info.ID); ok {
+			IChatroom.Notice(req.Body)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/users/<name> 查看用户，POST /admin/users/<name>/kick 断开用户的连接
+func (c *ChatServer) adminUser(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, AdminPathPrefix+"users/")
+	name, action := rest, ""
+	if strings.HasSuffix(rest, "/kick") {
+		name, action = strings.TrimSuffix(rest, "/kick"), "kick"
+	}
+	u, ok := c.userMap.GetUser(name)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		stats := u.SendStats()
+		dialect := "unknown"
+		switch u.Dialect() {
+		case protocol.DialectPipe:
+			dialect = "pipe"
+		case protocol.DialectJSON:
+			dialect = "json"
+		}
+		writeAdminJSON(w, http.StatusOK, AdminUser{
+			Name:       u.Name(),
+			Account:    u.Account,
+			Room:       u.RoomId(),
+			RemoteAddr: u.Conn.RemoteAddr().String(),
+			Dialect:    dialect,
+			Queued:     stats.Queued,
+			OnDisk:     stats.OnDisk,
+			Dropped:    stats.Dropped,
+			Spilled:    stats.Spilled,
+		})
+	case action == "kick" && r.Method == http.MethodPost:
+		var req adminRequest
+		if !readAdminRequest(w, r, &req) {
+			return
+		}
+		c.kickUser(u, req.Reason)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// 通知用户之后断开连接，不保存断线重连的会话
+func (c *ChatServer) kickUser(u *user.User, reason string) {
+	body := "你已被管理员断开连接"
+	if reason != "" {
+		body += "，原因: " + reason
+	}
+	u.Send(protocol.NewNotice(u.RoomId(), body+"\n"))
+	u.Logger().Info("admin kicked user", logging.KeyOp, "admin.kick", "reason", reason)
+	if IChatroom, inRoom := c.IChatroomManager.UserRoom(u); inRoom {
+		IChatroom.TerminalUserConnect(u)
+	} else {
+		c.terminalLobbyUser(u)
+	}
+}
+
+// 读取请求的 JSON body，body 为空时保持零值，格式不对时返回 400
+func readAdminRequest(w http.ResponseWriter, r *http.Request, req *adminRequest) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// chatroom_manager 的错误对应的 HTTP 状态码
+func adminStatus(err error) int {
+	switch {
+	case errors.Is(err, chatroom_manager.ErrRoomNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, chatroom_manager.ErrRoomExists), errors.Is(err, chatroom_manager.ErrTooManyRooms):
+		return http.StatusConflict
+	case errors.Is(err, chatroom_manager.ErrInvalidRoomName):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	utils.CheckError(json.NewEncoder(w).Encode(v), "Admin Response")
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret-token"
+
+// 启动测试服务器和它的管理接口，返回 TCP 地址和管理接口的地址
+func startAdminServer(t *testing.T) (*ChatServer, string, string) {
+	t.Helper()
+	c, addr := startTestServer(t)
+	admin := httptest.NewServer(c.AdminHandler(testAdminToken))
+	t.Cleanup(admin.Close)
+	return c, addr, admin.URL
+}
+
+// 发送带 token 的管理请求，v 不为 nil 时解析返回的 JSON
+func adminDo(t *testing.T, method, u, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	_, _, admin := startAdminServer(t)
+	for _, auth := range []string{"", "Bearer wrong", testAdminToken} {
+		req, _ := http.NewRequest(http.MethodGet, admin+"/admin/rooms", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q status = %d, want 401", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminRoomsAndNotices(t *testing.T) {
+	_, addr, admin := startAdminServer(t)
+	alice, aliceReader := dialTestUser(t, addr)
+
+	var created AdminRoom
+	if status := adminDo(t, http.MethodPost, admin+"/admin/rooms", `{"name":"ops","policy":"disconnect"}`, &created); status != http.StatusCreated {
+		t.Fatalf("create room status = %d", status)
+	}
+	if created.Name != "ops" || created.Policy != "disconnect" {
+		t.Fatalf("created room = %+v", created)
+	}
+	if status := adminDo(t, http.MethodPost, admin+"/admin/rooms", `{"name":"ops"}`, nil); status != http.StatusConflict {
+		t.Fatalf("duplicate room status = %d, want 409", status)
+	}
+	alice.Write([]byte(fmt.Sprintf("10|%d\n", created.ID)))
+	readTCPUntil(t, alice, aliceReader, "已加入ID为")
+
+	var rooms []AdminRoom
+	adminDo(t, http.MethodGet, admin+"/admin/rooms", "", &rooms)
+	found := false
+	for _, room := range rooms {
+		if room.ID == created.ID {
+			found = len(room.Users) == 1 && room.Users[0] == alice.LocalAddr().String()
+		}
+	}
+	if !found {
+		t.Fatalf("rooms = %+v, want alice in room %d", rooms, created.ID)
+	}
+
+	roomURL := fmt.Sprintf("%s/admin/rooms/%d", admin, created.ID)
+	if status := adminDo(t, http.MethodPost, roomURL+"/notice", `{"body":"maintenance at noon"}`, nil); status != http.StatusNoContent {
+		t.Fatalf("room notice status = %d", status)
+	}
+	readTCPUntil(t, alice, aliceReader, "maintenance at noon")
+	adminDo(t, http.MethodPost, admin+"/admin/notice", `{"body":"hello everyone"}`, nil)
+	readTCPUntil(t, alice, aliceReader, "hello everyone")
+
+	// 关闭房间之后成员回到大厅，连接保持
+	if status := adminDo(t, http.MethodDelete, roomURL, "", nil); status != http.StatusNoContent {
+		t.Fatalf("close room status = %d", status)
+	}
+	readTCPUntil(t, alice, aliceReader, "已被关闭，你已回到大厅")
+	alice.Write([]byte("1|anyone?\n"))
+	readTCPUntil(t, alice, aliceReader, "不在该聊天室中")
+	alice.Write([]byte("1|anyone?\n"))
+	readTCPUntil(t, alice, aliceReader, "你当前在大厅中")
+	if status := adminDo(t, http.MethodDelete, roomURL, "", nil); status != http.StatusNotFound {
+		t.Fatalf("close missing room status = %d, want 404", status)
+	}
+}
+
+func TestAdminInspectAndKickUser(t *testing.T) {
+	_, addr, admin := startAdminServer(t)
+	alice, aliceReader := dialTestUser(t, addr)
+	userURL := admin + "/admin/users/" + url.PathEscape(alice.LocalAddr().String())
+
+	var info AdminUser
+	if status := adminDo(t, http.MethodGet, userURL, "", &info); status != http.StatusOK {
+		t.Fatalf("inspect status = %d", status)
+	}
+	if info.Name != alice.LocalAddr().String() || info.Room == 0 {
+		t.Fatalf("user = %+v", info)
+	}
+	if status := adminDo(t, http.MethodGet, admin+"/admin/users/nobody", "", nil); status != http.StatusNotFound {
+		t.Fatalf("missing user status = %d, want 404", status)
+	}
+
+	if status := adminDo(t, http.MethodPost, userURL+"/kick", `{"reason":"spam"}`, nil); status != http.StatusNoContent {
+		t.Fatalf("kick status = %d", status)
+	}
+	readTCPUntil(t, alice, aliceReader, "原因: spam")
+	waitClosed(t, alice, aliceReader)
+	if status := adminDo(t, http.MethodGet, userURL, "", nil); status != http.StatusNotFound {
+		t.Fatalf("kicked user status = %d, want 404", status)
+	}
+}
+
+// 等待服务器关闭连接
+func waitClosed(t *testing.T, conn net.Conn, r *bufio.Reader) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("connection was not closed")
+			}
+			return
+		}
+	}
+}
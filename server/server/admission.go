@@ -0,0 +1,335 @@
+package server
+
+import (
+	"chatroom/constants"
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/metrics"
+	"chatroom/server/ratelimit"
+	"chatroom/server/user"
+	"chatroom/utils"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// 估计等待时间时参考的最近几次进入房间的时间
+const admissionSamples = 10
+
+// 所有房间都满时等待进入房间的用户，按照到达的顺序进入房间
+// 每个等待中的用户有自己的读协程（waitInQueue），断开或者退出时移出队列，进入房间之后由同一个协程继续处理消息
+type admissionQueue struct {
+	mu        sync.Mutex
+	waiting   []*user.User
+	admitting *user.User    // admitNext 正在给它分配房间的队首用户，分配期间不持有 mu
+	abandoned bool          // admitting 在分配房间期间离开了队列
+	max       int           // 最多等待的人数，为0时直接拒绝
+	admitted  []time.Time   // 最近几次从队列进入房间的时间，用于估计等待时间
+	wake      chan struct{} // 房间空出位置时通知 admitWaiting
+}
+
+func newAdmissionQueue(max int) *admissionQueue {
+	return &admissionQueue{
+		max:  max,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// 修改最多等待的人数，已经在队列中的用户不会被移出
+func (q *admissionQueue) setMax(max int) {
+	q.mu.Lock()
+	q.max = max
+	q.mu.Unlock()
+}
+
+// 把用户放到队尾，返回从1开始的位置，队列已满时返回 false
+func (q *admissionQueue) push(u *user.User) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) >= q.max {
+		return 0, false
+	}
+	q.waiting = append(q.waiting, u)
+	metrics.WaitingUsers.Set(float64(len(q.waiting)))
+	return len(q.waiting), true
+}
+
+// admitNext 的结果
+type admitResult int
+
+const (
+	admitStopped   admitResult = iota // 队列为空或者没有空位，队首的用户继续等待
+	admitDropped                      // 队首的用户已经离开，直接移出
+	admitEntered                      // 队首的用户进入了房间
+	admitAbandoned                    // 队首的用户进入了房间，但是分配期间离开了队列，调用者需要把它移出该房间
+)
+
+// 让队首的用户进入房间，assign 在 q.mu 之外调用，分配房间期间新用户仍然可以排队
+// 只有 admitWaiting 一个协程调用，分配期间队首的用户不会被别人移出，只会由 remove 标记为 abandoned
+func (q *admissionQueue) admitNext(assign func(*user.User) bool) (*user.User, admitResult) {
+	q.mu.Lock()
+	if len(q.waiting) == 0 {
+		q.mu.Unlock()
+		return nil, admitStopped
+	}
+	u := q.waiting[0]
+	if u.IsClosed() {
+		q.removeAt(0)
+		q.mu.Unlock()
+		return u, admitDropped
+	}
+	q.admitting, q.abandoned = u, false
+	q.mu.Unlock()
+
+	entered := assign(u)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	abandoned := q.abandoned
+	q.admitting, q.abandoned = nil, false
+	switch {
+	case abandoned && entered:
+		return u, admitAbandoned
+	case abandoned:
+		return u, admitDropped
+	case !entered:
+		return u, admitStopped
+	}
+	q.removeAt(0)
+	q.admitted = append(q.admitted, time.Now())
+	if len(q.admitted) > admissionSamples {
+		q.admitted = q.admitted[1:]
+	}
+	return u, admitEntered
+}
+
+// 把 u 移出队列，u 已经不在队列中（例如刚刚进入了房间）时返回 false
+// u 正在被分配房间时也移出，由 admitNext 把它移出刚分配的房间
+func (q *admissionQueue) remove(u *user.User) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiting := range q.waiting {
+		if waiting == u {
+			q.removeAt(i)
+			if u == q.admitting {
+				q.abandoned = true
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// 移出第 i 个用户，调用者需要持有 q.mu
+func (q *admissionQueue) removeAt(i int) {
+	copy(q.waiting[i:], q.waiting[i+1:])
+	q.waiting[len(q.waiting)-1] = nil
+	q.waiting = q.waiting[:len(q.waiting)-1]
+	metrics.WaitingUsers.Set(float64(len(q.waiting)))
+}
+
+// 等待中的人数
+func (q *admissionQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// 通知 admitWaiting 房间可能空出了位置，不会阻塞
+func (q *admissionQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 按照最近几次进入房间的平均间隔估计第 position 位的等待时间，样本不够时返回 false
+func (q *admissionQueue) estimate(position int) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.admitted) < 2 {
+		return 0, false
+	}
+	interval := q.admitted[len(q.admitted)-1].Sub(q.admitted[0]) / time.Duration(len(q.admitted)-1)
+	return interval * time.Duration(position), true
+}
+
+// 告诉等待中的用户它的位置和预计的等待时间
+func (q *admissionQueue) positionMsg(position int) string {
+	wait, ok := q.estimate(position)
+	switch {
+	case !ok:
+		return fmt.Sprintf("所有聊天室都已满，你在等待队列中的第%d位，有空位时会自动进入\n", position)
+	case wait < time.Second:
+		return fmt.Sprintf("所有聊天室都已满，你在等待队列中的第%d位，预计等待不到1秒\n", position)
+	default:
+		return fmt.Sprintf("所有聊天室都已满，你在等待队列中的第%d位，预计等待%s\n", position, wait.Round(time.Second))
+	}
+}
+
+// 房间的成员离开了，让等待中的用户进入房间，实现 chatroom.CommandHandler
+func (c *ChatServer) HandleUserLeft(_ *chatroom.Chatroom) {
+	c.admission.signal()
+}
+
+// 分配房间失败或者已经有用户在等待时，把用户放进等待队列，队列已满时断开该用户
+func (c *ChatServer) waitForRoom(u *user.User) {
+	position, ok := c.admission.push(u)
+	if !ok {
+		u.Send(protocol.NewError("", "所有聊天室和等待队列都已满，请稍后再连接\n"))
+		u.Logger().Warn("admission queue full, connection rejected")
+		c.terminalLobbyUser(u)
+		return
+	}
+	u.Send(protocol.NewNotice(0, c.admission.positionMsg(position)))
+	u.Logger().Info("user queued for room", "position", position)
+	if !c.goTracked(func() { c.waitInQueue(u) }) {
+		c.admission.remove(u)
+		c.terminalLobbyUser(u)
+		return
+	}
+	// 放进队列之前可能已经有人离开了房间
+	c.admission.signal()
+}
+
+// 等待中的用户的读协程: 断开连接或者退出时移出队列，其他消息只回复当前的位置
+// 进入房间之后由同一个协程继续处理该用户的消息
+func (c *ChatServer) waitInQueue(u *user.User) {
+	for u.RoomId() == 0 {
+		msg, err := u.ReadMsg()
+		// 读消息期间进入了房间，这条消息和断线都交给房间处理
+		if u.RoomId() != 0 {
+			if err == nil {
+				if IChatroom, ok := c.IChatroomManager.UserRoom(u); ok {
+					if cr, ok := IChatroom.(*chatroom.Chatroom); ok {
+						cr.HandleMsg(u, msg)
+					}
+				}
+			}
+			break
+		}
+		if u.IsClosed() || err == io.EOF || utils.CheckError(err, "Read") {
+			c.leaveQueue(u, true)
+			return
+		}
+		env, err := protocol.Parse(u.Dialect(), msg)
+		if err != nil {
+			u.Send(protocol.NewError("", "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr()))
+			continue
+		}
+		metrics.Messages.WithLabelValues(env.Type).Inc()
+		if verdict := u.CheckRate(env); verdict != ratelimit.Allow {
+			if verdict == ratelimit.Disconnect {
+				c.leaveQueue(u, false)
+				return
+			}
+			continue
+		}
+		switch env.Type {
+		case protocol.TypeQuit:
+			u.Send(protocol.NewAck(env.ID, fmt.Sprintf("Bye~ %s\n", u.Name())))
+			c.leaveQueue(u, false)
+			return
+		case protocol.TypePing:
+			u.Send(protocol.NewPong(env.ID))
+		case protocol.TypePong:
+		default:
+			if position, ok := c.admission.position(u); ok {
+				u.Send(protocol.NewError(env.ID, c.admission.positionMsg(position)))
+			}
+		}
+	}
+	c.serveUser(u)
+}
+
+// 等待中的用户断开连接（disconnected 为 true）或者退出，移出队列并告诉后面的用户新的位置
+// 已经进入房间时不在这里处理，交给房间；已经被关闭的连接由关闭它的一方做后处理
+func (c *ChatServer) leaveQueue(u *user.User, disconnected bool) {
+	if !c.admission.remove(u) {
+		c.serveUser(u)
+		return
+	}
+	if !u.IsClosed() {
+		u.Logger().Info("waiting user left", "disconnected", disconnected)
+		if disconnected {
+			c.HandleDisconnect(nil, u)
+		}
+		c.terminalLobbyUser(u)
+	}
+	c.notifyPositions()
+}
+
+// 作为等待队列的消费者，单个协程，每次房间空出位置时按顺序让用户进入房间，Shutdown 时退出
+func (c *ChatServer) admitWaiting() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.admission.wake:
+			if c.admitQueued() {
+				c.notifyPositions()
+			}
+		}
+	}
+}
+
+// 从队首开始让用户进入房间，直到没有空位或者队列为空，返回是否有用户离开了队列
+// 分配失败时不提示用户，等待中的用户只会收到自己的位置
+func (c *ChatServer) admitQueued() bool {
+	moved := false
+	for {
+		u, result := c.admission.admitNext(func(u *user.User) bool {
+			isFound, _ := c.IChatroomManager.AssignRoomToUser(u)
+			return isFound
+		})
+		switch result {
+		case admitStopped:
+			return moved
+		case admitEntered:
+			// 该用户的读协程 waitInQueue 发现进入了房间之后交给房间处理
+			u.Logger().Debug("room assigned", logging.KeyRoomID, u.RoomId())
+		case admitAbandoned:
+			// 读协程已经按离开队列做了后处理，刚分配的位置让给下一个用户
+			u.Logger().Debug("room assigned after leaving the queue, removed", logging.KeyRoomID, u.RoomId())
+			c.IChatroomManager.LeaveRoom(u)
+		}
+		moved = true
+	}
+}
+
+// 该用户在队列中从1开始的位置，不在队列中时返回 false
+func (q *admissionQueue) position(u *user.User) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiting := range q.waiting {
+		if waiting == u {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// 告诉还在等待的用户它们新的位置
+func (c *ChatServer) notifyPositions() {
+	c.admission.mu.Lock()
+	waiting := append([]*user.User(nil), c.admission.waiting...)
+	c.admission.mu.Unlock()
+	for i, u := range waiting {
+		u.Send(protocol.NewNotice(0, c.admission.positionMsg(i+1)))
+	}
+}
+
+// 用户已经被分配到房间，开一个协程处理该用户的消息
+func (c *ChatServer) enterAssignedRoom(u *user.User, IChatroom chatroom.IChatroom) {
+	cr, ok := IChatroom.(*chatroom.Chatroom)
+	if !ok {
+		log.Panicln("*chatroom.Chatroom 没有实现 Ichatroom 接口")
+	}
+	u.Logger().Debug("room assigned", logging.KeyRoomID, cr.RoomId)
+	if !c.goTracked(func() { c.serveUser(u) }) {
+		c.terminalLobbyUser(u)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"chatroom/server/user"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFullServerQueuesUsersInOrder(t *testing.T) {
+	cfg := testConfig()
+	cfg.Manager.MaxRooms = 1
+	cfg.Chatroom.MaxUsers = 1
+	cfg.Manager.MaxWaiting = 2
+	_, addr := startTestServerWithConfig(t, cfg)
+
+	dialWaiting := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+
+	alice, _ := dialTestUser(t, addr)
+	bob, bobReader := dialWaiting()
+	readTCPUntil(t, bob, bobReader, "你在等待队列中的第1位")
+	carol, carolReader := dialWaiting()
+	readTCPUntil(t, carol, carolReader, "你在等待队列中的第2位")
+	dave, daveReader := dialWaiting()
+	readTCPUntil(t, dave, daveReader, "等待队列都已满")
+	if _, err := daveReader.ReadString('\n'); err == nil {
+		t.Fatal("connection still open after the waiting queue was full")
+	}
+
+	// alice 离开之后按照到达的顺序进入房间
+	alice.Write([]byte("4\n"))
+	readTCPUntil(t, bob, bobReader, "房间")
+	readTCPUntil(t, carol, carolReader, "你在等待队列中的第1位")
+	bob.Write([]byte("1|hello\n"))
+	readTCPUntil(t, bob, bobReader, "hello")
+	bob.Close()
+	readTCPUntil(t, carol, carolReader, "房间")
+}
+
+func TestWaitingUsersCanLeaveQueue(t *testing.T) {
+	cfg := testConfig()
+	cfg.Manager.MaxRooms = 1
+	cfg.Manager.AssignStrategy = "random"
+	cfg.Chatroom.MaxUsers = 1
+	cfg.Manager.MaxWaiting = 3
+	c, addr := startTestServerWithConfig(t, cfg)
+
+	alice, _ := dialTestUser(t, addr)
+	dialWaiting := func(position string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		r := bufio.NewReader(conn)
+		// 等待中的用户只会收到自己的位置，不会收到每个房间已满的提示
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for position %s: %v", position, err)
+			}
+			if strings.Contains(line, "当前房间已满") {
+				t.Fatalf("waiting user got %q", line)
+			}
+			if strings.Contains(line, "你在等待队列中的第"+position+"位") {
+				return conn, r
+			}
+		}
+	}
+	bob, _ := dialWaiting("1")
+	carol, carolReader := dialWaiting("2")
+	dave, daveReader := dialWaiting("3")
+
+	// 等待中发送的消息只回复当前的位置
+	carol.Write([]byte("1|hello\n"))
+	readTCPUntil(t, carol, carolReader, "你在等待队列中的第2位")
+
+	// 断开连接和退出的用户都会被移出队列，后面的用户收到新的位置
+	bob.Close()
+	readTCPUntil(t, dave, daveReader, "你在等待队列中的第2位")
+	carol.Write([]byte("4\n"))
+	readTCPUntil(t, carol, carolReader, "Bye~")
+	readTCPUntil(t, dave, daveReader, "你在等待队列中的第1位")
+	if n := c.admission.Len(); n != 1 {
+		t.Fatalf("%d users waiting, want 1", n)
+	}
+
+	alice.Write([]byte("4\n"))
+	readTCPUntil(t, dave, daveReader, "房间")
+	dave.Write([]byte("1|hello\n"))
+	readTCPUntil(t, dave, daveReader, "hello")
+}
+
+// 分配房间时不持有队列的锁: 分配期间新用户可以排队，队首的用户离开时返回 admitAbandoned
+func TestAdmitNextAssignsOutsideQueueLock(t *testing.T) {
+	newWaitingUser := func(name string) *user.User {
+		server, client := net.Pipe()
+		go io.Copy(io.Discard, client)
+		u := user.NewUser(name, "127.0.0.1", name, server, user.NewSafeUserMap(), testConfig(), slog.Default())
+		t.Cleanup(func() {
+			u.Close()
+			client.Close()
+		})
+		return u
+	}
+	q := newAdmissionQueue(10)
+	alice, bob := newWaitingUser("alice"), newWaitingUser("bob")
+	q.push(alice)
+
+	assigning, release := make(chan struct{}), make(chan struct{})
+	results := make(chan admitResult, 1)
+	go func() {
+		_, result := q.admitNext(func(*user.User) bool {
+			close(assigning)
+			<-release
+			return true
+		})
+		results <- result
+	}()
+	<-assigning
+	if _, ok := q.push(bob); !ok {
+		t.Fatal("push blocked or failed while assigning")
+	}
+	if !q.remove(alice) {
+		t.Fatal("remove(alice) = false while assigning")
+	}
+	close(release)
+	if result := <-results; result != admitAbandoned {
+		t.Fatalf("admitNext = %v, want admitAbandoned", result)
+	}
+	if position, ok := q.position(bob); !ok || position != 1 {
+		t.Fatalf("bob at position %d (%v), want 1", position, ok)
+	}
+
+	if u, result := q.admitNext(func(*user.User) bool { return true }); u != bob || result != admitEntered {
+		t.Fatalf("admitNext = %v %v, want bob admitEntered", u, result)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("%d users waiting, want 0", q.Len())
+	}
+}
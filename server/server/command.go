@@ -0,0 +1,105 @@
+package server
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/account"
+	"chatroom/server/chatroom"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+)
+
+// 处理聊天室不认识的命令，实现 chatroom.CommandHandler
+// 用户在大厅中时 cr 为 nil
+func (c *ChatServer) HandleCommand(cr *chatroom.Chatroom, u *user.User, env *protocol.Envelope) bool {
+	switch env.Type {
+	case protocol.TypePrivate:
+		c.sendPrivate(u, env)
+	case protocol.TypeRead:
+		c.markRead(u, env)
+	case protocol.TypeReceipts:
+		c.setReceipts(u, env)
+	case protocol.TypeRegister:
+		c.register(u, env)
+	case protocol.TypeLogin:
+		c.login(cr, u, env)
+	case protocol.TypeNick:
+		c.nick(cr, u, env)
+	case protocol.TypeRooms:
+		c.listRooms(u, env)
+	case protocol.TypeCreateRoom:
+		c.createRoom(u, env)
+	case protocol.TypeJoin:
+		c.joinRoom(u, env)
+	case protocol.TypeLeave:
+		c.leaveRoom(u, env)
+	case protocol.TypeQuickJoin:
+		c.quickJoin(u, env)
+	case protocol.TypeResume:
+		c.resume(cr, u, env)
+	default:
+		return false
+	}
+	return true
+}
+
+// 注册账号，注册成功后还需要登录才会修改用户名
+func (c *ChatServer) register(u *user.User, env *protocol.Envelope) {
+	err := c.Accounts.Register(env.Name, env.Password)
+	if err != nil {
+		u.Send(protocol.NewError(env.ID, accountErrorMsg(err, env.Name)))
+		u.Logger().Info("register failed", "account", env.Name, logging.Err(err))
+		return
+	}
+	u.Logger().Info("account registered", "account", env.Name)
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("账号%s注册成功，请登录\n", env.Name)))
+}
+
+// 登录账号，登录成功后账号名成为该用户的名字
+func (c *ChatServer) login(cr *chatroom.Chatroom, u *user.User, env *protocol.Envelope) {
+	if u.Account != "" {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("你已经登录为%s\n", u.Account)))
+		return
+	}
+	if err := c.Accounts.Login(env.Name, env.Password); err != nil {
+		u.Send(protocol.NewError(env.ID, accountErrorMsg(err, env.Name)))
+		u.Logger().Info("login failed", "account", env.Name, logging.Err(err))
+		return
+	}
+	if !c.renameUser(cr, u, env.Name) {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("账号%s已经在线\n", env.Name)))
+		return
+	}
+	u.Account = env.Name
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("登录成功，你的名字是:%s\n", u.Name())))
+	c.deliverOffline(u)
+}
+
+// 修改用户名，用户在房间中时同时修改房间内的 key
+func (c *ChatServer) renameUser(cr *chatroom.Chatroom, u *user.User, newName string) bool {
+	if cr != nil {
+		return cr.RenameUser(u, newName)
+	}
+	if _, ok := c.userMap.Rename(u.Name(), newName); !ok {
+		return false
+	}
+	u.SetName(newName)
+	return true
+}
+
+// 账号错误对应的提示，不区分账号不存在和密码错误，避免泄露哪些账号存在
+func accountErrorMsg(err error, name string) string {
+	switch {
+	case errors.Is(err, account.ErrAccountExists):
+		return fmt.Sprintf("账号%s已经存在\n", name)
+	case errors.Is(err, account.ErrInvalidName):
+		return fmt.Sprintf("账号名不合法，长度不能超过%d，只能包含字母、数字和 _ - .，不能是保留的名字\n", account.MaxNameLength)
+	case errors.Is(err, account.ErrInvalidPassword):
+		return fmt.Sprintf("密码长度需要在%d到%d之间\n", account.MinPasswordLength, account.MaxPasswordLength)
+	case errors.Is(err, account.ErrAccountNotFound), errors.Is(err, account.ErrWrongPassword):
+		return "账号或密码错误\n"
+	default:
+		return "账号服务暂时不可用，请稍后再试\n"
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// 连接到测试服务器，等到分配房间之后返回
+func dialTestUser(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	readTCPUntil(t, conn, r, "房间")
+	return conn, r
+}
+
+func TestRegisterAndLoginRenamesUser(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("5|alice|secret1\n"))
+	readTCPUntil(t, alice, aliceReader, "注册成功")
+	alice.Write([]byte("6|alice|wrong-password\n"))
+	readTCPUntil(t, alice, aliceReader, "账号或密码错误")
+	alice.Write([]byte("6|alice|secret1\n"))
+	readTCPUntil(t, alice, aliceReader, "登录成功，你的名字是:alice")
+	alice.Write([]byte("3\n"))
+	readTCPUntil(t, alice, aliceReader, "你的名字是:alice")
+
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("2\n"))
+	readTCPUntil(t, bob, bobReader, "alice")
+	bob.Write([]byte("6|alice|secret1\n"))
+	readTCPUntil(t, bob, bobReader, "账号alice已经在线")
+	bob.Write([]byte("0|alice|hi alice\n"))
+	readTCPUntil(t, alice, aliceReader, "hi alice")
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/user"
+	"time"
+)
+
+// 每隔 Heartbeat.Interval 给需要心跳的用户发送 ping，Shutdown 时退出
+// 同时作为回收者，超时没有收到任何消息的用户当作半开的连接断开；没有心跳的用户按 Heartbeat.IdleTimeout 断开
+func (c *ChatServer) heartbeat() {
+	ticker := time.NewTicker(c.Config.Heartbeat.Interval)
+	defer ticker.Stop()
+	timeout := c.Config.Heartbeat.ReadTimeout()
+	idleTimeout := c.Config.Heartbeat.IdleTimeout
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			var silent []*user.User
+			c.userMap.Range(func(_, value any) bool {
+				u := value.(*user.User)
+				switch {
+				case !c.wantsHeartbeat(u):
+					// 不回复 ping 的客户端没法区分闲置和半开，只能等更长的时间
+					if idleTimeout > 0 && u.SinceLastRead() >= idleTimeout {
+						silent = append(silent, u)
+					}
+				case u.SinceLastRead() >= timeout:
+					silent = append(silent, u)
+				default:
+					u.Send(protocol.NewPing())
+				}
+				return true
+			})
+			for _, u := range silent {
+				c.reapTimedOut(u)
+			}
+		}
+	}
+}
+
+// JSON 协议的用户都有心跳；telnet 用户不会回复 ping，管道语法和还没有发送过消息的用户只有开启 heartbeat.pipe 时才有
+func (c *ChatServer) wantsHeartbeat(u *user.User) bool {
+	return u.Dialect() == protocol.DialectJSON || c.Config.Heartbeat.Pipe
+}
+
+// 断开心跳超时的用户，和读协程发现断线时的处理一样: 保存会话，通知房间，释放位置
+func (c *ChatServer) reapTimedOut(u *user.User) {
+	if u.IsClosed() || !u.MarkTimedOut() {
+		return
+	}
+	u.Logger().Info("heartbeat timed out")
+	if IChatroom, ok := c.IChatroomManager.UserRoom(u); ok {
+		if cr, ok := IChatroom.(*chatroom.Chatroom); ok {
+			c.HandleDisconnect(cr, u)
+			cr.TerminalUserConnect(u)
+			return
+		}
+	}
+	c.HandleDisconnect(nil, u)
+	c.terminalLobbyUser(u)
+}
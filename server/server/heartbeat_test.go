@@ -0,0 +1,122 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatPingPong(t *testing.T) {
+	cfg := testConfig()
+	cfg.Heartbeat.Interval = 100 * time.Millisecond
+	cfg.Heartbeat.Pipe = true
+	_, addr := startTestServerWithConfig(t, cfg)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	readTCPUntil(t, alice, aliceReader, "ping")
+	alice.Write([]byte("25\n"))
+	readTCPUntil(t, alice, aliceReader, "pong")
+}
+
+func TestSilentClientTimesOut(t *testing.T) {
+	cfg := testConfig()
+	cfg.Heartbeat.Interval = 100 * time.Millisecond
+	cfg.Heartbeat.MaxMissed = 2
+	cfg.Heartbeat.Pipe = true
+	c, addr := startTestServerWithConfig(t, cfg)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	bob, _ := dialTestUser(t, addr)
+	bobName := bob.LocalAddr().String()
+
+	// alice 回复每一个 ping，一直在线；bob 不发送任何消息，被当作半开的连接断开
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := aliceReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %s to time out: %v", bobName, err)
+		}
+		if strings.Contains(line, "ping") {
+			alice.Write([]byte("26\n"))
+		}
+		if strings.Contains(line, bobName+" 连接超时") {
+			break
+		}
+	}
+	// bob 被移出了房间和在线用户
+	if _, ok := c.userMap.GetUser(bobName); ok {
+		t.Fatalf("%s still online after timing out", bobName)
+	}
+	members := 0
+	for _, info := range c.IChatroomManager.ListRooms() {
+		members += info.Members
+	}
+	if members != 1 {
+		t.Fatalf("%d members in rooms after %s timed out, want 1", members, bobName)
+	}
+}
+
+func TestPipeClientsHaveNoHeartbeatByDefault(t *testing.T) {
+	cfg := testConfig()
+	cfg.Heartbeat.Interval = 50 * time.Millisecond
+	cfg.Heartbeat.MaxMissed = 2
+	c, addr := startTestServerWithConfig(t, cfg)
+
+	// telnet 用户不会回复 ping，闲置超过超时时间也不会被断开
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("3\n"))
+	readTCPUntil(t, bob, bobReader, "你的名字是")
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := c.userMap.GetUser(bob.LocalAddr().String()); !ok {
+		t.Fatal("idle pipe client was disconnected")
+	}
+	bob.Write([]byte("1|still here\n"))
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := bobReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "ping") {
+			t.Fatalf("pipe client got %q", line)
+		}
+		if strings.Contains(line, "still here") {
+			return
+		}
+	}
+}
+
+func TestSilentPipeClientIsReaped(t *testing.T) {
+	cfg := testConfig()
+	cfg.Heartbeat.Interval = 50 * time.Millisecond
+	cfg.Heartbeat.IdleTimeout = 300 * time.Millisecond
+	c, addr := startTestServerWithConfig(t, cfg)
+
+	// 没有心跳的管道用户不会收到 ping，但是半开的连接闲置超过 idle_timeout 之后被断开
+	bob, bobReader := dialTestUser(t, addr)
+	bobName := bob.LocalAddr().String()
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := bobReader.ReadString('\n')
+		if err != nil {
+			if os.IsTimeout(err) {
+				t.Fatalf("idle pipe client was not disconnected: %v", err)
+			}
+			break
+		}
+		if strings.Contains(line, "ping") {
+			t.Fatalf("pipe client got %q", line)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := c.userMap.GetUser(bobName); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still online after going idle", bobName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"chatroom/server/history"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestJoinReplaysRecentMessagesAndHistoryPagesBack(t *testing.T) {
+	// 连续发送的广播超过了默认的限流
+	cfg := testConfig()
+	cfg.RateLimit.BroadcastBurst = 0
+	c, addr := startTestServerWithConfig(t, cfg)
+	store := history.NewMemoryStore()
+	c.SetHistoryStore(store)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(alice, "1|msg-%02d\n", i)
+	}
+	readTCPUntil(t, alice, aliceReader, "msg-24")
+
+	// 聊天记录是异步写入的，等全部写入之后再往前翻
+	deadline := time.Now().Add(5 * time.Second)
+	for records, _ := store.Before(context.Background(), 1, time.Now().UnixMilli()+1, 0, 100); len(records) < 25; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d records flushed", len(records))
+		}
+		time.Sleep(10 * time.Millisecond)
+		records, _ = store.Before(context.Background(), 1, time.Now().UnixMilli()+1, 0, 100)
+	}
+
+	bob, bobReader := dialTestUser(t, addr)
+	readTCPUntil(t, bob, bobReader, "msg-05")
+	readTCPUntil(t, bob, bobReader, "msg-24")
+
+	bob.Write([]byte("7|3\n"))
+	readTCPUntil(t, bob, bobReader, "msg-02")
+	readTCPUntil(t, bob, bobReader, "msg-04")
+	readTCPUntil(t, bob, bobReader, "以上是3条")
+	bob.Write([]byte("7|10\n"))
+	readTCPUntil(t, bob, bobReader, "msg-00")
+	readTCPUntil(t, bob, bobReader, "以上是2条")
+	bob.Write([]byte("7\n"))
+	readTCPUntil(t, bob, bobReader, "没有更早的聊天记录了")
+}
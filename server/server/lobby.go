@@ -0,0 +1,66 @@
+package server
+
+import (
+	"chatroom/constants"
+	"chatroom/protocol"
+	"chatroom/server/metrics"
+	"chatroom/server/ratelimit"
+	"chatroom/server/user"
+	"chatroom/utils"
+	"fmt"
+	"io"
+)
+
+// 大厅: 用户离开房间之后所在的地方，只能处理房间之外的命令
+// 用户加入房间或者断开连接时返回
+func (c *ChatServer) lobbyHandle(u *user.User) {
+	for u.RoomId() == 0 {
+		msg, err := u.ReadMsg()
+		if u.IsClosed() {
+			return
+		}
+		if err == io.EOF || utils.CheckError(err, "Read") {
+			u.Logger().Info("user disconnected")
+			c.HandleDisconnect(nil, u)
+			c.terminalLobbyUser(u)
+			return
+		}
+		env, err := protocol.Parse(u.Dialect(), msg)
+		if err != nil {
+			u.Send(protocol.NewError("", "你的消息格式不对，请重新输入.\n"+constants.DynamicConstIntroduceStr()))
+			continue
+		}
+		metrics.Messages.WithLabelValues(env.Type).Inc()
+		if verdict := u.CheckRate(env); verdict != ratelimit.Allow {
+			if verdict == ratelimit.Disconnect {
+				c.terminalLobbyUser(u)
+				return
+			}
+			continue
+		}
+		switch env.Type {
+		case protocol.TypeQuit:
+			u.Send(protocol.NewAck(env.ID, fmt.Sprintf("Bye~ %s\n", u.Name())))
+			c.terminalLobbyUser(u)
+		case protocol.TypeMyName:
+			u.Send(protocol.NewAck(env.ID, fmt.Sprintf("你的名字是:%s\n", u.Name())))
+		case protocol.TypePing:
+			u.Send(protocol.NewPong(env.ID))
+		case protocol.TypePong:
+		case protocol.TypeBroadcast, protocol.TypeShow, protocol.TypeHistory,
+			protocol.TypeModerator, protocol.TypeMute, protocol.TypeKick, protocol.TypeBan, protocol.TypeUnban,
+			protocol.TypeAway, protocol.TypeBack, protocol.TypeTyping:
+			u.Send(protocol.NewError(env.ID, "你当前在大厅中，请先加入聊天室\n"))
+		default:
+			if !c.HandleCommand(nil, u, env) {
+				u.Send(protocol.NewError(env.ID, constants.DynamicConstIntroduceStr()))
+			}
+		}
+	}
+}
+
+// 大厅中的用户退出连接时，所做的后处理
+func (c *ChatServer) terminalLobbyUser(u *user.User) {
+	c.userMap.DeleteUser(u.Name())
+	u.Close()
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"chatroom/server/metrics"
+	"chatroom/utils"
+	"errors"
+	"net/http"
+)
+
+// 在 addr 上以 Prometheus 文本格式输出 /metrics
+func (c *ChatServer) StartMetrics(addr string) {
+	c.logger.Info("metrics listening", "addr", addr)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	httpServer := &http.Server{Addr: addr, Handler: mux}
+	if !c.addHTTPServer(httpServer) {
+		return
+	}
+	err := httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	utils.CheckError(err, "Metrics Listener")
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"chatroom/server/metrics"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogram 中记录的样本数
+func histogramCount(h prometheus.Histogram) uint64 {
+	var m dto.Metric
+	h.Write(&m)
+	return m.GetHistogram().GetSampleCount()
+}
+
+// 等待 get 的值变成 want
+func waitMetric(t *testing.T, name string, get func() float64, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, want %v", name, get(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerUpdatesMetrics(t *testing.T) {
+	c, addr := startTestServer(t)
+	users := testutil.ToFloat64(metrics.ConnectedUsers)
+	broadcasts := testutil.ToFloat64(metrics.Messages.WithLabelValues("broadcast"))
+	fanouts := histogramCount(metrics.BroadcastFanoutSeconds)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	bob, bobReader := dialTestUser(t, addr)
+	waitMetric(t, "connected_users", func() float64 { return testutil.ToFloat64(metrics.ConnectedUsers) }, users+2)
+
+	alice.Write([]byte("1|hi bob\n"))
+	readTCPUntil(t, bob, bobReader, "hi bob")
+	if got := testutil.ToFloat64(metrics.Messages.WithLabelValues("broadcast")); got != broadcasts+1 {
+		t.Fatalf("broadcast messages = %v, want %v", got, broadcasts+1)
+	}
+	waitMetric(t, "broadcast_fanout_seconds_count", func() float64 { return float64(histogramCount(metrics.BroadcastFanoutSeconds)) }, float64(fanouts+1))
+
+	rooms := c.IChatroomManager.ListRooms()
+	if got := testutil.ToFloat64(metrics.Rooms); got != float64(len(rooms)) {
+		t.Fatalf("rooms = %v, want %d", got, len(rooms))
+	}
+	room := strconv.Itoa(rooms[0].ID)
+	if got := testutil.ToFloat64(metrics.RoomMembers.WithLabelValues(room)); got != 2 {
+		t.Fatalf("room_members{room=%s} = %v, want 2", room, got)
+	}
+
+	alice.Write([]byte("4\n"))
+	readTCPUntil(t, alice, aliceReader, "Bye~")
+	waitMetric(t, "room_members", func() float64 { return testutil.ToFloat64(metrics.RoomMembers.WithLabelValues(room)) }, 1)
+	waitMetric(t, "connected_users", func() float64 { return testutil.ToFloat64(metrics.ConnectedUsers) }, users+1)
+}
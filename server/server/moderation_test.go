@@ -0,0 +1,121 @@
+package server
+
+import (
+	"chatroom/server/moderation"
+	"testing"
+)
+
+// 房主任命管理员，管理员禁言和封禁普通成员，被封禁的IP不能再进入该聊天室，所有操作都记录在审计日志中
+func TestModeratorMutesAndBans(t *testing.T) {
+	c, addr := startTestServer(t)
+	store := moderation.NewMemoryStore()
+	c.SetModerationStore(store)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+	carol, carolReader := dialTestUser(t, addr)
+	carol.Write([]byte("10|dev\n"))
+	readTCPUntil(t, carol, carolReader, "已加入ID为")
+	bobName, carolName := bob.LocalAddr().String(), carol.LocalAddr().String()
+
+	bob.Write([]byte("15|" + carolName + "|1h\n"))
+	readTCPUntil(t, bob, bobReader, "只有房主和管理员可以管理聊天室")
+	alice.Write([]byte("14|" + bobName + "\n"))
+	readTCPUntil(t, carol, carolReader, "被 "+alice.LocalAddr().String()+" 任命为管理员")
+
+	bob.Write([]byte("15|" + carolName + "|1h\n"))
+	readTCPUntil(t, carol, carolReader, "禁言1h0m0s")
+	carol.Write([]byte("1|can anyone hear me\n"))
+	readTCPUntil(t, carol, carolReader, "你在该聊天室中被禁言")
+	bob.Write([]byte("16|" + alice.LocalAddr().String() + "\n"))
+	readTCPUntil(t, bob, bobReader, "不能管理房主或者其他管理员")
+
+	bob.Write([]byte("17|" + carolName + "\n"))
+	readTCPUntil(t, carol, carolReader, "中封禁，你已回到大厅")
+	readTCPUntil(t, alice, aliceReader, carolName+" 被 "+bobName+" 按IP封禁")
+	// 未登录的用户按IP封禁，同一IP下的其他用户也会被挡在外面，管理员收到明确的提示
+	readTCPUntil(t, bob, bobReader, "已按IP 127.0.0.1 封禁，该IP下其他未登录的用户也不能进入该聊天室")
+	// 被移出之前已经在读的那条消息不再由原来的房间处理
+	carol.Write([]byte("3\n"))
+	readTCPUntil(t, carol, carolReader, "你已经不在该聊天室中")
+	carol.Write([]byte("10|dev\n"))
+	readTCPUntil(t, carol, carolReader, "你已被禁止进入该聊天室")
+
+	alice.Write([]byte("18|127.0.0.1\n"))
+	readTCPUntil(t, alice, aliceReader, "已解除对127.0.0.1的封禁")
+	carol.Write([]byte("10|dev\n"))
+	readTCPUntil(t, carol, carolReader, "已加入ID为")
+
+	var actions []string
+	for _, entry := range store.Entries() {
+		actions = append(actions, entry.Action)
+	}
+	want := []string{moderation.ActionModerator, moderation.ActionMute, moderation.ActionBan, moderation.ActionUnban}
+	if len(actions) != len(want) {
+		t.Fatalf("audit log = %v, want %v", actions, want)
+	}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("audit log = %v, want %v", actions, want)
+		}
+	}
+}
+
+// 被移出的成员回到大厅，可以重新加入
+func TestOwnerKicksMember(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+
+	alice.Write([]byte("16|" + bob.LocalAddr().String() + "\n"))
+	readTCPUntil(t, bob, bobReader, "中移出，你已回到大厅")
+	readTCPUntil(t, alice, aliceReader, "移出了聊天室")
+	bob.Write([]byte("1|still here?\n"))
+	readTCPUntil(t, bob, bobReader, "你已经不在该聊天室中")
+	bob.Write([]byte("1|still here?\n"))
+	readTCPUntil(t, bob, bobReader, "你当前在大厅中")
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+}
+
+// 角色和禁言属于用户本身，不属于名字: 改名躲不过禁言，房主离开之后别人改成它的名字也不是房主
+func TestRolesDoNotFollowNames(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("24|boss\n"))
+	readTCPUntil(t, alice, aliceReader, "你的名字已改为:boss")
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+	carol, carolReader := dialTestUser(t, addr)
+	carol.Write([]byte("10|dev\n"))
+	readTCPUntil(t, carol, carolReader, "已加入ID为")
+
+	alice.Write([]byte("15|" + carol.LocalAddr().String() + "|1h\n"))
+	readTCPUntil(t, carol, carolReader, "禁言1h0m0s")
+	carol.Write([]byte("24|carol\n"))
+	readTCPUntil(t, carol, carolReader, "你的名字已改为:carol")
+	carol.Write([]byte("1|renamed, can you hear me\n"))
+	readTCPUntil(t, carol, carolReader, "你在该聊天室中被禁言")
+
+	alice.Write([]byte("4\n"))
+	readTCPUntil(t, carol, carolReader, "boss 断开了连接")
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("24|boss\n"))
+	readTCPUntil(t, bob, bobReader, "你的名字已改为:boss")
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+	bob.Write([]byte("16|carol\n"))
+	readTCPUntil(t, bob, bobReader, "只有房主和管理员可以管理聊天室")
+	bob.Write([]byte("15|carol|0s\n"))
+	readTCPUntil(t, bob, bobReader, "只有房主和管理员可以管理聊天室")
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+)
+
+// 修改名字: 新名字在整个服务器内唯一，全局 SafeUserMap 和房间内的 key 一起修改
+// 登录的用户的名字就是账号名，不能修改
+func (c *ChatServer) nick(cr *chatroom.Chatroom, u *user.User, env *protocol.Envelope) {
+	if u.Account != "" {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("你已经登录为%s，登录用户的名字就是账号名，不能修改\n", u.Account)))
+		return
+	}
+	if err := user.ValidateName(env.Name, c.Config.User.MaxNickLength); err != nil {
+		u.Send(protocol.NewError(env.ID, nickErrorMsg(err, c.Config.User.MaxNickLength)))
+		return
+	}
+	if env.Name == u.Name() {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("你的名字已经是%s\n", env.Name)))
+		return
+	}
+	// 账号名留给账号的主人，否则它登录时会因为名字被占用而失败
+	exists, err := c.Accounts.Exists(env.Name)
+	if err != nil {
+		u.Logger().Error("check nick against accounts failed", "nick", env.Name, logging.Err(err))
+		u.Send(protocol.NewError(env.ID, "账号服务暂时不可用，请稍后再试\n"))
+		return
+	}
+	if exists {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("名字%s已经被注册为账号，请换一个名字\n", env.Name)))
+		return
+	}
+	oldName := u.Name()
+	if !c.renameUser(cr, u, env.Name) {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("名字%s已经被使用\n", env.Name)))
+		return
+	}
+	u.Logger().Info("nick changed", "old_name", oldName)
+	if cr != nil {
+		cr.Notice(fmt.Sprintf("%s 改名为 %s", oldName, u.Name()))
+	}
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("你的名字已改为:%s\n", u.Name())))
+}
+
+// 名字不合法时的提示
+func nickErrorMsg(err error, maxLength int) string {
+	switch {
+	case errors.Is(err, user.ErrNameLength):
+		return fmt.Sprintf("名字的长度需要在1到%d个字符之间\n", maxLength)
+	case errors.Is(err, user.ErrNameReserved):
+		return "该名字是保留的名字，请换一个名字\n"
+	default:
+		return "名字只能包含字母、数字和 _ - .\n"
+	}
+}
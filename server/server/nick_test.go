@@ -0,0 +1,46 @@
+package server
+
+import "testing"
+
+func TestNickRenamesUserServerWide(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	aliceAddr := alice.LocalAddr().String()
+	bob, bobReader := dialTestUser(t, addr)
+
+	alice.Write([]byte("24|小爱\n"))
+	readTCPUntil(t, alice, aliceReader, "你的名字已改为:小爱")
+	readTCPUntil(t, bob, bobReader, aliceAddr+" 改名为 小爱")
+	bob.Write([]byte("0|小爱|hi\n"))
+	readTCPUntil(t, alice, aliceReader, "hi")
+	bob.Write([]byte("2\n"))
+	readTCPUntil(t, bob, bobReader, "小爱")
+
+	bob.Write([]byte("24|小爱\n"))
+	readTCPUntil(t, bob, bobReader, "名字小爱已经被使用")
+	// 大厅中也可以改名，房间之外的用户也不能重名
+	bob.Write([]byte("11\n"))
+	readTCPUntil(t, bob, bobReader, "你已回到大厅")
+	bob.Write([]byte("24|bob\n"))
+	readTCPUntil(t, bob, bobReader, "你的名字已改为:bob")
+	alice.Write([]byte("24|bob\n"))
+	readTCPUntil(t, alice, aliceReader, "名字bob已经被使用")
+
+	alice.Write([]byte("5|carol|secret1\n"))
+	readTCPUntil(t, alice, aliceReader, "注册成功")
+	alice.Write([]byte("24|carol\n"))
+	readTCPUntil(t, alice, aliceReader, "已经被注册为账号")
+}
+
+func TestNickLengthFromConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.User.MaxNickLength = 4
+	_, addr := startTestServerWithConfig(t, cfg)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("24|alice\n"))
+	readTCPUntil(t, alice, aliceReader, "名字的长度需要在1到4个字符之间")
+	alice.Write([]byte("24|ali\n"))
+	readTCPUntil(t, alice, aliceReader, "你的名字已改为:ali")
+}
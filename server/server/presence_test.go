@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceEvents(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	aliceName := alice.LocalAddr().String()
+	bob, bobReader := dialTestUser(t, addr)
+	bobName := bob.LocalAddr().String()
+	readTCPUntil(t, alice, aliceReader, bobName+" 进入了聊天室")
+
+	alice.Write([]byte("21|lunch\n"))
+	readTCPUntil(t, bob, bobReader, aliceName+" 暂时离开: lunch")
+	bob.Write([]byte("2\n"))
+	readTCPUntil(t, bob, bobReader, aliceName+" [暂时离开: lunch]")
+
+	alice.Write([]byte("23\n"))
+	readTCPUntil(t, bob, bobReader, aliceName+" 正在输入...")
+	alice.Write([]byte("22\n"))
+	readTCPUntil(t, bob, bobReader, aliceName+" 回来了")
+	alice.Write([]byte("22\n"))
+	readTCPUntil(t, alice, aliceReader, "你当前没有离开")
+
+	bob.Write([]byte("11\n"))
+	readTCPUntil(t, alice, aliceReader, bobName+" 离开了聊天室")
+
+	carol, _ := dialTestUser(t, addr)
+	carolName := carol.LocalAddr().String()
+	readTCPUntil(t, alice, aliceReader, carolName+" 进入了聊天室")
+	carol.Close()
+	readTCPUntil(t, alice, aliceReader, carolName+" 断开了连接")
+}
+
+func TestIdleMembersMarkedAway(t *testing.T) {
+	cfg := testConfig()
+	cfg.Chatroom.IdleAwayAfter = 200 * time.Millisecond
+	_, addr := startTestServerWithConfig(t, cfg)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	aliceName := alice.LocalAddr().String()
+	bob, bobReader := dialTestUser(t, addr)
+	readTCPUntil(t, bob, bobReader, aliceName+" 空闲")
+	bob.Write([]byte("2\n"))
+	readTCPUntil(t, bob, bobReader, aliceName+" [空闲]")
+
+	// 空闲的成员发送任何消息都会回来
+	alice.Write([]byte("1|hi\n"))
+	readTCPUntil(t, bob, bobReader, aliceName+" 回来了")
+	readTCPUntil(t, alice, aliceReader, "hi")
+}
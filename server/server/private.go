@@ -0,0 +1,99 @@
+package server
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/offline"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+)
+
+// 设置离线私聊的存储，默认使用 mongo 中的 offline_messages 集合
+func (c *ChatServer) SetOfflineStore(store offline.Store) {
+	c.mailbox = offline.New(store, c.Config.User.MaxOfflineMessages, c.Config.Mongo.Timeout)
+}
+
+// 私聊: 分配消息ID和序号之后回复发送者，接收者在线时不管它在哪个房间都直接送达
+// 接收者不在线但是已经注册了账号时保存为离线私聊，等它下次登录时送达
+func (c *ChatServer) sendPrivate(u *user.User, env *protocol.Envelope) {
+	msg := protocol.NewMessage(u.RoomId(), u.Name(), env.To, env.Body+"\n")
+	msg.MsgID, msg.Seq = user.NewMessageID(), c.privateSeq.Add(1)
+	if distUser, ok := c.userMap.GetUser(env.To); ok {
+		u.Accepted(env.ID, msg)
+		distUser.PrivateMsgHandler(msg)
+		return
+	}
+	exists, err := c.Accounts.Exists(env.To)
+	if err != nil {
+		u.Logger().Error("find private message recipient failed", "to", env.To, logging.Err(err))
+		u.Send(protocol.NewError(env.ID, "私聊暂时不可用，请稍后再试\n"))
+		return
+	}
+	if !exists {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("你发送的%s不存在\n", env.To)))
+		u.Logger().Debug("private message recipient not found", "to", env.To)
+		return
+	}
+	if err := c.mailbox.Save(msg); err != nil {
+		reply := "离线消息保存失败，请稍后再试\n"
+		if errors.Is(err, offline.ErrMailboxFull) {
+			reply = fmt.Sprintf("%s的离线消息已满\n", env.To)
+		} else {
+			u.Logger().Error("save offline message failed", "to", env.To, logging.Err(err))
+		}
+		u.Send(protocol.NewError(env.ID, reply))
+		return
+	}
+	u.Logger().Debug("offline message saved", "to", env.To)
+	ack := protocol.NewAck(env.ID, fmt.Sprintf("%s不在线，消息%s会在对方下次登录时送达\n", env.To, msg.MsgID))
+	ack.Seq, ack.MsgID = msg.Seq, msg.MsgID
+	u.Send(ack)
+}
+
+// 接收者告诉发送者私聊已读，没有指定消息ID时所有送达的私聊都标记为已读
+func (c *ChatServer) markRead(u *user.User, env *protocol.Envelope) {
+	n := u.MarkRead(env.MsgID)
+	if n == 0 && env.MsgID != "" {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("没有ID为%s的未读私聊\n", env.MsgID)))
+		return
+	}
+	if env.ID != "" {
+		u.Send(protocol.NewAck(env.ID, fmt.Sprintf("已读%d条私聊\n", n)))
+	}
+}
+
+// 开启或关闭发送确认和回执
+func (c *ChatServer) setReceipts(u *user.User, env *protocol.Envelope) {
+	switch env.Body {
+	case "on":
+		u.SetReceipts(true)
+		u.Send(protocol.NewAck(env.ID, "已开启发送确认和回执\n"))
+	case "off":
+		u.SetReceipts(false)
+		u.Send(protocol.NewAck(env.ID, "已关闭发送确认和回执\n"))
+	default:
+		u.Send(protocol.NewError(env.ID, "请使用 on 或 off 开启或关闭发送确认和回执\n"))
+	}
+}
+
+// 登录或恢复会话之后，先提示有多少条离线私聊，再按发送顺序送达
+// 读取失败时离线私聊留在存储中，下次登录时再送达
+func (c *ChatServer) deliverOffline(u *user.User) {
+	if u.Account == "" {
+		return
+	}
+	msgs, err := c.mailbox.Take(u.Account)
+	if err != nil {
+		u.Logger().Error("take offline messages failed", logging.Err(err))
+		u.Send(protocol.NewNotice(u.RoomId(), "离线消息暂时无法读取，下次登录时会再次送达\n"))
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	u.Send(protocol.NewNotice(u.RoomId(), fmt.Sprintf("你有%d条离线消息:\n", len(msgs))))
+	for _, msg := range msgs {
+		u.PrivateMsgHandler(msg)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivateMessageAcrossRooms(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("0|" + alice.LocalAddr().String() + "|hi from another room\n"))
+	readTCPUntil(t, alice, aliceReader, "hi from another room")
+
+	alice.Write([]byte("11\n"))
+	readTCPUntil(t, alice, aliceReader, "你已回到大厅")
+	alice.Write([]byte("0|" + bob.LocalAddr().String() + "|hi from the lobby\n"))
+	readTCPUntil(t, bob, bobReader, "hi from the lobby")
+
+	bob.Write([]byte("0|nobody|hi\n"))
+	readTCPUntil(t, bob, bobReader, "你发送的nobody不存在")
+}
+
+func TestOfflineMessagesDeliveredOnLogin(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	carol, carolReader := dialTestUser(t, addr)
+	carol.Write([]byte("5|carol|secret1\n"))
+	readTCPUntil(t, carol, carolReader, "注册成功")
+
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("0|carol|first\n"))
+	readTCPUntil(t, bob, bobReader, "carol不在线")
+	bob.Write([]byte("0|carol|second\n"))
+	readTCPUntil(t, bob, bobReader, "carol不在线")
+
+	carol.Write([]byte("6|carol|secret1\n"))
+	readTCPUntil(t, carol, carolReader, "登录成功")
+	readTCPUntil(t, carol, carolReader, "你有2条离线消息")
+	readTCPUntil(t, carol, carolReader, "first")
+	readTCPUntil(t, carol, carolReader, "second")
+
+	// 登录之后的私聊直接送达，不再保存为离线私聊
+	bob.Write([]byte("0|carol|online now\n"))
+	readTCPUntil(t, carol, carolReader, "online now")
+}
+
+func TestPrivateMessageReceipts(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	bob, bobReader := dialTestUser(t, addr)
+	bobName := bob.LocalAddr().String()
+
+	// 管道语法的用户默认没有发送确认和回执，输出和原来一样
+	alice.Write([]byte("0|" + bobName + "|default\n"))
+	readTCPUntil(t, bob, bobReader, "default")
+	alice.Write([]byte("1|hello\n"))
+	if line := readTCPUntil(t, alice, aliceReader, "hello"); !strings.Contains(line, "hello") {
+		t.Fatalf("got %q", line)
+	}
+	alice.Write([]byte("3\n"))
+	readTCPUntil(t, alice, aliceReader, "你的名字是")
+	bob.Write([]byte("19\n"))
+	bob.Write([]byte("1|done\n"))
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := aliceReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "消息") {
+			t.Fatalf("pipe client got %q without turning receipts on", line)
+		}
+		if strings.Contains(line, "done") {
+			break
+		}
+	}
+
+	alice.Write([]byte("20|on\n"))
+	readTCPUntil(t, alice, aliceReader, "已开启发送确认和回执")
+	alice.Write([]byte("0|" + bobName + "|hi bob\n"))
+	ack := readTCPUntil(t, alice, aliceReader, "消息已发送，ID:")
+	msgID := strings.TrimSpace(strings.TrimPrefix(ack, "消息已发送，ID:"))
+	readTCPUntil(t, bob, bobReader, "hi bob")
+	readTCPUntil(t, alice, aliceReader, "消息"+msgID+"已送达")
+
+	bob.Write([]byte("19|nope\n"))
+	readTCPUntil(t, bob, bobReader, "没有ID为nope的未读私聊")
+	bob.Write([]byte("19|" + msgID + "\n"))
+	readTCPUntil(t, alice, aliceReader, "消息"+msgID+"已读")
+
+	// 关闭之后不再收到发送确认和回执，只有聊天消息
+	alice.Write([]byte("20|off\n"))
+	readTCPUntil(t, alice, aliceReader, "已关闭发送确认和回执")
+	alice.Write([]byte("0|" + bobName + "|quiet\n"))
+	readTCPUntil(t, bob, bobReader, "quiet")
+	alice.Write([]byte("1|ping\n"))
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := aliceReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "消息已发送") || strings.Contains(line, "已送达") {
+			t.Fatalf("got %q after turning receipts off", line)
+		}
+		if strings.Contains(line, "ping") {
+			break
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"chatroom/logging"
+	"chatroom/server/metrics"
+	"chatroom/server/ratelimit"
+	"chatroom/utils"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// 为连接的IP占用一个名额，超过 rate_limit.max_conns_per_ip 时提示后关闭该连接
+// 返回的 release 在连接关闭时调用
+func (c *ChatServer) acquireConn(conn net.Conn) (release func(), ok bool) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	if !c.connLimiter.Acquire(ip) {
+		metrics.RateLimited.WithLabelValues("reject_conn").Inc()
+		c.logger.Warn("too many connections from ip", logging.KeyRemoteAddr, conn.RemoteAddr().String())
+		// TLS 连接在写入时才握手，不等待迟迟不握手的客户端
+		conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+		utils.SendMessage(conn, "来自你的IP的连接数已经达到上限\n")
+		conn.Close()
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { c.connLimiter.Release(ip) }) }, true
+}
+
+// 为用户创建限流状态
+func (c *ChatServer) newLimiter() *ratelimit.Limiter {
+	return ratelimit.NewLimiter(c.Config.RateLimit, ratelimit.RealClock{})
+}
+
+// 关闭时释放IP名额的连接
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (l *limitedConn) Close() error {
+	l.release()
+	return l.Conn.Close()
+}
+
+// 实现 tlsConnectionStater，明文连接时返回零值
+func (l *limitedConn) ConnectionState() tls.ConnectionState {
+	if stater, ok := l.Conn.(tlsConnectionStater); ok {
+		return stater.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 超过广播的限制之后先警告，再禁言，禁言期间命令不受影响
+func TestRateLimitWarnsThenMutes(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit.BroadcastBurst = 2
+	cfg.RateLimit.BroadcastInterval = time.Hour
+	cfg.RateLimit.MuteAfter = 2
+	cfg.RateLimit.MuteFor = time.Hour
+	cfg.RateLimit.MaxMutes = 1
+	_, addr := startTestServerWithConfig(t, cfg)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	bob, bobReader := dialTestUser(t, addr)
+	alice.Write([]byte("1|one\n1|two\n1|three\n"))
+	readTCPUntil(t, bob, bobReader, "one")
+	readTCPUntil(t, bob, bobReader, "two")
+	readTCPUntil(t, alice, aliceReader, "你发送得太快了，请稍后再试")
+	alice.Write([]byte("1|four\n"))
+	readTCPUntil(t, alice, aliceReader, "已被禁言3600秒")
+	alice.Write([]byte("1|five\n"))
+	readTCPUntil(t, alice, aliceReader, "你正在被禁言")
+	alice.Write([]byte("3\n"))
+	readTCPUntil(t, alice, aliceReader, "你的名字是")
+
+	// bob 没有收到被限流的消息
+	bob.Write([]byte("1|marker\n"))
+	line := readTCPUntil(t, bob, bobReader, "marker")
+	if line != "marker\n" {
+		t.Fatalf("bob received %q before marker", line)
+	}
+}
+
+// 用完禁言次数之后再超过限制就断开连接，该用户离开房间
+func TestRateLimitDisconnects(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit.PrivateBurst = 1
+	cfg.RateLimit.PrivateInterval = time.Hour
+	cfg.RateLimit.MuteAfter = 1
+	cfg.RateLimit.MaxMutes = 0
+	c, addr := startTestServerWithConfig(t, cfg)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("0|nobody|hi\n0|nobody|hi\n"))
+	readTCPUntil(t, alice, aliceReader, "已被断开连接")
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(aliceReader); err != nil {
+		t.Fatalf("connection was not closed: %v", err)
+	}
+	waitMembers(t, c, 0)
+}
+
+// 同一个IP的连接数达到上限之后拒绝新的连接，断开之后释放名额
+func TestMaxConnsPerIP(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit.MaxConnsPerIP = 2
+	c, addr := startTestServerWithConfig(t, cfg)
+
+	first, _ := dialTestUser(t, addr)
+	dialTestUser(t, addr)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readTCPUntil(t, conn, bufio.NewReader(conn), "连接数已经达到上限")
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.connLimiter.Conns("127.0.0.1") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection slot not released, %d in use", c.connLimiter.Conns("127.0.0.1"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialTestUser(t, addr)
+}
+
+// 等待所有房间的成员数之和变为 want
+func waitMembers(t *testing.T, c *ChatServer, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		members := 0
+		for _, room := range c.IChatroomManager.ListRooms() {
+			members += room.Members
+		}
+		if members == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d members in rooms, want %d", members, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"chatroom/config"
+	"chatroom/logging"
+)
+
+// 热更新运行时的容量限制: 最大房间数、等待队列的长度、每个房间的容量和消息环的大小，分配房间的策略，以及日志级别和是否隐藏消息体
+// 监听地址、TLS、数据库、限流、自动空闲、心跳、用户的发送队列等其他配置只在启动时生效，修改它们需要重启服务器
+func (c *ChatServer) Reload(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Server != c.Config.Server || cfg.Mongo != c.Config.Mongo || cfg.History.Persist != c.Config.History.Persist ||
+		cfg.History.BufferSize != c.Config.History.BufferSize || cfg.History.FlushBatchSize != c.Config.History.FlushBatchSize ||
+		cfg.RateLimit != c.Config.RateLimit || cfg.Chatroom.IdleAwayAfter != c.Config.Chatroom.IdleAwayAfter ||
+		cfg.Heartbeat != c.Config.Heartbeat || cfg.User != c.Config.User {
+		c.logger.Warn("only limits are reloaded, restart to apply server, mongo, history, rate_limit, idle_away_after, heartbeat and user changes")
+	}
+	logging.Apply(cfg.Log)
+	c.IChatroomManager.ApplyLimits(cfg)
+	c.admission.setMax(cfg.Manager.MaxWaiting)
+	// 最大房间数和房间容量变大之后可能可以让等待中的用户进入
+	c.admission.signal()
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// 用户不断进入房间的同时热更新容量限制，调低容量不会移出任何人，只是不再接受新的用户
+func TestReloadWhileUsersJoin(t *testing.T) {
+	c, addr := startTestServer(t)
+
+	const users = 20
+	var reloads sync.WaitGroup
+	stop := make(chan struct{})
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cfg := testConfig()
+			cfg.Chatroom.MaxUsers = 1 + i%4
+			cfg.Chatroom.RingCapacity = 20 + i%5
+			cfg.History.ReplaySize = 10
+			if err := c.Reload(cfg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var joins sync.WaitGroup
+	for i := 0; i < users; i++ {
+		joins.Add(1)
+		go func() {
+			defer joins.Done()
+			dialTestUser(t, addr)
+		}()
+	}
+	joins.Wait()
+	close(stop)
+	reloads.Wait()
+
+	members := 0
+	for _, room := range c.IChatroomManager.ListRooms() {
+		members += room.Members
+	}
+	if members != users {
+		t.Fatalf("%d users in rooms after reloads, want %d", members, users)
+	}
+
+	// 最后一次热更新的容量是随机的，先恢复默认的容量
+	if err := c.Reload(testConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 调低容量之后，超过容量的房间保留所有人，但是不再接受新的用户
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+
+	cfg := testConfig()
+	cfg.Chatroom.MaxUsers = 1
+	if err := c.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	carol, carolReader := dialTestUser(t, addr)
+	carol.Write([]byte("10|dev\n"))
+	readTCPUntil(t, carol, carolReader, "聊天室已满")
+	alice.Write([]byte("1|still here\n"))
+	readTCPUntil(t, bob, bobReader, "still here")
+	carol.Write([]byte("8\n"))
+	readTCPUntil(t, carol, carolReader, fmt.Sprintf("名字:dev 人数:2/%d", cfg.Chatroom.MaxUsers))
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	c, _ := startTestServer(t)
+	cfg := testConfig()
+	cfg.Chatroom.MaxUsers = 0
+	if err := c.Reload(cfg); err == nil {
+		t.Fatal("Reload accepted max_users = 0")
+	}
+	if rooms := c.IChatroomManager.ListRooms(); rooms[0].Capacity != testConfig().Chatroom.MaxUsers {
+		t.Fatalf("capacity = %d after rejected reload", rooms[0].Capacity)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"chatroom/constants"
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/chatroom_manager"
+	"chatroom/server/session"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+)
+
+// 给新连接的用户下发重连令牌，断线后在宽限期内可以用它恢复会话
+func (c *ChatServer) issueResumeToken(u *user.User) {
+	u.ResumeToken = session.NewToken()
+	u.Send(protocol.NewSession(u.ResumeToken, fmt.Sprintf("你的重连令牌是:%s，断线后%d秒内重新连接并发送 %d|<token> 可以恢复会话\n",
+		u.ResumeToken, int(c.Config.Server.ResumeGracePeriod.Seconds()), constants.ResumeOption)))
+}
+
+// 用户的连接异常断开，保存它的会话，实现 chatroom.CommandHandler
+// 用户在大厅中时 cr 为 nil，恢复时只恢复名字和账号
+func (c *ChatServer) HandleDisconnect(cr *chatroom.Chatroom, u *user.User) {
+	if u.ResumeToken == "" {
+		return
+	}
+	s := &session.Session{
+		Token:    u.ResumeToken,
+		UserName: u.Name(),
+		UserID:   u.ID(),
+		Account:  u.Account,
+	}
+	if cr != nil {
+		s.RoomId = cr.RoomId
+		s.LastSeenSeq = cr.LastSeen()
+		cr.Reserve()
+	}
+	c.sessions.Suspend(s)
+	u.Logger().Info("session suspended", logging.KeyRoomID, s.RoomId)
+}
+
+// 使用重连令牌恢复断线前的名字、账号和房间，并补发断线期间错过的消息
+func (c *ChatServer) resume(cr *chatroom.Chatroom, u *user.User, env *protocol.Envelope) {
+	if u.Account != "" {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("你已经登录为%s，不能再恢复会话\n", u.Account)))
+		return
+	}
+	s, ok := c.sessions.Resume(env.Token)
+	if !ok {
+		u.Send(protocol.NewError(env.ID, "重连令牌无效或已过期\n"))
+		return
+	}
+	// 回到原来的房间之后再释放，避免房间在这之间被删除
+	defer c.releaseRoom(s.RoomId)
+	if s.UserName != u.Name() && !c.renameUser(cr, u, s.UserName) {
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("用户%s已经在线\n", s.UserName)))
+		return
+	}
+	u.Account = s.Account
+	u.ResumeToken = s.Token
+	// 断线期间发给该账号的私聊保存成了离线私聊，恢复完成之后送达
+	defer c.deliverOffline(u)
+	u.Logger().Info("session resumed", logging.KeyRoomID, s.RoomId)
+	if s.RoomId == 0 {
+		u.Send(protocol.NewAck(env.ID, fmt.Sprintf("会话已恢复，你的名字是:%s\n", u.Name())))
+		return
+	}
+	IChatroom, err := c.IChatroomManager.ResumeRoom(u, s.RoomId, s.LastSeenSeq)
+	if err != nil {
+		msg := "原来的聊天室已满"
+		if errors.Is(err, chatroom_manager.ErrRoomNotFound) {
+			msg = "原来的聊天室已经关闭"
+		}
+		u.Send(protocol.NewAck(env.ID, fmt.Sprintf("会话已恢复，你的名字是:%s，%s，留在当前的聊天室\n", u.Name(), msg)))
+		return
+	}
+	if resumed, ok := IChatroom.(*chatroom.Chatroom); ok {
+		resumed.InheritRoles(s.UserID, u)
+	}
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("会话已恢复，你的名字是:%s\n", u.Name())))
+}
+
+// 释放断线时 Reserve 保留的房间
+func (c *ChatServer) releaseRoom(roomId int) {
+	if roomId == 0 {
+		return
+	}
+	if IChatroom, found := c.IChatroomManager.FindRoom(roomId); found {
+		if cr, ok := IChatroom.(*chatroom.Chatroom); ok {
+			cr.Release()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 连接服务器，返回连接和下发的重连令牌
+func dialResumableUser(t *testing.T, addr string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	line := readTCPUntil(t, conn, r, "你的重连令牌是:")
+	token, _, _ := strings.Cut(strings.SplitN(line, "你的重连令牌是:", 2)[1], "，")
+	readTCPUntil(t, conn, r, "房间")
+	return conn, r, token
+}
+
+// 等待服务端检测到断线并保存 n 个会话
+func waitSessions(t *testing.T, c *ChatServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.sessions.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions = %d, want %d", c.sessions.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeRestoresNameRoomAndMissedMessages(t *testing.T) {
+	c, addr := startTestServer(t)
+
+	alice, aliceReader, token := dialResumableUser(t, addr)
+	aliceName := alice.LocalAddr().String()
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+	bob.Write([]byte("1|before drop\n"))
+	readTCPUntil(t, alice, aliceReader, "before drop")
+
+	alice.Close()
+	waitSessions(t, c, 1)
+	bob.Write([]byte("1|missed while away from the drop\n"))
+	readTCPUntil(t, bob, bobReader, "missed while away")
+
+	again, againReader := dialTestUser(t, addr)
+	again.Write([]byte("13|" + token + "\n"))
+	readTCPUntil(t, again, againReader, "你已回到ID为")
+	// 只补发断线期间错过的消息，断线前已经收到的不再补发
+	if line := readTCPUntil(t, again, againReader, "drop"); !strings.Contains(line, "missed while away") {
+		t.Fatalf("first message after resume = %q, want the missed one", line)
+	}
+	readTCPUntil(t, again, againReader, "会话已恢复，你的名字是:"+aliceName)
+	again.Write([]byte("2\n"))
+	readTCPUntil(t, again, againReader, bob.LocalAddr().String())
+
+	again.Write([]byte("1|back again\n"))
+	readTCPUntil(t, bob, bobReader, "back again")
+	// 恢复之后还是房主
+	again.Write([]byte("14|" + bob.LocalAddr().String() + "\n"))
+	readTCPUntil(t, bob, bobReader, "被 "+aliceName+" 任命为管理员")
+
+	// 令牌只能使用一次
+	other, otherReader := dialTestUser(t, addr)
+	other.Write([]byte("13|" + token + "\n"))
+	readTCPUntil(t, other, otherReader, "重连令牌无效或已过期")
+}
+
+func TestResumeWithUnknownToken(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("13|not-a-token\n"))
+	readTCPUntil(t, alice, aliceReader, "重连令牌无效或已过期")
+}
+
+func TestReservedRoomSurvivesUntilResume(t *testing.T) {
+	c, addr := startTestServer(t)
+
+	alice, aliceReader, token := dialResumableUser(t, addr)
+	alice.Write([]byte("9|solo\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为solo的聊天室")
+	alice.Close()
+	waitSessions(t, c, 1)
+	// 房间空了，但是还在等待 alice 重连，不能被删除
+	time.Sleep(1200 * time.Millisecond)
+	again, againReader := dialTestUser(t, addr)
+	again.Write([]byte("8\n"))
+	readTCPUntil(t, again, againReader, "名字:solo 人数:0/100")
+	again.Write([]byte("13|" + token + "\n"))
+	readTCPUntil(t, again, againReader, "你已回到ID为")
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"chatroom/protocol"
+	"chatroom/server/chatroom"
+	"chatroom/server/chatroom_manager"
+	"chatroom/server/user"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 列出所有聊天室的ID、名字、人数和容量
+func (c *ChatServer) listRooms(u *user.User, env *protocol.Envelope) {
+	rooms := c.IChatroomManager.ListRooms()
+	var sb strings.Builder
+	for _, room := range rooms {
+		name := room.Name
+		if name == "" {
+			name = "-"
+		}
+		current := ""
+		if room.ID == u.RoomId() {
+			current = " (当前)"
+		}
+		fmt.Fprintf(&sb, "ID:%d 名字:%s 人数:%d/%d 策略:%s%s\n", room.ID, name, room.Members, room.Capacity, room.Policy, current)
+	}
+	ack := protocol.NewAck(env.ID, sb.String())
+	ack.Rooms = rooms
+	u.Send(ack)
+}
+
+// 创建命名聊天室，创建者直接加入该聊天室
+// env.Policy 不为空时设置该房间广播消息来不及发送时的处理方式
+func (c *ChatServer) createRoom(u *user.User, env *protocol.Envelope) {
+	policy, err := user.ParseSlowConsumerPolicy(env.Policy)
+	if env.Policy != "" && err != nil {
+		u.Send(protocol.NewError(env.ID, roomErrorMsg(err)))
+		return
+	}
+	IChatroom, err := c.IChatroomManager.CreateRoom(env.Name)
+	if err != nil {
+		u.Send(protocol.NewError(env.ID, roomErrorMsg(err)))
+		return
+	}
+	if env.Policy != "" {
+		IChatroom.(*chatroom.Chatroom).SetSlowConsumerPolicy(policy)
+	}
+	IChatroom.(*chatroom.Chatroom).SetOwner(u)
+	info := IChatroom.Info()
+	if _, err := c.IChatroomManager.JoinRoom(u, info.ID, ""); err != nil {
+		// 创建者没能加入（例如按名字被封禁），不留下一个没有人的房间
+		c.IChatroomManager.CloseRoom(info.ID)
+		u.Send(protocol.NewError(env.ID, roomErrorMsg(err)))
+		return
+	}
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("已创建并加入名字为%s的聊天室，ID为%d\n", info.Name, info.ID)))
+}
+
+// 按ID或名字加入聊天室
+func (c *ChatServer) joinRoom(u *user.User, env *protocol.Envelope) {
+	IChatroom, err := c.IChatroomManager.JoinRoom(u, env.Room, env.Name)
+	if err != nil {
+		u.Send(protocol.NewError(env.ID, roomErrorMsg(err)))
+		return
+	}
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("已加入ID为%d的聊天室\n", IChatroom.Info().ID)))
+}
+
+// 离开当前聊天室回到大厅
+func (c *ChatServer) leaveRoom(u *user.User, env *protocol.Envelope) {
+	if err := c.IChatroomManager.LeaveRoom(u); err != nil {
+		u.Send(protocol.NewError(env.ID, roomErrorMsg(err)))
+		return
+	}
+	u.Send(protocol.NewAck(env.ID, "你已回到大厅\n"))
+}
+
+// 在大厅中随机加入一个聊天室，和刚连接时的分配方式相同
+func (c *ChatServer) quickJoin(u *user.User, env *protocol.Envelope) {
+	if u.RoomId() != 0 {
+		u.Send(protocol.NewError(env.ID, roomErrorMsg(chatroom_manager.ErrAlreadyInRoom)))
+		return
+	}
+	if isFound, _ := c.IChatroomManager.AssignRoomToUser(u); !isFound {
+		u.Send(protocol.NewError(env.ID, "本聊天室服务器分配已满或是没有分配到房间\n"))
+		return
+	}
+	u.Send(protocol.NewAck(env.ID, fmt.Sprintf("已加入ID为%d的聊天室\n", u.RoomId())))
+}
+
+// 聊天室操作错误对应的提示
+func roomErrorMsg(err error) string {
+	switch {
+	case errors.Is(err, chatroom_manager.ErrRoomNotFound):
+		return "聊天室不存在\n"
+	case errors.Is(err, chatroom_manager.ErrRoomExists):
+		return "聊天室的名字已经被使用\n"
+	case errors.Is(err, chatroom_manager.ErrRoomFull):
+		return "聊天室已满\n"
+	case errors.Is(err, chatroom_manager.ErrTooManyRooms):
+		return "聊天室数量已经达到上限\n"
+	case errors.Is(err, chatroom_manager.ErrInvalidRoomName):
+		return fmt.Sprintf("聊天室的名字不合法，长度不能超过%d，不能是纯数字，不能包含空白字符和 | : #\n", chatroom_manager.MaxRoomNameLength)
+	case errors.Is(err, chatroom_manager.ErrAlreadyInRoom):
+		return "你已经在该聊天室中\n"
+	case errors.Is(err, chatroom_manager.ErrNotInRoom):
+		return "你当前不在任何聊天室中\n"
+	case errors.Is(err, chatroom_manager.ErrBanned):
+		return "你已被禁止进入该聊天室\n"
+	case errors.Is(err, user.ErrInvalidPolicy):
+		return "策略不合法，只能是 drop_oldest、disconnect 或 spill_to_disk\n"
+	default:
+		return "聊天室操作失败\n"
+	}
+}
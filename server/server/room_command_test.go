@@ -0,0 +1,91 @@
+package server
+
+import (
+	"chatroom/server/moderation"
+	"strings"
+	"testing"
+)
+
+func TestCreateJoinAndLeaveNamedRoom(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("8\n"))
+	readTCPUntil(t, bob, bobReader, "名字:dev 人数:1/100")
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+
+	alice.Write([]byte("1|hello dev\n"))
+	readTCPUntil(t, bob, bobReader, "hello dev")
+
+	bob.Write([]byte("11\n"))
+	readTCPUntil(t, bob, bobReader, "你已回到大厅")
+	bob.Write([]byte("1|anyone?\n"))
+	readTCPUntil(t, bob, bobReader, "你当前在大厅中")
+	bob.Write([]byte("9|dev\n"))
+	readTCPUntil(t, bob, bobReader, "聊天室的名字已经被使用")
+	bob.Write([]byte("12\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+	bob.Write([]byte("2\n"))
+	readTCPUntil(t, bob, bobReader, bob.LocalAddr().String())
+}
+
+func TestJoinRoomById(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("10|999\n"))
+	readTCPUntil(t, alice, aliceReader, "聊天室不存在")
+	alice.Write([]byte("9|123\n"))
+	readTCPUntil(t, alice, aliceReader, "聊天室的名字不合法")
+	alice.Write([]byte("9|ops\n"))
+	readTCPUntil(t, alice, aliceReader, "ID为2")
+
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("10|2\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为2的聊天室")
+	bob.Write([]byte("10|2\n"))
+	readTCPUntil(t, bob, bobReader, "你已经在该聊天室中")
+	bob.Write([]byte("1|hi ops\n"))
+	readTCPUntil(t, alice, aliceReader, "hi ops")
+}
+
+func TestCreateRoomWithSlowConsumerPolicy(t *testing.T) {
+	_, addr := startTestServer(t)
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|big|block\n"))
+	readTCPUntil(t, alice, aliceReader, "策略不合法")
+	alice.Write([]byte("9|big|spill_to_disk\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为big的聊天室")
+	alice.Write([]byte("8\n"))
+	readTCPUntil(t, alice, aliceReader, "名字:big 人数:1/100 策略:spill_to_disk")
+}
+
+// 创建者没能加入新建的房间时，房间被删除，不会留在房间列表中
+func TestCreateRoomRemovedWhenCreatorCannotJoin(t *testing.T) {
+	c, addr := startTestServer(t)
+	if err := c.Moderation.Ban(&moderation.Ban{Room: "dev", Target: "127.0.0.1", ByIP: true, By: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "你已被禁止进入该聊天室")
+	for _, room := range c.IChatroomManager.ListRooms() {
+		if room.Name == "dev" {
+			t.Fatalf("room dev (ID %d) still listed after the creator failed to join", room.ID)
+		}
+	}
+	alice.Write([]byte("8\n"))
+	if line := readTCPUntil(t, alice, aliceReader, "ID:"); strings.Contains(line, "名字:dev") {
+		t.Fatalf("room list = %q, want no dev", line)
+	}
+	// 名字没有被占用，再次创建时同样因为封禁失败
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "你已被禁止进入该聊天室")
+}
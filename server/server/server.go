@@ -1,18 +1,32 @@
 package server
 
 import (
-	"chatroom/parameter"
-	"chatroom/server/chatroom"
+	"chatroom/config"
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/account"
 	"chatroom/server/chatroom_manager"
+	"chatroom/server/history"
+	"chatroom/server/metrics"
+	"chatroom/server/moderation"
+	"chatroom/server/offline"
+	"chatroom/server/ratelimit"
+	"chatroom/server/session"
 	"chatroom/server/user"
 	"chatroom/utils"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,36 +34,101 @@ import (
 type ChatServer struct {
 	ServerIP          string                            // 服务器对应的IP
 	ServerPort        string                            // 服务器对应的端口号
+	Config            *config.Config                    // 创建服务器时使用的配置
 	userMap           *user.SafeUserMap                 // userName(default:"IP:Port")->*User 对应每个用户的map
 	EnterRoomChannel  chan *user.User                   // 进入房间的channel，顺序处理每一个用户的连接，可以增加buffer cap去增加用户并发连接数
 	IChatroomManager  chatroom_manager.IChatroomManager // 该服务器对应的 IChatroomManager
 	userMongoDatabase *mongo.Database                   // mongo中User数据库
+	TLSConfig         *tls.Config                       // 不为 nil 时，TCP 和 WebSocket 监听都使用 TLS
+	Accounts          *account.Service                  // 注册和登录的逻辑，默认使用 mongo 中的 users 集合
+	sessions          *session.Registry                 // 断线之后等待重连的会话
+	logger            *slog.Logger                      // 服务器的 logger，交给 ChatroomManager 和每个用户
+	connLimiter       *ratelimit.ConnLimiter            // 每个IP同时建立的连接数的限制
+	history           *history.History                  // 所有聊天室共用的聊天记录，Shutdown 时写完剩下的记录
+	Moderation        *moderation.Service               // 所有聊天室共用的封禁和审计日志，启动时需要 Load 已有的封禁
+	mailbox           *offline.Mailbox                  // 发给不在线账号的私聊，账号登录时送达
+	privateSeq        atomic.Int64                      // 最近一条私聊在服务器内的序号
+	admission         *admissionQueue                   // 所有房间都满时等待进入房间的用户
+
+	mu           sync.Mutex                // 保护下面的字段
+	shuttingDown bool                      // 已经开始 Shutdown，不再接受新的连接
+	listeners    map[net.Listener]struct{} // 正在 Serve 的 listener，Shutdown 时关闭
+	httpServers  []*http.Server            // StartWebSocket 启动的 HTTP 服务器，Shutdown 时关闭
+	done         chan struct{}             // Shutdown 时关闭，通知后台协程退出
+	wg           sync.WaitGroup            // 连接和用户的协程，Shutdown 时等待它们退出
 }
 
-// 创建聊天服务器
-func NewChatServer(serverIP, serverPort string) *ChatServer {
+// 创建聊天服务器，cfg 不合法或者数据库连接失败时返回 nil
+// 日志写到 slog 的默认 logger，main 中由 logging.Setup 按照 cfg.Log 设置
+func NewChatServer(cfg *config.Config) *ChatServer {
+	logger := slog.Default()
+	if err := cfg.Validate(); err != nil {
+		logger.Error("invalid config", logging.Err(err))
+		return nil
+	}
 	chatServer := &ChatServer{
-		ServerIP:         serverIP,
-		ServerPort:       serverPort,
+		ServerIP:         cfg.Server.IP,
+		ServerPort:       cfg.Server.Port,
+		Config:           cfg,
 		userMap:          user.NewSafeUserMap(),
-		EnterRoomChannel: make(chan *user.User),                  //可以增加buffer cap去增加用户并发连接数(生产者)
-		IChatroomManager: chatroom_manager.NewChatroomManager(0), // 目前只有一个manager去管理
+		EnterRoomChannel: make(chan *user.User),                               //可以增加buffer cap去增加用户并发连接数(生产者)
+		IChatroomManager: chatroom_manager.NewChatroomManager(0, cfg, logger), // 目前只有一个manager去管理
+		logger:           logger,
+		connLimiter:      ratelimit.NewConnLimiter(cfg.RateLimit.MaxConnsPerIP),
+		admission:        newAdmissionQueue(cfg.Manager.MaxWaiting),
+		listeners:        make(map[net.Listener]struct{}),
+		done:             make(chan struct{}),
 	}
 
-	database, err := connectToMongo(parameter.DatabaseUrl, parameter.DatabaseName,
-		parameter.Timeout, parameter.DatabaseConnectPoolSize)
+	database, err := chatServer.connectToMongo(cfg.Mongo.URL, cfg.Mongo.Database,
+		cfg.Mongo.Timeout, cfg.Mongo.PoolSize)
 	if err != nil {
-		log.Println("数据库连接失败", err)
+		logger.Error("connect to mongo failed", logging.Err(err))
 		return nil
 	}
+	chatServer.sessions = session.NewRegistry(cfg.Server.ResumeGracePeriod, func(s *session.Session) {
+		logger.Info("resume session expired", logging.KeyUser, s.UserName, logging.KeyRoomID, s.RoomId)
+		chatServer.releaseRoom(s.RoomId)
+	})
 	chatServer.userMongoDatabase = database
-	go chatServer.consumEnterUser()
+	chatServer.Accounts = account.NewService(account.NewMongoStore(database), cfg.Mongo.Timeout)
+	chatServer.IChatroomManager.(*chatroom_manager.ChatroomManager).SetCommandHandler(chatServer)
+	if cfg.History.Persist {
+		chatServer.SetHistoryStore(history.NewMongoStore(database))
+	}
+	chatServer.SetModerationStore(moderation.NewMongoStore(database))
+	chatServer.SetOfflineStore(offline.NewMongoStore(database))
+	chatServer.goTracked(chatServer.consumEnterUser)
+	chatServer.goTracked(chatServer.admitWaiting)
+	if cfg.Heartbeat.Interval > 0 {
+		chatServer.goTracked(chatServer.heartbeat)
+	}
 
 	return chatServer
 }
 
+// 设置聊天记录的持久化存储，所有聊天室的广播消息都会写入 store，history 命令也从 store 中读取
+// 之前的存储写完剩下的记录后关闭
+func (c *ChatServer) SetHistoryStore(store history.Store) {
+	previous := c.history
+	c.history = history.New(store, c.Config.History.BufferSize, c.Config.History.FlushBatchSize, c.Config.Mongo.Timeout)
+	c.IChatroomManager.(*chatroom_manager.ChatroomManager).SetHistory(c.history)
+	if previous != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Config.Mongo.Timeout)
+		defer cancel()
+		previous.Close(ctx)
+	}
+}
+
+// 设置封禁和审计日志的存储，默认使用 mongo 中的 bans 和 audit 集合
+// 不会从 store 中加载已有的封禁，需要时调用 Moderation.Load
+func (c *ChatServer) SetModerationStore(store moderation.Store) {
+	c.Moderation = moderation.NewService(store, c.Config.Mongo.Timeout, c.logger)
+	c.IChatroomManager.(*chatroom_manager.ChatroomManager).SetModeration(c.Moderation)
+}
+
 // 连接到数据库，如何设置 poolSize 参数，默认选用 poolSize最后一个参数作为连接池的大小
-func connectToMongo(url, databaseName string, timeout time.Duration, connPoolSize ...uint64) (*mongo.Database, error) {
+func (c *ChatServer) connectToMongo(url, databaseName string, timeout time.Duration, connPoolSize ...uint64) (*mongo.Database, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	o := options.Client().ApplyURI(url)
@@ -60,55 +139,106 @@ func connectToMongo(url, databaseName string, timeout time.Duration, connPoolSiz
 	if utils.CheckError(err, "client") {
 		return nil, err
 	}
-	log.Printf("已成功连接数据库:\n"+
-		"                      url为:%s\n"+
-		"                      databaseName为:%s\n"+
-		"                      连接池大小为:%d\n", url, databaseName, connPoolSize)
+	c.logger.Info("mongo client ready", "url", url, "database", databaseName, "pool_size", connPoolSize)
 	return client.Database(databaseName), nil
 }
 
 // 监听对应端口，执行handle
 func (c *ChatServer) Start() {
 	localAddress := fmt.Sprintf("%s:%s", c.ServerIP, c.ServerPort)
-	log.Printf("Local Address: %s\n", localAddress)
+	c.logger.Info("listening", "addr", localAddress)
 	listener, err := net.Listen("tcp", localAddress)
-	utils.CheckError(err, "Listener", listener)
+	if utils.CheckError(err, "Listener") {
+		return
+	}
+	c.Serve(listener)
+}
+
+// 在 listener 上循环 Accept，每个连接都交给 serveConn，Shutdown 时关闭 listener 并返回
+// 设置了 TLSConfig 时，listener 上的连接都使用 TLS
+func (c *ChatServer) Serve(listener net.Listener) {
+	if !c.addListener(listener) {
+		listener.Close()
+		return
+	}
+	defer c.removeListener(listener)
+	if c.TLSConfig != nil {
+		listener = tls.NewListener(listener, c.TLSConfig)
+	}
 	for {
 		conn, err := listener.Accept()
 		//log.Printf("-----------------------Remote connect info: %s-----------------------\n", conn.RemoteAddr().String())
-		utils.CheckError(err, "Accept", conn)
-		curUser := c.storeUser(conn)
-		go c.userEnterRoom(curUser)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if utils.CheckError(err, "Accept") {
+			continue
+		}
+		if !c.goTracked(func() { c.serveConn(conn) }) {
+			conn.Close()
+		}
+	}
+}
+
+// TCP 和 WebSocket 的连接共用的入口: 检查IP的连接数，完成 TLS 握手，保存用户，然后送进 EnterRoomChannel 分配房间
+func (c *ChatServer) serveConn(conn net.Conn) {
+	release, ok := c.acquireConn(conn)
+	if !ok {
+		return
+	}
+	if err := handshake(conn); utils.CheckError(err, "TLS handshake", conn) {
+		release()
+		return
+	}
+	curUser, ok := c.storeUser(&limitedConn{Conn: conn, release: release})
+	if !ok {
+		return
 	}
+	c.userEnterRoom(curUser)
 }
 
-// 保存链接的逻辑, 如果历史访问过，返回的是该用户，否则返回一个新用户
-func (c *ChatServer) storeUser(conn net.Conn) *user.User {
+// 保存链接的逻辑，用户名默认为 "IP:Port"，使用客户端证书时为证书的 CommonName
+// 如果该用户名已经有在线的用户，拒绝这个连接
+func (c *ChatServer) storeUser(conn net.Conn) (*user.User, bool) {
 	remoteAddr := conn.RemoteAddr().String()
 	remoteAddrSplit := strings.Split(remoteAddr, ":")
 	remoteIP, remotePort := remoteAddrSplit[0], remoteAddrSplit[1]
-	// userMap如果存在该user的话
-	if u, isPresent := c.userMap.GetUser(remoteAddr); isPresent {
-		return u
-	}
-	u := user.NewUser(remoteAddr, remoteIP, remotePort, conn, c.userMap)
-	utils.SendMessage(conn, fmt.Sprintf("Hello, %s\n", u.UserName))
-	c.userMap.SetUser(remoteAddr, u)
-	return u
+	userName := remoteAddr
+	if commonName := peerCommonName(conn); commonName != "" {
+		userName = commonName
+	}
+	u := user.NewUser(userName, remoteIP, remotePort, conn, c.userMap, c.Config, c.logger)
+	u.Limiter = c.newLimiter()
+	// 检查和保存必须是一步，同一个证书同时建立的两个连接只有一个能保存成功
+	if _, stored := c.userMap.SetUser(userName, u); !stored {
+		u.Send(protocol.NewError("", fmt.Sprintf("用户%s已经在线\n", userName)))
+		u.Close()
+		return nil, false
+	}
+	u.Send(protocol.NewPresence(0, u.Name(), fmt.Sprintf("Hello, %s", u.Name())))
+	c.issueResumeToken(u)
+	return u, true
 }
 
-// 作为生产者，将用户放进 EnterRoomChannel 中
+// 作为生产者，将用户放进 EnterRoomChannel 中，服务器正在关闭时断开该用户
 func (c *ChatServer) userEnterRoom(user *user.User) {
-	log.Printf("%s 用户已上线\n", user.Conn.RemoteAddr().String())
-	c.EnterRoomChannel <- user
+	user.Logger().Debug("user waiting for room")
+	start := time.Now()
+	select {
+	case c.EnterRoomChannel <- user:
+		metrics.ObserveSince(metrics.EnterRoomWaitSeconds, start)
+	case <-c.done:
+		c.terminalLobbyUser(user)
+	}
 }
 
-// 作为消费者，消费 EnterRoomChannel 的用户，单个协程，顺序消费用户
+// 作为消费者，消费 EnterRoomChannel 的用户，单个协程，顺序消费用户，Shutdown 时退出
 func (c *ChatServer) consumEnterUser() {
 	for {
-		log.Printf("尝试消费用户\n")
-		if u, open := <-c.EnterRoomChannel; open {
-			log.Printf("%s 用户被消费\n", u.Conn.RemoteAddr().String())
+		select {
+		case <-c.done:
+			return
+		case u := <-c.EnterRoomChannel:
 			c.consumProcess(u)
 		}
 	}
@@ -116,28 +246,35 @@ func (c *ChatServer) consumEnterUser() {
 
 // 消费任务的逻辑
 // 如果消费成功，就开一个协程处理
-// 如果消费失败，就进行将消息
+// 如果所有房间都满了或者已经有用户在等待，放进等待队列，按顺序等待空出的位置
 func (c *ChatServer) consumProcess(u *user.User) {
-	log.Println("EnterRoomUser:", u.UserName)
 	chatroomManager, ok := c.IChatroomManager.(*chatroom_manager.ChatroomManager)
 	if !ok {
 		log.Panicln("*chatroom.Chatroom 没有实现 IChatroom 接口")
 	}
-	if isFound, IChatroom := chatroomManager.AssignRoomToUser(u); !isFound {
-		utils.SendMessage(u.Conn, "本聊天室服务器分配已满或是没有分配到房间")
-		log.Println("本聊天室服务器分配已满或是没有分配到房间")
-		// 保证User不丢失，没来得及消费的User，重新放入 EnterRoomChannel，重新消费
-		go c.userEnterRoom(u)
-	} else {
-		cr, ok := IChatroom.(*chatroom.Chatroom)
-		if !ok {
-			log.Panicln("*chatroom.Chatroom 没有实现 Ichatroom 接口")
+	if c.admission.Len() > 0 {
+		c.waitForRoom(u)
+		return
+	}
+	isFound, IChatroom := chatroomManager.AssignRoomToUser(u)
+	if !isFound {
+		u.Logger().Warn("no room available")
+		c.waitForRoom(u)
+		return
+	}
+	c.enterAssignedRoom(u, IChatroom)
+}
+
+// 每个用户一个协程的读循环，直到连接断开
+// 在房间中时交给房间的 MsgHandle 处理，离开房间之后在大厅中处理
+func (c *ChatServer) serveUser(u *user.User) {
+	for !u.IsClosed() {
+		if IChatroom, inRoom := c.IChatroomManager.UserRoom(u); inRoom {
+			IChatroom.MsgHandle(u)
+		} else {
+			// 所在的房间已经被删除时也回到大厅
+			u.SetRoomId(0)
+			c.lobbyHandle(u)
 		}
-		log.Printf("已经分配聊天室，ID:%d\n", cr.RoomId)
-		//go cr.MsgHandle(u)
-		go func() {
-			log.Println("有一个协程进来了")
-			time.Sleep(60 * time.Second)
-		}()
 	}
 }
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/user"
+	"context"
+	"net"
+	"net/http"
+)
+
+// 优雅地关闭服务器:
+//  1. 不再接受新的连接
+//  2. 关闭所有聊天室，等待正在发送的广播发完
+//  3. 通知所有在线用户服务器即将关闭，然后断开连接
+//  4. 等待所有连接和用户的协程退出，写完剩下的聊天记录，关闭 mongo 连接
+//
+// ctx 结束时不再等待，强制关闭剩下的部分并返回 ctx.Err()，可以重复调用
+func (c *ChatServer) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.shuttingDown {
+		c.mu.Unlock()
+		return nil
+	}
+	c.shuttingDown = true
+	close(c.done)
+	listeners, httpServers := c.listeners, c.httpServers
+	c.listeners, c.httpServers = nil, nil
+	c.mu.Unlock()
+	c.logger.Info("shutdown started")
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for listener := range listeners {
+		listener.Close()
+	}
+	for _, httpServer := range httpServers {
+		record(httpServer.Shutdown(ctx))
+	}
+	record(waitContext(ctx, c.IChatroomManager.Close))
+
+	c.userMap.Range(func(_, value any) bool {
+		u := value.(*user.User)
+		u.Send(protocol.NewPresence(0, "", "服务器即将关闭，请稍后重新连接\n"))
+		u.Close()
+		return true
+	})
+	record(waitContext(ctx, c.wg.Wait))
+
+	c.sessions.Close()
+	if c.history != nil {
+		record(c.history.Close(ctx))
+	}
+	if c.userMongoDatabase != nil {
+		record(c.userMongoDatabase.Client().Disconnect(ctx))
+	}
+	c.logger.Info("shutdown finished", logging.Err(firstErr))
+	return firstErr
+}
+
+// 登记一个需要在 Shutdown 时等待的协程，结束时调用 c.wg.Done，已经开始关闭时返回 false
+func (c *ChatServer) track() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.wg.Add(1)
+	return true
+}
+
+// 在登记过的协程中运行 f，已经开始关闭时不运行并返回 false
+func (c *ChatServer) goTracked(f func()) bool {
+	if !c.track() {
+		return false
+	}
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+	return true
+}
+
+func (c *ChatServer) addListener(listener net.Listener) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.listeners[listener] = struct{}{}
+	return true
+}
+
+func (c *ChatServer) removeListener(listener net.Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.listeners, listener)
+}
+
+func (c *ChatServer) addHTTPServer(httpServer *http.Server) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.httpServers = append(c.httpServers, httpServer)
+	return true
+}
+
+// 等待 f 返回，ctx 先结束时返回 ctx.Err()，f 继续在后台运行
+func waitContext(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
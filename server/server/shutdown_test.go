@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownNotifiesUsersAndStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	c, addr := startTestServer(t)
+	httpServer := httptest.NewServer(c.WebSocketHandler())
+
+	alice, aliceReader := dialTestUser(t, addr)
+	alice.Write([]byte("9|dev\n"))
+	readTCPUntil(t, alice, aliceReader, "已创建并加入名字为dev的聊天室")
+	bob, bobReader := dialTestUser(t, addr)
+	bob.Write([]byte("10|dev\n"))
+	readTCPUntil(t, bob, bobReader, "已加入ID为")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	readWSUntil(t, ws, "房间")
+	// 断线的用户留下一个等待重连的会话
+	carol, _ := dialTestUser(t, addr)
+	carol.Close()
+	waitSessions(t, c, 1)
+
+	bob.Write([]byte("1|last words\n"))
+	readTCPUntil(t, alice, aliceReader, "last words")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	readTCPUntil(t, alice, aliceReader, "服务器即将关闭")
+	readTCPUntil(t, bob, bobReader, "服务器即将关闭")
+	readWSUntil(t, ws, "服务器即将关闭")
+	if c.sessions.Len() != 0 {
+		t.Fatalf("sessions = %d after Shutdown", c.sessions.Len())
+	}
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("second Shutdown = %v", err)
+	}
+	httpServer.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("goroutines = %d, want <= %d\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeAfterShutdownReturns(t *testing.T) {
+	c, _ := startTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已经关闭的服务器不再 Accept，Serve 关闭 listener 后立即返回
+	c.Serve(listener)
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Serve = %v, want net.ErrClosed", err)
+	}
+}
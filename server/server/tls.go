@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second // TLS 握手的超时时间
+
+// 加载服务端证书和私钥，clientCAFile 不为空时要求客户端出示该 CA 签发的证书
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("client CA 文件中没有有效的证书")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// 可以拿到 TLS 连接状态的连接，*tls.Conn 和 TLS 上的 wsConn 都实现了该接口
+type tlsConnectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// 如果是 TLS 连接，在保存用户之前完成握手，这样才能拿到客户端证书
+func handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
+
+// 客户端证书的 CommonName，没有客户端证书时返回空字符串
+func peerCommonName(conn net.Conn) string {
+	stater, ok := conn.(tlsConnectionStater)
+	if !ok {
+		return ""
+	}
+	state := stater.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
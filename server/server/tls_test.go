@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试用的证书和私钥
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// 生成证书，parent 为 nil 时生成自签名的 CA
+func newTestCert(t *testing.T, commonName string, parent *testCert, isServer bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	parentCert, parentKey := template, key
+	switch {
+	case parent == nil:
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	case isServer:
+		parentCert, parentKey = parent.cert, parent.key
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	default:
+		parentCert, parentKey = parent.cert, parent.key
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// 把证书和私钥写成 PEM 文件，返回文件路径
+func (tc *testCert) writePEM(t *testing.T, name string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+// 启动使用 ca 签发证书的 TLS ChatServer，requireClientCert 时要求客户端出示 ca 签发的证书
+func startTLSServer(t *testing.T, ca *testCert, requireClientCert bool) string {
+	t.Helper()
+	serverCert := newTestCert(t, "chatroom", ca, true)
+	certFile, keyFile := serverCert.writePEM(t, "server")
+	caFile := ""
+	if requireClientCert {
+		caFile, _ = ca.writePEM(t, "ca")
+	}
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChatServer(testConfig())
+	c.TLSConfig = tlsConfig
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+	})
+	go c.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestTLSClientCertificateNamesUser(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, false)
+	addr := startTLSServer(t, ca, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert := newTestCert(t, "alice", ca, false)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert.tlsCertificate()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readTCPUntil(t, conn, r, "Hello, alice")
+	readTCPUntil(t, conn, r, "房间")
+	conn.Write([]byte("3\n"))
+	readTCPUntil(t, conn, r, "你的名字是:alice")
+}
+
+func TestTLSWithoutClientCA(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, false)
+	addr := startTLSServer(t, ca, false)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readTCPUntil(t, conn, r, "Hello, "+conn.LocalAddr().String())
+}
+
+func TestTLSRejectsClientWithoutCertificate(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, false)
+	addr := startTLSServer(t, ca, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("server accepted a client without certificate")
+	}
+}
+
+// 同一个证书同时建立的连接只有一个能上线，其他连接在收到 Hello 之前被拒绝
+func TestTLSSameCommonNameOnlyOnce(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, false)
+	addr := startTLSServer(t, ca, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert := newTestCert(t, "alice", ca, false)
+	const conns = 8
+	lines := make(chan []string, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			var got []string
+			defer func() { lines <- got }()
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				RootCAs:      roots,
+				Certificates: []tls.Certificate{clientCert.tlsCertificate()},
+			})
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				got = append(got, line)
+			}
+		}()
+	}
+	hello, rejected := 0, 0
+	for i := 0; i < conns; i++ {
+		for _, line := range <-lines {
+			switch {
+			case strings.Contains(line, "Hello, alice"):
+				hello++
+			case strings.Contains(line, "用户alice已经在线"):
+				rejected++
+			}
+		}
+	}
+	if hello != 1 || rejected != conns-1 {
+		t.Fatalf("%d connections greeted and %d rejected, want 1 and %d", hello, rejected, conns-1)
+	}
+}
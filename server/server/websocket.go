@@ -0,0 +1,175 @@
+package server
+
+import (
+	"chatroom/codec"
+	"chatroom/utils"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 按照 server.websocket_origins 检查浏览器的来源
+// 使用客户端证书时，浏览器会把证书出示给任意页面发起的 wss:// 连接，不检查来源的话其他网站可以冒充该用户
+func (c *ChatServer) newUpgrader() *websocket.Upgrader {
+	origins := c.Config.Server.WebSocketOriginList()
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			if allowedOrigin(r, origins) {
+				return true
+			}
+			c.logger.Warn("websocket origin rejected", "origin", r.Header.Get("Origin"), "remote_addr", r.RemoteAddr)
+			return false
+		},
+	}
+}
+
+// 不带 Origin 的非浏览器客户端、同源的页面和 origins 中的来源可以连接，origins 中有 * 时允许任意来源
+func allowedOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// 在 ServerIP:port 上监听 WebSocket 连接，path 为升级的路径
+func (c *ChatServer) StartWebSocket(port, path string) {
+	localAddress := fmt.Sprintf("%s:%s", c.ServerIP, port)
+	c.logger.Info("websocket listening", "addr", localAddress, "path", path)
+	mux := http.NewServeMux()
+	mux.Handle(path, c.WebSocketHandler())
+	httpServer := &http.Server{Addr: localAddress, Handler: mux, TLSConfig: c.TLSConfig}
+	if !c.addHTTPServer(httpServer) {
+		return
+	}
+	var err error
+	if c.TLSConfig != nil {
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	utils.CheckError(err, "WebSocket Listener")
+}
+
+// 把 HTTP 请求升级为 WebSocket，包装成 net.Conn 后和 TCP 连接走同一套流程
+func (c *ChatServer) WebSocketHandler() http.Handler {
+	upgrader := c.newUpgrader()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.track() {
+			http.Error(w, "服务器正在关闭", http.StatusServiceUnavailable)
+			return
+		}
+		defer c.wg.Done()
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if utils.CheckError(err, "WebSocket Upgrade") {
+			return
+		}
+		ws.SetReadLimit(int64(c.Config.Server.MaxFrameSize + codec.HeaderSize))
+		c.serveConn(newWSConn(ws, r.TLS))
+	})
+}
+
+// 把 WebSocket 连接适配成 net.Conn
+// 读: 文本消息被当作一行，缺少结尾换行时补上 '\n'；二进制消息原样交给 Decoder，可以携带长度前缀的帧
+// 写: 每次 Write 发送一条文本消息，去掉结尾的 '\n'
+type wsConn struct {
+	ws       *websocket.Conn
+	tlsState *tls.ConnectionState // 升级前 HTTP 请求的 TLS 状态，明文连接时为 nil
+	pending  []byte               // 当前消息中还没有被 Read 读走的部分
+	writeMu  sync.Mutex           // websocket.Conn 不支持并发写
+}
+
+func newWSConn(ws *websocket.Conn, tlsState *tls.ConnectionState) *wsConn {
+	return &wsConn{ws: ws, tlsState: tlsState}
+}
+
+// 实现 tlsConnectionStater，明文连接时返回零值
+func (w *wsConn) ConnectionState() tls.ConnectionState {
+	if w.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *w.tlsState
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		msgType, data, err := w.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if msgType == websocket.TextMessage && len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		w.pending = data
+	}
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	msg := p
+	if len(msg) > 0 && msg[len(msg)-1] == '\n' {
+		msg = msg[:len(msg)-1]
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if err := w.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsConn) Close() error {
+	w.writeMu.Lock()
+	w.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	w.writeMu.Unlock()
+	return w.ws.Close()
+}
+
+func (w *wsConn) LocalAddr() net.Addr {
+	return w.ws.LocalAddr()
+}
+
+func (w *wsConn) RemoteAddr() net.Addr {
+	return w.ws.RemoteAddr()
+}
+
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.ws.SetWriteDeadline(t)
+}
+
+func (w *wsConn) SetReadDeadline(t time.Time) error {
+	return w.ws.SetReadDeadline(t)
+}
+
+func (w *wsConn) SetWriteDeadline(t time.Time) error {
+	return w.ws.SetWriteDeadline(t)
+}
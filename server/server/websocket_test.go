@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"chatroom/config"
+	"chatroom/server/account"
+	"chatroom/server/history"
+	"chatroom/server/moderation"
+	"chatroom/server/offline"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 测试使用的默认配置，监听本地随机端口
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.Server.Port = "0"
+	return cfg
+}
+
+// 启动一个只监听本地随机端口的 ChatServer，返回 TCP 地址
+func startTestServer(t *testing.T) (*ChatServer, string) {
+	t.Helper()
+	return startTestServerWithConfig(t, testConfig())
+}
+
+// 使用 cfg 启动测试服务器，cfg.Server 中的监听地址不起作用
+func startTestServerWithConfig(t *testing.T, cfg *config.Config) (*ChatServer, string) {
+	t.Helper()
+	c := NewChatServer(cfg)
+	if c == nil {
+		t.Fatal("NewChatServer failed")
+	}
+	// 测试不依赖 mongo，账号和聊天记录都保存在内存中
+	c.Accounts = account.NewService(account.NewMemoryStore(), time.Second)
+	c.SetHistoryStore(history.NewMemoryStore())
+	c.SetModerationStore(moderation.NewMemoryStore())
+	c.SetOfflineStore(offline.NewMemoryStore())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+	})
+	go c.Serve(listener)
+	return c, listener.Addr().String()
+}
+
+// 从 TCP 连接中逐行读取，直到读到包含 want 的一行，返回该行
+func readTCPUntil(t *testing.T, conn net.Conn, r *bufio.Reader, want string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.Contains(line, want) {
+			return line
+		}
+	}
+}
+
+// 从 WebSocket 连接中逐条读取，直到读到包含 want 的一条消息
+func readWSUntil(t *testing.T, ws *websocket.Conn, want string) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.Contains(string(msg), want) {
+			return
+		}
+	}
+}
+
+func TestWebSocketAndTCPShareBroadcast(t *testing.T) {
+	c, tcpAddr := startTestServer(t)
+	httpServer := httptest.NewServer(c.WebSocketHandler())
+	defer httpServer.Close()
+
+	tcpConn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	tcpReader := bufio.NewReader(tcpConn)
+	readTCPUntil(t, tcpConn, tcpReader, "房间")
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	readWSUntil(t, ws, "房间")
+
+	if _, err := tcpConn.Write([]byte("1|hello from tcp\n")); err != nil {
+		t.Fatal(err)
+	}
+	readWSUntil(t, ws, "hello from tcp")
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("1|hello from web")); err != nil {
+		t.Fatal(err)
+	}
+	readTCPUntil(t, tcpConn, tcpReader, "hello from web")
+}
+
+func TestWebSocketChecksOrigin(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.WebSocketOrigins = "https://chat.example.com"
+	c, _ := startTestServerWithConfig(t, cfg)
+	httpServer := httptest.NewServer(c.WebSocketHandler())
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	for origin, allowed := range map[string]bool{
+		"":                         true, // 非浏览器客户端
+		"https://chat.example.com": true,
+		httpServer.URL:             true, // 同源
+		"https://evil.example.com": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if allowed && err != nil {
+			t.Errorf("origin %q rejected: %v", origin, err)
+		}
+		if !allowed && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q accepted", origin)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
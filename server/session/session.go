@@ -0,0 +1,102 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// 断线的用户保存下来的会话，在宽限期内可以用 Token 恢复
+type Session struct {
+	Token       string // 重连令牌
+	UserName    string // 断线时的用户名
+	UserID      uint64 // 断线前的连接的用户ID，恢复时继承它在房间中的角色和禁言
+	Account     string // 断线时登录的账号，未登录时为空
+	RoomId      int    // 断线时所在的房间，为0时在大厅中
+	LastSeenSeq int64  // 断线时房间最近一条广播消息的序号，重连后补发序号更大的消息
+}
+
+// 生成随机的重连令牌
+func NewToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// 等待恢复的会话，宽限期过后自动过期
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*entry // token -> 等待恢复的会话
+	grace    time.Duration     // 断线后可以恢复的宽限期
+	onExpire func(*Session)    // 会话过期时的回调，可以为 nil
+}
+
+type entry struct {
+	session *Session
+	timer   *time.Timer // 宽限期结束时让会话过期
+}
+
+func NewRegistry(grace time.Duration, onExpire func(*Session)) *Registry {
+	return &Registry{
+		sessions: make(map[string]*entry),
+		grace:    grace,
+		onExpire: onExpire,
+	}
+}
+
+// 保存断线用户的会话，同一个 Token 已有会话时覆盖旧的会话
+func (r *Registry) Suspend(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, isPresent := r.sessions[s.Token]; isPresent {
+		old.timer.Stop()
+	}
+	e := &entry{session: s}
+	e.timer = time.AfterFunc(r.grace, func() { r.expire(e) })
+	r.sessions[s.Token] = e
+}
+
+// 取出 token 对应的会话，取出后该会话不能再次恢复，不存在或已过期时返回 false
+func (r *Registry) Resume(token string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, isPresent := r.sessions[token]
+	if !isPresent || !e.timer.Stop() {
+		return nil, false
+	}
+	delete(r.sessions, token)
+	return e.session, true
+}
+
+// 等待恢复的会话数量
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// 丢弃所有等待恢复的会话，不再触发 onExpire
+func (r *Registry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for token, e := range r.sessions {
+		e.timer.Stop()
+		delete(r.sessions, token)
+	}
+}
+
+func (r *Registry) expire(e *entry) {
+	r.mu.Lock()
+	if r.sessions[e.session.Token] != e {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.sessions, e.session.Token)
+	r.mu.Unlock()
+	if r.onExpire != nil {
+		r.onExpire(e.session)
+	}
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumeWithinGracePeriod(t *testing.T) {
+	r := NewRegistry(time.Minute, nil)
+	token := NewToken()
+	r.Suspend(&Session{Token: token, UserName: "alice", RoomId: 3})
+	s, ok := r.Resume(token)
+	if !ok || s.UserName != "alice" || s.RoomId != 3 {
+		t.Fatalf("Resume = %+v, %v", s, ok)
+	}
+	if _, ok := r.Resume(token); ok {
+		t.Fatal("session resumed twice")
+	}
+	if _, ok := r.Resume("unknown"); ok {
+		t.Fatal("unknown token resumed")
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	expired := make(chan *Session, 1)
+	r := NewRegistry(10*time.Millisecond, func(s *Session) { expired <- s })
+	token := NewToken()
+	r.Suspend(&Session{Token: token, UserName: "alice"})
+	select {
+	case s := <-expired:
+		if s.Token != token {
+			t.Fatalf("expired %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not expire")
+	}
+	if _, ok := r.Resume(token); ok {
+		t.Fatal("expired session resumed")
+	}
+	if r.Len() != 0 {
+		t.Fatalf("Len = %d after expiry", r.Len())
+	}
+}
+
+func TestNewTokenIsRandom(t *testing.T) {
+	if a, b := NewToken(), NewToken(); a == b || len(a) != 32 {
+		t.Fatalf("tokens %q %q", a, b)
+	}
+}
+
+func TestCloseDropsSessionsWithoutExpiring(t *testing.T) {
+	r := NewRegistry(10*time.Millisecond, func(s *Session) { t.Errorf("session %s expired after Close", s.UserName) })
+	r.Suspend(&Session{Token: NewToken(), UserName: "alice"})
+	r.Close()
+	if r.Len() != 0 {
+		t.Fatalf("Len = %d after Close", r.Len())
+	}
+	time.Sleep(50 * time.Millisecond)
+}
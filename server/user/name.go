@@ -0,0 +1,39 @@
+package user
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrNameLength   = errors.New("user: invalid name length")
+	ErrNameCharset  = errors.New("user: invalid character in name")
+	ErrNameReserved = errors.New("user: reserved name")
+)
+
+// 保留的名字，不区分大小写，避免冒充服务器公告和管理员
+var ReservedNames = []string{"server", "admin"}
+
+// 用户自己选择的名字（改名和账号名）的规则: 长度为1到 maxLength 个字符，只能包含字母、数字和 _ - .，不能是保留的名字
+// 不允许 ':'，所以不会和默认的 "IP:Port" 名字冲突
+func ValidateName(name string, maxLength int) error {
+	if !utf8.ValidString(name) {
+		return ErrNameCharset
+	}
+	if n := utf8.RuneCountInString(name); n == 0 || n > maxLength {
+		return ErrNameLength
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-.", r) {
+			return ErrNameCharset
+		}
+	}
+	for _, reserved := range ReservedNames {
+		if strings.EqualFold(name, reserved) {
+			return ErrNameReserved
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	valid := []string{"alice", "小明", "bob_2", "a-b.c", strings.Repeat("x", 24)}
+	for _, name := range valid {
+		if err := ValidateName(name, 24); err != nil {
+			t.Errorf("ValidateName(%q) = %v, want nil", name, err)
+		}
+	}
+	invalid := map[string]error{
+		"":                        ErrNameLength,
+		strings.Repeat("x", 25):   ErrNameLength,
+		"127.0.0.1:4096":          ErrNameCharset,
+		"a b":                     ErrNameCharset,
+		"a|b":                     ErrNameCharset,
+		"server":                  ErrNameReserved,
+		"Admin":                   ErrNameReserved,
+		string([]byte{0xff, 'a'}): ErrNameCharset,
+	}
+	for name, want := range invalid {
+		if err := ValidateName(name, 24); err != want {
+			t.Errorf("ValidateName(%q) = %v, want %v", name, err, want)
+		}
+	}
+}
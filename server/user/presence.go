@@ -0,0 +1,64 @@
+package user
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 用户的在线状态
+type Presence int32
+
+const (
+	Present Presence = iota // 在线
+	Away                    // 用户自己标记的暂时离开
+	Idle                    // 长时间没有发送消息，自动标记的空闲
+)
+
+// 用户的在线状态和最近一次发送消息的时间，可以在其他协程中读取
+type presenceState struct {
+	status     atomic.Int32
+	awayMsg    atomic.Pointer[string] // 暂时离开时的说明
+	lastActive atomic.Int64           // 最近一次发送消息的时间，UnixNano
+}
+
+// 当前的在线状态和暂时离开时的说明
+func (u *User) Presence() (Presence, string) {
+	status := Presence(u.presence.status.Load())
+	if status != Away {
+		return status, ""
+	}
+	if msg := u.presence.awayMsg.Load(); msg != nil {
+		return status, *msg
+	}
+	return status, ""
+}
+
+// 标记为暂时离开，暂时离开之后不会再被标记为空闲
+func (u *User) SetAway(msg string) {
+	u.presence.awayMsg.Store(&msg)
+	u.presence.status.Store(int32(Away))
+}
+
+// 从暂时离开或空闲中回来，本来就在线时返回 false
+func (u *User) SetBack() bool {
+	return Presence(u.presence.status.Swap(int32(Present))) != Present
+}
+
+// 记录一次发送消息，心跳不算发送消息
+func (u *User) Touch() {
+	u.presence.lastActive.Store(time.Now().UnixNano())
+}
+
+// 被自动标记为空闲的用户重新发送了消息，回到在线，不是空闲时返回 false
+// 用户自己标记的暂时离开需要用 back 命令回来
+func (u *User) Wake() bool {
+	return u.presence.status.CompareAndSwap(int32(Idle), int32(Present))
+}
+
+// 超过 after 没有发送消息的在线用户标记为空闲，返回是否刚刚被标记
+func (u *User) MarkIdle(after time.Duration) bool {
+	if time.Since(time.Unix(0, u.presence.lastActive.Load())) < after {
+		return false
+	}
+	return u.presence.status.CompareAndSwap(int32(Present), int32(Idle))
+}
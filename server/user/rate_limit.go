@@ -0,0 +1,57 @@
+package user
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/metrics"
+	"chatroom/server/ratelimit"
+	"fmt"
+	"math"
+)
+
+// 请求对应的限流类型，quit 不受限制
+func rateKind(env *protocol.Envelope) (ratelimit.Kind, bool) {
+	switch env.Type {
+	case protocol.TypeQuit:
+		return 0, false
+	case protocol.TypeBroadcast:
+		return ratelimit.Broadcast, true
+	case protocol.TypePrivate:
+		return ratelimit.Private, true
+	default:
+		return ratelimit.Command, true
+	}
+}
+
+// 检查该用户的请求是否超过限流，Limiter 为 nil 时不限制
+// 超过限制时提示该用户并返回对应的 Verdict，调用者丢弃该请求；返回 Disconnect 时调用者需要断开该用户
+func (u *User) CheckRate(env *protocol.Envelope) ratelimit.Verdict {
+	if u.Limiter == nil {
+		return ratelimit.Allow
+	}
+	kind, limited := rateKind(env)
+	if !limited {
+		return ratelimit.Allow
+	}
+	verdict := u.Limiter.Check(kind)
+	switch verdict {
+	case ratelimit.Allow:
+		return verdict
+	case ratelimit.Warn:
+		u.Send(protocol.NewError(env.ID, "你发送得太快了，请稍后再试\n"))
+	case ratelimit.Mute:
+		u.Send(protocol.NewNotice(u.RoomId(), fmt.Sprintf("你发送得太快了，已被禁言%d秒\n", mutedSeconds(u.Limiter))))
+	case ratelimit.Muted:
+		u.Send(protocol.NewError(env.ID, fmt.Sprintf("你正在被禁言，还剩%d秒\n", mutedSeconds(u.Limiter))))
+	case ratelimit.Disconnect:
+		u.Send(protocol.NewNotice(u.RoomId(), "你多次发送过快，已被断开连接\n"))
+	}
+	metrics.RateLimited.WithLabelValues(verdict.String()).Inc()
+	u.Logger().Warn("rate limited", logging.KeyOp, env.Type, "action", verdict.String())
+	return verdict
+}
+
+// 禁言剩余的秒数，向上取整
+func mutedSeconds(l *ratelimit.Limiter) int {
+	return int(math.Ceil(l.MutedFor().Seconds()))
+}
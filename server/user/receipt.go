@@ -0,0 +1,98 @@
+package user
+
+import (
+	"chatroom/protocol"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 进程启动的时间，作为消息ID的前缀，重启之后分配的消息ID不会和保存下来的离线私聊重复
+	messageIDPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+	lastMessageID   atomic.Int64
+)
+
+// 分配一个服务器内唯一的消息ID
+func NewMessageID() string {
+	return messageIDPrefix + "-" + strconv.FormatInt(lastMessageID.Add(1), 10)
+}
+
+// User.receipts 的取值
+const (
+	receiptsDefault int32 = iota // 没有设置过，JSON 协议的用户开启，管道语法的用户关闭
+	receiptsOn
+	receiptsOff
+)
+
+// 开启或关闭发送确认和回执，管道语法的用户默认关闭，需要时用 receipts 命令开启
+func (u *User) SetReceipts(on bool) {
+	if on {
+		u.receipts.Store(receiptsOn)
+	} else {
+		u.receipts.Store(receiptsOff)
+	}
+}
+
+// 是否需要发送确认和回执，没有设置过时只有 JSON 协议的用户需要，telnet 用户看到的输出和原来一样
+func (u *User) WantsReceipts() bool {
+	switch u.receipts.Load() {
+	case receiptsOn:
+		return true
+	case receiptsOff:
+		return false
+	}
+	return u.Dialect() == protocol.DialectJSON
+}
+
+// 消息被服务器接受之后回复发送者，带上服务器分配的消息ID和序号
+// 请求没有ID并且不需要回执时不回复，保持管道语法原来的行为
+func (u *User) Accepted(requestID string, msg *protocol.Envelope) {
+	if requestID == "" && !u.WantsReceipts() {
+		return
+	}
+	ack := protocol.NewAck(requestID, fmt.Sprintf("消息已发送，ID:%s\n", msg.MsgID))
+	ack.Room, ack.Seq, ack.MsgID = msg.Room, msg.Seq, msg.MsgID
+	u.Send(ack)
+}
+
+// 私聊写入该用户的连接之后，记下它等待已读，并给发送者发送送达回执
+func (u *User) delivered(msg *protocol.Envelope) {
+	u.unreadMu.Lock()
+	if len(u.unread) < u.maxUnread {
+		u.unread[msg.MsgID] = msg.From
+	}
+	u.unreadMu.Unlock()
+	u.notifySender(msg.From, msg.MsgID, protocol.ReceiptDelivered, fmt.Sprintf("你发给%s的消息%s已送达\n", u.Name(), msg.MsgID))
+}
+
+// 把 msgID 对应的私聊标记为已读并给发送者发送已读回执，msgID 为空时标记所有送达的私聊
+// 返回标记的条数
+func (u *User) MarkRead(msgID string) int {
+	u.unreadMu.Lock()
+	read := make(map[string]string)
+	if msgID == "" {
+		read, u.unread = u.unread, make(map[string]string)
+	} else if from, isPresent := u.unread[msgID]; isPresent {
+		read[msgID] = from
+		delete(u.unread, msgID)
+	}
+	u.unreadMu.Unlock()
+	for id, from := range read {
+		u.notifySender(from, id, protocol.ReceiptRead, fmt.Sprintf("你发给%s的消息%s已读\n", u.Name(), id))
+	}
+	return len(read)
+}
+
+// 发送者在线并且需要回执时，给它发送回执，发送者已经离线时丢弃
+func (u *User) notifySender(from, msgID, status, body string) {
+	if u.UserMap == nil {
+		return
+	}
+	sender, ok := u.UserMap.GetUser(from)
+	if !ok || !sender.WantsReceipts() {
+		return
+	}
+	sender.Send(protocol.NewReceipt(msgID, u.Name(), status, body))
+}
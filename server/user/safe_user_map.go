@@ -1,7 +1,6 @@
 package user
 
 import (
-	"log"
 	"sync"
 	"sync/atomic"
 )
@@ -19,7 +18,6 @@ func NewSafeUserMap() *SafeUserMap {
 }
 
 func (sm *SafeUserMap) GetUser(username string) (*User, bool) {
-	log.Println("username:", username)
 	u, isPresent := sm.m.Load(username)
 	if !isPresent {
 		return nil, false
@@ -57,6 +55,19 @@ func (sm *SafeUserMap) DeleteUser(username string) (*User, bool) {
 	return user, true
 }
 
+// 把 oldName 对应的用户改存到 newName 下，newName 已被占用或 oldName 不存在时返回 false
+func (sm *SafeUserMap) Rename(oldName, newName string) (*User, bool) {
+	u, isPresent := sm.GetUser(oldName)
+	if !isPresent {
+		return nil, false
+	}
+	if _, loaded := sm.m.LoadOrStore(newName, u); loaded {
+		return nil, false
+	}
+	sm.m.Delete(oldName)
+	return u, true
+}
+
 func (sm *SafeUserMap) Len() int {
 	return int(sm.cnt.Load())
 }
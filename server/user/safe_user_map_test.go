@@ -1,14 +1,16 @@
 package user
 
 import (
+	"chatroom/config"
 	"fmt"
+	"log/slog"
 	"testing"
 )
 
 func TestNewSafeUserMap(t *testing.T) {
 	safeUserMap := NewSafeUserMap()
 	fmt.Println("safeUserMap:", safeUserMap)
-	safeUserMap.SetUser("nihao", NewUser("1", "2", "3", nil, nil))
+	safeUserMap.SetUser("nihao", NewUser("1", "2", "3", nil, nil, config.Default(), slog.Default()))
 	fmt.Println("safeUserMap set:", safeUserMap)
 	user, _ := safeUserMap.GetUser("nihao")
 	deleteUser, _ := safeUserMap.DeleteUser("nihao")
@@ -0,0 +1,172 @@
+package user
+
+import (
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/metrics"
+	"errors"
+	"slices"
+	"time"
+)
+
+// 广播消息来不及发送时的处理方式，由用户所在的房间决定
+type SlowConsumerPolicy int
+
+const (
+	DropOldest  SlowConsumerPolicy = iota // 丢弃发送队列中最早的消息，给新消息腾出位置
+	Disconnect                            // 发送队列超过 SlowConsumerHighWater 时断开该用户
+	SpillToDisk                           // 发送队列满了之后把消息写到磁盘上，追上之后再补发
+)
+
+var ErrInvalidPolicy = errors.New("user: invalid slow consumer policy")
+
+var policyNames = map[SlowConsumerPolicy]string{
+	DropOldest:  "drop_oldest",
+	Disconnect:  "disconnect",
+	SpillToDisk: "spill_to_disk",
+}
+
+func (p SlowConsumerPolicy) String() string {
+	if name, ok := policyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// 按名字解析 SlowConsumerPolicy，名字和 String 的返回值一致
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for policy, policyName := range policyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, ErrInvalidPolicy
+}
+
+// 该用户发送队列的统计
+type SendStats struct {
+	Queued  int   // 发送队列中等待写出的消息数
+	OnDisk  int   // 磁盘上等待补发的消息数
+	Dropped int64 // 累计丢弃的消息数
+	Spilled int64 // 累计写到磁盘上的消息数
+}
+
+func (u *User) SendStats() SendStats {
+	stats := SendStats{
+		Queued:  u.queued(),
+		Dropped: u.dropped.Load(),
+		Spilled: u.spilled.Load(),
+	}
+	if u.spill != nil {
+		stats.OnDisk = u.spill.Len()
+	}
+	return stats
+}
+
+// 按照 policy 把广播消息交给该用户，不会阻塞调用者
+func (u *User) Deliver(env *protocol.Envelope, policy SlowConsumerPolicy) error {
+	if u.IsClosed() {
+		return ErrUserClosed
+	}
+	switch policy {
+	case Disconnect:
+		if u.queued() >= u.highWater {
+			u.dropped.Add(1)
+			metrics.MessagesDropped.WithLabelValues("high_water").Inc()
+			u.kick("send queue over high water mark, disconnecting", "high_water", u.highWater)
+			return ErrSendQueueFull
+		}
+		return u.send(env, true)
+	case SpillToDisk:
+		return u.spillOrSend(env)
+	default:
+		return u.sendDropOldest(env)
+	}
+}
+
+// 发送队列满时丢弃最早的一条房间广播，再放入 env；私聊、回执和命令的回复不会被丢弃
+// 队列中没有广播时丢弃 env 本身
+func (u *User) sendDropOldest(env *protocol.Envelope) error {
+	u.sendMu.Lock()
+	defer u.sendMu.Unlock()
+	if len(u.outbound) >= u.sendQueueSize {
+		oldest := slices.IndexFunc(u.outbound, func(ev outboundEvent) bool { return ev.broadcast })
+		if oldest < 0 {
+			u.dropped.Add(1)
+			metrics.MessagesDropped.WithLabelValues("queue_full").Inc()
+			return ErrSendQueueFull
+		}
+		u.outbound = slices.Delete(u.outbound, oldest, oldest+1)
+		u.dropped.Add(1)
+		metrics.MessagesDropped.WithLabelValues("drop_oldest").Inc()
+	}
+	u.outbound = append(u.outbound, outboundEvent{env: env, broadcast: true})
+	u.signalOutbound()
+	return nil
+}
+
+// 正在溢出或者发送队列已满时写到磁盘上，由 listenAndWrite 在发送队列空了之后补发
+func (u *User) spillOrSend(env *protocol.Envelope) error {
+	if spilled, err := u.spill.pushIfActive(env); spilled {
+		return u.afterSpill(err)
+	}
+	if u.enqueue(outboundEvent{env: env, broadcast: true}) {
+		return nil
+	}
+	return u.afterSpill(u.spill.Push(env))
+}
+
+func (u *User) afterSpill(err error) error {
+	if errors.Is(err, ErrSpillFull) {
+		u.dropped.Add(1)
+		metrics.MessagesDropped.WithLabelValues("spill_full").Inc()
+		u.kick("spill file full, disconnecting", "max_spill_bytes", u.spill.max)
+		return err
+	}
+	if err != nil {
+		u.Logger().Warn("spill to disk failed, event dropped", logging.Err(err))
+		u.dropped.Add(1)
+		metrics.MessagesDropped.WithLabelValues("spill_failed").Inc()
+		return err
+	}
+	u.spilled.Add(1)
+	select {
+	case u.spillReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 断开跟不上的用户: 让正在进行的写入立即超时，之后的 write 都会失败，listenAndWrite 随后关闭连接
+// 先设置 kicked 再设置超时，listenAndWrite 重新设置的超时不会让它错过 kick；msg 和 args 只在第一次记录日志
+func (u *User) kick(msg string, args ...any) {
+	if u.kicked.CompareAndSwap(false, true) {
+		u.Logger().Warn(msg, args...)
+		u.Conn.SetWriteDeadline(time.Now())
+	}
+}
+
+// 在发送队列空了之后补发磁盘上的消息，写入失败时返回 false
+func (u *User) replaySpill() bool {
+	for u.spill.Len() > 0 {
+		// 发送队列里还有消息时先写队列，稍后再回来补发
+		if u.queued() > 0 {
+			select {
+			case u.spillReady <- struct{}{}:
+			default:
+			}
+			return true
+		}
+		envs, err := u.spill.Pop(u.spillBatch)
+		if err != nil {
+			u.Logger().Warn("read spilled events failed", logging.Err(err))
+		}
+		for _, env := range envs {
+			u.Conn.SetWriteDeadline(time.Now().Add(u.writeTimeout))
+			if !u.write(env) {
+				return false
+			}
+		}
+	}
+	return true
+}
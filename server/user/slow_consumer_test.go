@@ -0,0 +1,175 @@
+package user
+
+import (
+	"bufio"
+	"chatroom/config"
+	"chatroom/parameter"
+	"chatroom/protocol"
+	"chatroom/server/metrics"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// 创建一个通过 net.Pipe 连接的用户，测试通过返回的 client 读取发给该用户的消息
+func newPipeUser(t *testing.T) (*User, net.Conn) {
+	t.Helper()
+	return newPipeUserWithConfig(t, config.Default())
+}
+
+func newPipeUserWithConfig(t *testing.T, cfg *config.Config) (*User, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	u := NewUser("alice", "127.0.0.1", "1", server, NewSafeUserMap(), cfg, slog.Default())
+	t.Cleanup(func() {
+		u.Close()
+		client.Close()
+	})
+	return u, client
+}
+
+// 按顺序读出 n 条消息体
+func readBodies(t *testing.T, client net.Conn, n int) []int {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(client)
+	bodies := make([]int, 0, n)
+	for len(bodies) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read %d of %d messages: %v", len(bodies), n, err)
+		}
+		body, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil {
+			t.Fatalf("unexpected line %q", line)
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{DropOldest, Disconnect, SpillToDisk} {
+		if got, err := ParseSlowConsumerPolicy(policy.String()); err != nil || got != policy {
+			t.Errorf("ParseSlowConsumerPolicy(%q) = %v, %v", policy.String(), got, err)
+		}
+	}
+	if _, err := ParseSlowConsumerPolicy("block"); err != ErrInvalidPolicy {
+		t.Fatalf("err = %v, want ErrInvalidPolicy", err)
+	}
+}
+
+func TestDropOldestKeepsNewestMessages(t *testing.T) {
+	u, client := newPipeUser(t)
+	const total = parameter.UserSendQueueSize + 100
+	evicted := testutil.ToFloat64(metrics.MessagesDropped.WithLabelValues("drop_oldest"))
+	for i := 1; i <= total; i++ {
+		if err := u.Deliver(protocol.NewMessage(1, "bob", "", strconv.Itoa(i)), DropOldest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := u.SendStats()
+	if stats.Dropped == 0 || stats.Spilled != 0 {
+		t.Fatalf("stats = %+v, want some dropped and none spilled", stats)
+	}
+	// 丢弃最早的消息是一次丢弃，不是重试
+	if got := testutil.ToFloat64(metrics.MessagesDropped.WithLabelValues("drop_oldest")) - evicted; got != float64(stats.Dropped) {
+		t.Fatalf("messages_dropped_total{reason=drop_oldest} grew by %v, want %d", got, stats.Dropped)
+	}
+	bodies := readBodies(t, client, total-int(stats.Dropped))
+	if last := bodies[len(bodies)-1]; last != total {
+		t.Fatalf("last message = %d, want %d", last, total)
+	}
+	for i := 1; i < len(bodies); i++ {
+		if bodies[i] <= bodies[i-1] {
+			t.Fatalf("messages out of order: %v", bodies)
+		}
+	}
+}
+
+// 私聊、回执和命令的回复不会被 drop_oldest 丢弃，只丢弃房间的广播
+func TestDropOldestKeepsNonBroadcasts(t *testing.T) {
+	u, client := newPipeUser(t)
+	if err := u.Send(protocol.NewMessage(1, "bob", "alice", "0")); err != nil {
+		t.Fatal(err)
+	}
+	const total = parameter.UserSendQueueSize + 100
+	for i := 1; i <= total; i++ {
+		if err := u.Deliver(protocol.NewMessage(1, "bob", "", strconv.Itoa(i)), DropOldest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := u.SendStats()
+	bodies := readBodies(t, client, total+1-int(stats.Dropped))
+	if bodies[0] != 0 {
+		t.Fatalf("private message evicted, first message = %d", bodies[0])
+	}
+	if last := bodies[len(bodies)-1]; last != total {
+		t.Fatalf("last message = %d, want %d", last, total)
+	}
+}
+
+func TestDisconnectAfterHighWater(t *testing.T) {
+	u, client := newPipeUser(t)
+	for i := 1; i <= parameter.SlowConsumerHighWater+10; i++ {
+		u.Deliver(protocol.NewMessage(1, "bob", "", strconv.Itoa(i)), Disconnect)
+	}
+	if stats := u.SendStats(); stats.Dropped == 0 {
+		t.Fatalf("stats = %+v, want dropped messages", stats)
+	}
+	// 连接被服务端关闭，读完已经写出的消息之后读到 EOF
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+}
+
+func TestSpillToDiskReplaysInOrder(t *testing.T) {
+	u, client := newPipeUser(t)
+	const total = parameter.UserSendQueueSize*2 + 50
+	for i := 1; i <= total; i++ {
+		if err := u.Deliver(protocol.NewMessage(1, "bob", "", strconv.Itoa(i)), SpillToDisk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := u.SendStats(); stats.Spilled == 0 || stats.Dropped != 0 {
+		t.Fatalf("stats = %+v, want spilled and none dropped", stats)
+	}
+	bodies := readBodies(t, client, total)
+	for i, body := range bodies {
+		if body != i+1 {
+			t.Fatalf("message %d = %d, want %d", i, body, i+1)
+		}
+	}
+	if stats := u.SendStats(); stats.OnDisk != 0 {
+		t.Fatalf("stats after replay = %+v, want nothing left on disk", stats)
+	}
+}
+
+// 消息文件超过 user.max_spill_bytes 之后断开用户，不会无限占用磁盘
+func TestSpillToDiskDisconnectsWhenFull(t *testing.T) {
+	cfg := config.Default()
+	cfg.User.MaxSpillBytes = 4096
+	u, client := newPipeUserWithConfig(t, cfg)
+	full := false
+	for i := 1; i <= parameter.UserSendQueueSize*4 && !full; i++ {
+		full = u.Deliver(protocol.NewMessage(1, "bob", "", strconv.Itoa(i)), SpillToDisk) == ErrSpillFull
+	}
+	if !full {
+		t.Fatal("spill file never reported full")
+	}
+	if stats := u.SendStats(); stats.Dropped == 0 {
+		t.Fatalf("stats = %+v, want dropped messages", stats)
+	}
+	// 连接被服务端关闭，读完已经写出的消息之后读到 EOF
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package user
+
+import (
+	"bufio"
+	"chatroom/protocol"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+var ErrSpillFull = errors.New("user: spill file full")
+
+// 保存在磁盘上的发送队列，发送队列满了之后的广播消息按顺序追加到文件中
+// 文件中的消息全部读完之后删除文件，下次溢出时重新创建；文件最多写入 max 个字节，超过时返回 ErrSpillFull
+type spillQueue struct {
+	mu       sync.Mutex
+	dir      string        // 文件所在目录，为空时使用系统临时目录
+	file     *os.File      // 追加写入的文件，为 nil 时没有溢出的消息
+	readFile *os.File      // 同一个文件的读句柄
+	reader   *bufio.Reader // 从 readFile 的开头顺序读取
+	pending  int           // 文件中还没有读走的消息条数
+	size     int64         // 文件已经写入的字节数，读走的消息在文件删除之前仍然占用磁盘
+	max      int64         // 文件最多写入的字节数
+}
+
+func newSpillQueue(dir string, max int64) *spillQueue {
+	return &spillQueue{dir: dir, max: max}
+}
+
+// 正在溢出时把 env 追加到文件末尾并返回 true，没有溢出时返回 false
+// 溢出期间新的广播消息都要进入文件，保证消息的顺序
+func (q *spillQueue) pushIfActive(env *protocol.Envelope) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return false, nil
+	}
+	return true, q.push(env)
+}
+
+// 把 env 追加到文件末尾，需要时创建文件
+func (q *spillQueue) Push(env *protocol.Envelope) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		file, err := os.CreateTemp(q.dir, "chatroom-spill-*.jsonl")
+		if err != nil {
+			return err
+		}
+		readFile, err := os.Open(file.Name())
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		q.file, q.readFile, q.reader = file, readFile, bufio.NewReader(readFile)
+	}
+	return q.push(env)
+}
+
+// 调用者需要持有 q.mu
+func (q *spillQueue) push(env *protocol.Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if q.size+int64(len(data)) > q.max {
+		return ErrSpillFull
+	}
+	if _, err := q.file.Write(data); err != nil {
+		return err
+	}
+	q.size += int64(len(data))
+	q.pending++
+	return nil
+}
+
+// 按顺序读出最多 n 条消息，文件读完时删除文件
+func (q *spillQueue) Pop(n int) ([]*protocol.Envelope, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var envs []*protocol.Envelope
+	for len(envs) < n && q.pending > 0 {
+		line, err := q.reader.ReadBytes('\n')
+		if err != nil {
+			q.remove()
+			return envs, err
+		}
+		q.pending--
+		env := &protocol.Envelope{}
+		if err := json.Unmarshal(line, env); err != nil {
+			continue
+		}
+		envs = append(envs, env)
+	}
+	if q.pending == 0 {
+		q.remove()
+	}
+	return envs, nil
+}
+
+// 文件中还没有读走的消息条数
+func (q *spillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// 丢弃所有溢出的消息并删除文件
+func (q *spillQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.remove()
+}
+
+// 调用者需要持有 q.mu
+func (q *spillQueue) remove() {
+	if q.file == nil {
+		return
+	}
+	name := q.file.Name()
+	q.file.Close()
+	q.readFile.Close()
+	q.file, q.readFile, q.reader, q.pending, q.size = nil, nil, nil, 0, 0
+	os.Remove(name)
+}
@@ -1,53 +1,348 @@
 package user
 
 import (
+	"chatroom/codec"
+	"chatroom/config"
+	"chatroom/logging"
+	"chatroom/protocol"
+	"chatroom/server/metrics"
+	"chatroom/server/ratelimit"
 	"chatroom/utils"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 最近一次分配的用户ID
+var lastUserID atomic.Uint64
+
+var (
+	ErrUserClosed    = errors.New("user: connection closed")
+	ErrSendQueueFull = errors.New("user: send queue full")
 )
 
 // 用户对象
 type User struct {
-	UserName           string       // 对应用户名称
-	UserIP             string       // 对应用户的IP地址
-	UserPort           string       // 对应用户的端口号
-	Conn               net.Conn     // 对应聊天用户的链接
-	PrivateChatChannel chan string  // 对应私聊的channel
-	UserMap            *SafeUserMap // 每一个聊天室的Map TODO 需要修改
+	id                 uint64                            // 每个连接唯一的用户ID，不随改名和登录变化
+	name               atomic.Pointer[string]            // 对应用户名称，改名时其他协程也在读，通过 Name 和 SetName 访问
+	Account            string                            // 登录的账号名，未登录时为空
+	UserIP             string                            // 对应用户的IP地址
+	UserPort           string                            // 对应用户的端口号
+	Conn               net.Conn                          // 对应聊天用户的链接
+	Decoder            *codec.Decoder                    // 从 Conn 中切分出完整消息的解码器
+	dialect            atomic.Int32                      // 该用户协商的协议 protocol.Dialect，由第一帧决定
+	PrivateChatChannel chan *protocol.Envelope           // 对应私聊的channel
+	historyCursor      atomic.Pointer[protocol.Envelope] // 该用户在当前房间收到的最早的一条历史消息，通过 HistoryCursor 和 SetHistoryCursor 访问
+	roomId             atomic.Int64                      // 当前所在房间的ID，为0时在大厅中
+	ResumeToken        string                            // 断线重连时用来恢复会话的令牌
+	closed             atomic.Bool                       // 连接是否已经关闭
+	done               chan struct{}                     // 连接关闭时关闭，通知 listenAndSendPrivateMsg 和 listenAndWrite 退出
+	sendMu             sync.Mutex                        // 保护 outbound
+	outbound           []outboundEvent                   // 等待写入连接的事件，由 listenAndWrite 顺序写出
+	outboundReady      chan struct{}                     // outbound 中有事件时通知 listenAndWrite
+	sendQueueSize      int                               // outbound 的容量
+	spill              *spillQueue                       // SpillToDisk 策略下发送队列满了之后的消息
+	spillReady         chan struct{}                     // 通知 listenAndWrite 补发磁盘上的消息或者断开连接
+	kicked             atomic.Bool                       // 因为跟不上广播被断开（Disconnect 策略或者消息文件已满）
+	dropped            atomic.Int64                      // 累计丢弃的消息数
+	spilled            atomic.Int64                      // 累计写到磁盘上的消息数
+	UserMap            *SafeUserMap                      // 每一个聊天室的Map TODO 需要修改
+	Limiter            *ratelimit.Limiter                // 该用户请求的限流，为 nil 时不限制
+	receipts           atomic.Int32                      // 是否开启了发送确认和回执，receipts* 之一
+	unreadMu           sync.Mutex                        // 保护 unread
+	unread             map[string]string                 // 已经送达但还没有已读的私聊: 消息ID -> 发送者
+	presence           presenceState                     // 在线、暂时离开或空闲
+	lastRead           atomic.Int64                      // 最近一次收到任何消息的时间，UnixNano，心跳用它判断连接是否还活着
+	timedOut           atomic.Bool                       // 是否因为心跳超时被断开
+	maxFrameSize       int                               // 单帧消息的最大字节数
+	writeTimeout       time.Duration                     // 单条消息写入连接的超时时间
+	flushTimeout       time.Duration                     // 关闭连接前写完已经排队消息的最长时间
+	highWater          int                               // disconnect 策略下断开用户的发送队列长度
+	spillBatch         int                               // 补发磁盘上的消息时每次读出的条数
+	maxUnread          int                               // 最多记住多少条等待已读回执的私聊
+	logger             *slog.Logger                      // 带有 remote_addr 字段的 logger，通过 Logger 使用
 }
 
-func NewUser(userName, userIP, userPort string, conn net.Conn, userMap *SafeUserMap) *User {
+// logger 为该用户日志的上级 logger，会加上 remote_addr 字段，cfg 需要已经通过 Validate
+func NewUser(userName, userIP, userPort string, conn net.Conn, userMap *SafeUserMap, cfg *config.Config, logger *slog.Logger) *User {
 	user := &User{
-		UserName:           userName,
+		id:                 lastUserID.Add(1),
 		UserIP:             userIP,
 		UserPort:           userPort,
 		Conn:               conn,
-		PrivateChatChannel: make(chan string),
+		Decoder:            codec.NewDecoder(conn, cfg.Server.MaxFrameSize),
+		PrivateChatChannel: make(chan *protocol.Envelope),
+		done:               make(chan struct{}),
+		outboundReady:      make(chan struct{}, 1),
+		sendQueueSize:      cfg.User.SendQueueSize,
+		spill:              newSpillQueue(cfg.User.SpillDir, cfg.User.MaxSpillBytes),
+		spillReady:         make(chan struct{}, 1),
+		unread:             make(map[string]string),
 		UserMap:            userMap,
+		maxFrameSize:       cfg.Server.MaxFrameSize,
+		writeTimeout:       cfg.User.WriteTimeout,
+		flushTimeout:       cfg.User.FlushTimeout,
+		highWater:          cfg.User.HighWater,
+		spillBatch:         cfg.User.SpillReplayBatch,
+		maxUnread:          cfg.User.MaxUnreadReceipts,
+		logger:             logger.With(logging.KeyRemoteAddr, net.JoinHostPort(userIP, userPort)),
 	}
 
+	user.SetName(userName)
+	user.Touch()
+	user.lastRead.Store(time.Now().UnixNano())
+	metrics.ConnectedUsers.Inc()
 	go user.listenAndSendPrivateMsg()
+	go user.listenAndWrite()
 	return user
 }
 
-// 监听 PrivateChatChannel 处理message
+// 监听 PrivateChatChannel，把发给该用户的私聊写给该用户，连接关闭后退出
 func (u *User) listenAndSendPrivateMsg() {
 	for {
-		if msg, open := <-u.PrivateChatChannel; open {
-			// 在私聊之前判断，一定有两个split
-			splitMsg := strings.Split(msg, "#")
-			distName, msgBody := splitMsg[0], splitMsg[1]
-			distUser, ok := u.UserMap.GetUser(distName)
+		select {
+		case msg := <-u.PrivateChatChannel:
+			u.Send(msg)
+			metrics.PrivateMessages.Inc()
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// 把一条私聊交给该用户，该用户的连接已经关闭时丢弃消息
+func (u *User) PrivateMsgHandler(msg *protocol.Envelope) {
+	select {
+	case u.PrivateChatChannel <- msg:
+	case <-u.done:
+	}
+}
+
+// 读取该用户的下一条消息
+// 超过最大长度的消息提示用户后丢弃；第一帧用来协商协议，hello 帧本身不会返回
+func (u *User) ReadMsg() ([]byte, error) {
+	for {
+		msg, err := u.Decoder.Decode()
+		if err == nil || errors.Is(err, codec.ErrFrameTooLarge) {
+			u.lastRead.Store(time.Now().UnixNano())
+		}
+		if errors.Is(err, codec.ErrFrameTooLarge) {
+			u.Send(protocol.NewError("", fmt.Sprintf("你的消息超过了%d字节的上限，已被丢弃", u.maxFrameSize)))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if u.Dialect() == protocol.DialectUnknown {
+			dialect, hello := protocol.Negotiate(msg)
+			u.dialect.Store(int32(dialect))
+			if hello != nil {
+				u.Send(&protocol.Envelope{Version: protocol.Version, Type: protocol.TypeAck, ID: hello.ID})
+				continue
+			}
+		}
+		return msg, nil
+	}
+}
+
+// 该用户协商的协议，在收到第一帧之前为 DialectUnknown，可以在其他协程中调用
+func (u *User) Dialect() protocol.Dialect {
+	return protocol.Dialect(u.dialect.Load())
+}
+
+// 带有 user 和 remote_addr 字段的 logger，用户改名之后使用新的名字
+func (u *User) Logger() *slog.Logger {
+	return u.logger.With(logging.KeyUser, u.Name())
+}
+
+// 当前所在房间的ID，为0时在大厅中，可以在其他协程中调用
+func (u *User) RoomId() int {
+	return int(u.roomId.Load())
+}
+
+// 设置当前所在房间的ID
+func (u *User) SetRoomId(roomId int) {
+	u.roomId.Store(int64(roomId))
+}
+
+// 用户还在 roomId 房间时回到大厅，已经去了其他房间时返回 false
+func (u *User) ClearRoomId(roomId int) bool {
+	return u.roomId.CompareAndSwap(int64(roomId), 0)
+}
+
+// 关闭该用户的连接，可以重复调用
+// 连接由 listenAndWrite 在写完已经排队的事件之后关闭
+func (u *User) Close() {
+	if u.closed.CompareAndSwap(false, true) {
+		metrics.ConnectedUsers.Dec()
+		close(u.done)
+	}
+}
+
+// 每个连接唯一的用户ID，名字可以被别人重新使用，需要稳定的身份时（例如房间中的角色）使用它
+func (u *User) ID() uint64 {
+	return u.id
+}
+
+// 用户当前的名字，可以在其他协程中调用
+func (u *User) Name() string {
+	return *u.name.Load()
+}
+
+// 修改名字，调用者负责同时修改 SafeUserMap 和房间中的 key
+func (u *User) SetName(name string) {
+	u.name.Store(&name)
+}
+
+// 该用户在当前房间收到的最早的一条历史消息，history 命令从这里继续往前翻，没有时为 nil
+// 进入房间时由分配房间的协程设置，history 命令在该用户的读协程中读写
+func (u *User) HistoryCursor() *protocol.Envelope {
+	return u.historyCursor.Load()
+}
+
+func (u *User) SetHistoryCursor(cursor *protocol.Envelope) {
+	u.historyCursor.Store(cursor)
+}
+
+// 连接是否已经关闭
+func (u *User) IsClosed() bool {
+	return u.closed.Load()
+}
+
+// 发送队列中的一个事件，broadcast 为 true 的是 Deliver 放入的房间广播，drop_oldest 策略只丢弃这种事件
+type outboundEvent struct {
+	env       *protocol.Envelope
+	broadcast bool
+}
+
+// 把事件放进该用户的发送队列，不会阻塞调用者
+// 连接已经关闭时返回 ErrUserClosed，队列已满时丢弃该事件并返回 ErrSendQueueFull
+func (u *User) Send(env *protocol.Envelope) error {
+	return u.send(env, false)
+}
+
+func (u *User) send(env *protocol.Envelope, broadcast bool) error {
+	if u.IsClosed() {
+		return ErrUserClosed
+	}
+	if u.enqueue(outboundEvent{env: env, broadcast: broadcast}) {
+		return nil
+	}
+	u.Logger().Warn("send queue full, event dropped", "event", env.Type)
+	u.dropped.Add(1)
+	metrics.MessagesDropped.WithLabelValues("queue_full").Inc()
+	return ErrSendQueueFull
+}
+
+// 不阻塞地放入发送队列，队列已满时返回 false
+func (u *User) enqueue(ev outboundEvent) bool {
+	u.sendMu.Lock()
+	defer u.sendMu.Unlock()
+	if len(u.outbound) >= u.sendQueueSize {
+		return false
+	}
+	u.outbound = append(u.outbound, ev)
+	u.signalOutbound()
+	return true
+}
+
+// 取出发送队列中最早的事件，more 表示取出之后队列中还有事件
+func (u *User) dequeue() (ev outboundEvent, ok, more bool) {
+	u.sendMu.Lock()
+	defer u.sendMu.Unlock()
+	if len(u.outbound) == 0 {
+		return outboundEvent{}, false, false
+	}
+	ev = u.outbound[0]
+	u.outbound[0] = outboundEvent{}
+	u.outbound = u.outbound[1:]
+	return ev, true, len(u.outbound) > 0
+}
+
+// 发送队列中等待写出的事件数
+func (u *User) queued() int {
+	u.sendMu.Lock()
+	defer u.sendMu.Unlock()
+	return len(u.outbound)
+}
+
+// 通知 listenAndWrite 发送队列中有事件，不会阻塞
+func (u *User) signalOutbound() {
+	select {
+	case u.outboundReady <- struct{}{}:
+	default:
+	}
+}
+
+// 按顺序把发送队列中的事件写入连接，每个用户一个协程，慢的用户不会拖慢其他用户
+// 写入失败、超时或者被 kick 时关闭连接，读协程随后会发现连接断开
+// Close 之后在 flushTimeout 内写完已经排队的事件，然后关闭连接，磁盘上没有补发的消息被丢弃
+func (u *User) listenAndWrite() {
+	defer func() {
+		u.spill.Close()
+		u.Conn.Close()
+	}()
+	for {
+		select {
+		case <-u.outboundReady:
+			// 每次只写一个事件，然后回到 select，Close 之后不会继续按 writeTimeout 写完整个队列
+			ev, ok, more := u.dequeue()
 			if !ok {
-				log.Printf("SafeUserMap 没有 %s", distName)
+				continue
+			}
+			if more {
+				u.signalOutbound()
+			}
+			u.Conn.SetWriteDeadline(time.Now().Add(u.writeTimeout))
+			if !u.write(ev.env) {
+				return
+			}
+		case <-u.spillReady:
+			if !u.replaySpill() {
+				return
+			}
+		case <-u.done:
+			u.Conn.SetWriteDeadline(time.Now().Add(u.flushTimeout))
+			for {
+				ev, ok, _ := u.dequeue()
+				if !ok || !u.write(ev.env) {
+					return
+				}
 			}
-			utils.SendMessage(distUser.Conn, msgBody)
 		}
 	}
 }
 
-// 私聊的处理逻辑
-func (u *User) PrivateMsgHandler(msgBody string) {
-	u.PrivateChatChannel <- msgBody
+// 按照该用户协商的协议和分帧模式写入一个事件，失败或者已经被 kick 时返回 false
+func (u *User) write(env *protocol.Envelope) bool {
+	if u.kicked.Load() {
+		return false
+	}
+	err := codec.Encode(u.Conn, u.Decoder.Mode(), protocol.Render(u.Dialect(), env))
+	if utils.CheckError(err, fmt.Sprintf("%s write", u.Conn.RemoteAddr())) {
+		return false
+	}
+	if env.Type == protocol.TypeMessage && env.To != "" && env.MsgID != "" {
+		u.delivered(env)
+	}
+	return true
+}
+
+// 距离最近一次收到该用户的任何消息过了多久，ping、pong 和超长被丢弃的消息也算
+func (u *User) SinceLastRead() time.Duration {
+	return time.Since(time.Unix(0, u.lastRead.Load()))
+}
+
+// 标记为心跳超时，已经标记过时返回 false
+func (u *User) MarkTimedOut() bool {
+	return u.timedOut.CompareAndSwap(false, true)
+}
+
+// 是否因为心跳超时被断开
+func (u *User) TimedOut() bool {
+	return u.timedOut.Load()
 }
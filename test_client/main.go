@@ -1,6 +1,7 @@
 package main
 
 import (
+	"chatroom/codec"
 	"chatroom/utils"
 	"flag"
 	"fmt"
@@ -22,6 +23,8 @@ func init() {
 }
 
 // 测试 NumberOfUser 个用户，测试并发
+// 所有用户都来自同一个IP，服务器需要设置 CHATROOM_RATE_LIMIT_MAX_CONNS_PER_IP=0 关闭每个IP的连接数限制
+// 测试用户使用管道语法，默认没有心跳，不需要回复 ping；闲置超过 heartbeat.idle_timeout 的连接会被断开
 func main() {
 	flag.Parse()
 	var cnt atomic.Int32
@@ -36,9 +39,9 @@ func main() {
 			MsgContext := generateRandomString(16)
 			randv := rand.Intn(2)
 			if randv == 0 { // 私聊
-				conn.Write([]byte(fmt.Sprintf("%d|%s|", randv, conn.LocalAddr().String(), MsgContext)))
+				codec.Encode(conn, codec.ModeLength, []byte(fmt.Sprintf("%d|%s|%s", randv, conn.LocalAddr().String(), MsgContext)))
 			} else { // 广播
-				conn.Write([]byte(fmt.Sprintf("%d|%s", randv, MsgContext)))
+				codec.Encode(conn, codec.ModeLength, []byte(fmt.Sprintf("%d|%s", randv, MsgContext)))
 			}
 			log.Printf("第%d个用户发送消息成功, 端口为:%v\n", ix, localPort)
 			cnt.Add(1)
@@ -2,7 +2,7 @@ package utils
 
 import (
 	"io"
-	"log"
+	"log/slog"
 )
 
 // 错误处理方法
@@ -13,7 +13,7 @@ func CheckError(err error, info string, closers ...io.Closer) bool {
 				closer.Close()
 			}
 		}()
-		log.Println(info, ":", err)
+		slog.Warn(info, "err", err)
 		return true
 	}
 	return false